@@ -9,4 +9,16 @@ public static class CharacterConstants
     public const byte MaxSavedCharactersPerUser = 5;
     
     public const byte MaxVersionsPerCharacter = 50;
+
+    /// <summary>
+    /// Access token claim listing the game ids of the user's characters
+    /// </summary>
+    public const string GameIdClaim = "cid";
+
+    /// <summary>
+    /// Game servers key characters by a 64-bit id: the first 8 bytes of the
+    /// character Guid, little-endian
+    /// </summary>
+    public static ulong ToGameId(Guid characterId) =>
+        BitConverter.ToUInt64(characterId.ToByteArray(), 0);
 }
\ No newline at end of file
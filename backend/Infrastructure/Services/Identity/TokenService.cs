@@ -5,7 +5,10 @@ using System.Text;
 using Application.Contracts.Data.Identity;
 using Application.Repositories.Identity;
 using Application.Services.Identity;
+using Constants;
+using Domain.Entities;
 using Domain.Entities.Identity;
+using Microsoft.EntityFrameworkCore;
 using Microsoft.Extensions.Configuration;
 using Microsoft.IdentityModel.Tokens;
 using Persistence.Contexts;
@@ -83,7 +86,12 @@ public class TokenService : ITokenService
 
         var roleNames = await _roleManager.GetUserRolesAsync(user.Id, cancellationToken);
 
-        var claims = GetClaimsForUser(user, roleNames);
+        var characterIds = await _dbContext.Set<SavedCharacter>()
+            .Where(c => c.ApplicationUserId == user.Id)
+            .Select(c => c.Id)
+            .ToListAsync(cancellationToken);
+
+        var claims = GetClaimsForUser(user, roleNames, characterIds);
         
         var accessToken = GenerateJwt(claims);
         var accessTokenString = new JwtSecurityTokenHandler().WriteToken(accessToken);
@@ -206,7 +214,9 @@ public class TokenService : ITokenService
         };
     }
     
-    private List<Claim> GetClaimsForUser(ApplicationUser user, IReadOnlyList<string> roleNames)
+    private List<Claim> GetClaimsForUser(ApplicationUser user,
+        IReadOnlyList<string> roleNames,
+        IReadOnlyList<Guid> characterIds)
     {
         var claims = new List<Claim>
         {
@@ -217,6 +227,10 @@ public class TokenService : ITokenService
         };
 
         claims.AddRange(roleNames.Select(rn => new Claim(ClaimTypes.Role, rn)));
+        
+        // the game gateway lets a session play only the characters listed here
+        claims.AddRange(characterIds.Select(id => new Claim(CharacterConstants.GameIdClaim,
+            CharacterConstants.ToGameId(id).ToString(), ClaimValueTypes.UInteger64)));
 
         return claims;
     }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"game-server/internal/gateway"
+)
+
+// Server tick estimate, NTP style. We send PTimeSync with our send time t0;
+// the gateway stamps its zone's tick when the request arrives, and we take
+// that tick as valid at the midpoint of the round trip. Of the last few
+// samples the one with the shortest round trip wins (least queueing in it),
+// and the estimate slews toward it so rendering never jumps.
+
+const (
+	syncSamples   = 8
+	syncFastEvery = 200 * time.Millisecond // until the first answers are in
+	syncEvery     = 2 * time.Second
+	syncStepAfter = 250 * time.Millisecond // errors this big are stepped, not slewed
+)
+
+type syncSample struct {
+	rtt   time.Duration
+	epoch time.Time // local time of server tick 0, according to this sample
+}
+
+type tickSync struct {
+	mu      sync.Mutex
+	hz      float64
+	samples []syncSample // newest last
+	epoch   time.Time    // zero until the first answer
+}
+
+func (t *tickSync) add(t0, t3 time.Time, tick float64, hz uint16) {
+	if hz == 0 || t3.Before(t0) { return }
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if float64(hz) != t.hz {
+		t.hz = float64(hz)
+		t.samples = t.samples[:0]
+		t.epoch = time.Time{}
+	}
+	rtt := t3.Sub(t0)
+	mid := t0.Add(rtt / 2)
+	t.samples = append(t.samples, syncSample{rtt: rtt, epoch: mid.Add(-time.Duration(tick / t.hz * float64(time.Second)))})
+	if len(t.samples) > syncSamples { t.samples = t.samples[1:] }
+
+	best := t.samples[0]
+	for _, s := range t.samples[1:] {
+		if s.rtt < best.rtt { best = s }
+	}
+	d := best.epoch.Sub(t.epoch)
+	if t.epoch.IsZero() || d > syncStepAfter || d < -syncStepAfter {
+		t.epoch = best.epoch
+		return
+	}
+	t.epoch = t.epoch.Add(d / 4)
+}
+
+func (t *tickSync) at(now time.Time) (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.epoch.IsZero() || now.Before(t.epoch) { return 0, false }
+	return uint32(now.Sub(t.epoch).Seconds() * t.hz), true
+}
+
+// reset forgets every sample: the session moved to a zone with its own tick.
+func (t *tickSync) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = t.samples[:0]
+	t.epoch = time.Time{}
+}
+
+func (t *tickSync) synced() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.epoch.IsZero()
+}
+
+// timeSyncLoop keeps the estimate fresh: quickly until the first answer
+// (the gateway only answers once we are in a zone), then every syncEvery.
+func (p *clientState) timeSyncLoop() {
+	for {
+		every := syncEvery
+		if !p.clock.synced() { every = syncFastEvery }
+		time.Sleep(every)
+		if p.sec.Load() == nil { continue }
+		b := make([]byte, gateway.TimeSyncLen)
+		binary.LittleEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+		p.sendUnreliable(gateway.PTimeSync, b)
+	}
+}
+
+func (p *clientState) onTimeSyncOk(payload []byte) {
+	if len(payload) != gateway.TimeSyncOkLen { return }
+	t3 := time.Now()
+	t0 := time.Unix(0, int64(binary.LittleEndian.Uint64(payload[0:8])))
+	tick := float64(binary.LittleEndian.Uint32(payload[8:12])) + float64(binary.LittleEndian.Uint16(payload[12:14]))/65536
+	p.clock.add(t0, t3, tick, binary.LittleEndian.Uint16(payload[14:16]))
+}
+
+// estimatedServerTickNow is the synced tick estimate; before the first sync
+// answer it falls back to the newest replicated tick plus elapsed time.
+func (p *clientState) estimatedServerTickNow() uint32 {
+	now := time.Now()
+	if t, ok := p.clock.at(now); ok { return t }
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastServerTick == 0 || p.tickHz <= 0 { return p.lastServerTick }
+	return p.lastServerTick + uint32(now.Sub(p.lastServerAt)/(time.Second/time.Duration(p.tickHz)))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"game-server/internal/gateway"
+	"game-server/internal/shared/wire"
+)
+
+// Step25: acked-baseline replication, client side.
+//
+// Every complete move message for tick T carries the base tick B it was
+// diffed against; frame T = frame B + events. We keep more frames than the
+// zone keeps unacked views, so any base it picks is still here. Complete
+// messages are acked back (PRepAck) so the zone can advance its baseline.
+const maxFrames = 64
+
+type repKey struct {
+	tick uint32
+	ch   wire.RepChannel
+}
+
+type repParts struct {
+	base  uint32
+	parts [][]wire.RepEvent
+	got   int
+}
+
+type repFrames struct {
+	frames  map[uint32]map[uint32][2]int16
+	order   []uint32
+	partial map[repKey]*repParts
+}
+
+func newRepFrames() repFrames {
+	return repFrames{
+		frames: make(map[uint32]map[uint32][2]int16),
+		partial: make(map[repKey]*repParts),
+	}
+}
+
+func (f *repFrames) store(tick uint32, fr map[uint32][2]int16) {
+	if _, ok := f.frames[tick]; !ok {
+		f.order = append(f.order, tick)
+	}
+	f.frames[tick] = fr
+	for len(f.order) > maxFrames {
+		delete(f.frames, f.order[0])
+		f.order = f.order[1:]
+	}
+}
+
+// assemble collects the parts of one message; it returns the full event list
+// once the last part arrives.
+func (f *repFrames) assemble(rb gateway.RepBatch) ([]wire.RepEvent, bool) {
+	if rb.Parts == 1 {
+		return rb.Events, true
+	}
+	k := repKey{tick: rb.ServerTick, ch: rb.Chan}
+	ps := f.partial[k]
+	if ps == nil {
+		ps = &repParts{base: rb.BaseTick, parts: make([][]wire.RepEvent, rb.Parts)}
+		f.partial[k] = ps
+	}
+	if int(rb.Part) >= len(ps.parts) || ps.parts[rb.Part] != nil {
+		return nil, false
+	}
+	ps.parts[rb.Part] = rb.Events
+	ps.got++
+	// forget partials that can no longer complete
+	for pk := range f.partial {
+		if pk.tick+maxFrames < rb.ServerTick { delete(f.partial, pk) }
+	}
+	if ps.got < len(ps.parts) {
+		return nil, false
+	}
+	delete(f.partial, k)
+	var all []wire.RepEvent
+	for _, evs := range ps.parts { all = append(all, evs...) }
+	return all, true
+}
+
+func (p *clientState) onRepBatch(rb gateway.RepBatch) {
+	events, ok := p.rep.assemble(rb)
+	if !ok { return }
+	serverTick := rb.ServerTick
+
+	p.mu.Lock()
+	if serverTick > p.lastServerTick {
+		p.lastServerTick = serverTick
+		p.lastServerAt = time.Now()
+	}
+	p.mu.Unlock()
+
+	switch rb.Chan {
+	case wire.ChanMove:
+		base := map[uint32][2]int16{}
+		if rb.BaseTick != 0 {
+			base, ok = p.rep.frames[rb.BaseTick]
+			if !ok { return } // cannot rebuild; the zone falls back once acks stop
+		}
+		fr := make(map[uint32][2]int16, len(base)+len(events))
+		for eid, pos := range base { fr[eid] = pos }
+		for _, ev := range events {
+			eid := uint32(ev.EID)
+			switch ev.Op {
+			case wire.RepSpawn:
+				fmt.Printf("T %d SPAWN %d %d %d kind=%d mask=%d\n", serverTick, eid, ev.X, ev.Y, ev.Kind, uint32(ev.Mask))
+				fr[eid] = [2]int16{ev.X, ev.Y}
+			case wire.RepMove:
+				fmt.Printf("T %d MOV %d %d %d\n", serverTick, eid, ev.X, ev.Y)
+				fr[eid] = [2]int16{ev.X, ev.Y}
+			case wire.RepMoveDelta:
+				prev := fr[eid]
+				x, y := prev[0]+ev.X, prev[1]+ev.Y
+				fmt.Printf("T %d MOV %d %d %d\n", serverTick, eid, x, y)
+				fr[eid] = [2]int16{x, y}
+			case wire.RepDespawn:
+				fmt.Printf("T %d DESPAWN %d\n", serverTick, eid)
+				delete(fr, eid)
+			}
+		}
+		p.rep.store(serverTick, fr)
+		p.applyFrame(serverTick, fr)
+	case wire.ChanState:
+		for _, ev := range events {
+			if ev.Op == wire.RepStateHP {
+				fmt.Printf("T %d STAT %d hp=%d\n", serverTick, uint32(ev.EID), ev.Val)
+			}
+		}
+	default:
+		return
+	}
+
+	ack := make([]byte, 5)
+	putU32(ack[0:4], serverTick)
+	ack[4] = byte(rb.Chan)
+	p.sendUnreliable(gateway.PRepAck, ack)
+}
+
+// applyFrame feeds a rebuilt frame into the interpolation buffers.
+func (p *clientState) applyFrame(tick uint32, fr map[uint32][2]int16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// only the newest frame decides who exists
+	if tick >= p.lastServerTick {
+		for eid := range p.ents {
+			if _, ok := fr[eid]; !ok { delete(p.ents, eid) }
+		}
+	}
+	for eid, pos := range fr {
+		b := p.ents[eid]
+		if b == nil {
+			b = &entityBuf{}
+			p.ents[eid] = b
+		}
+		b.add(sample{tick: tick, x: pos[0], y: pos[1], at: time.Now()})
+	}
+}
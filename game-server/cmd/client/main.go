@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"crypto/ecdh"
+	"encoding/binary"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"net"
@@ -9,9 +12,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"game-server/internal/gateway"
+	"game-server/internal/netcode"
 )
 
 func main() {
@@ -20,32 +25,54 @@ func main() {
 	var charID uint64
 	var interpMs int
 	var tickHz int
+	var token, tokenFile string
 	flag.StringVar(&addr, "addr", "127.0.0.1:7777", "gateway addr")
-	flag.UintVar(&proto, "proto", 1, "protocol version")
+	flag.UintVar(&proto, "proto", gateway.ProtoVersion, "protocol version")
 	flag.Uint64Var(&charID, "char", 1, "character id")
 	flag.IntVar(&interpMs, "interpMs", 150, "interpolation delay in ms")
 	flag.IntVar(&tickHz, "tickHz", 20, "server tick rate (Hz)")
+	flag.StringVar(&token, "token", "", "access token from the identity service")
+	flag.StringVar(&tokenFile, "tokenFile", "", "read the access token from a file")
 	flag.Parse()
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil { panic(err) }
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		// the token names the character; only send -char when it was asked for explicitly
+		charSet := false
+		flag.Visit(func(f *flag.Flag) { if f.Name == "char" { charSet = true } })
+		if !charSet { charID = 0 }
+	}
 
 	raddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil { panic(err) }
 	c, err := net.DialUDP("udp", nil, raddr)
 	if err != nil { panic(err) }
-	defer c.Close()
 
 	state := newClientState(uint16(proto), c, time.Duration(interpMs)*time.Millisecond, tickHz)
-	go state.readLoop()
+	defer func() { _ = state.c.Load().Close() }()
+	go state.readLoop(c)
 	go state.renderLoop()
 
+	// nothing but the key exchange goes out in the clear
+	if err := state.keyExchange(); err != nil { panic(err) }
+
 	// send reliable HELLO
-	hello := make([]byte, 12)
+	hello := make([]byte, 14, 14+len(token))
 	putU64(hello[0:8], charID)
 	putU32(hello[8:12], uint32(0)) // interest default
+	putU16(hello[12:14], uint16(len(token)))
+	hello = append(hello, token...)
 	state.sendReliable(gateway.PHello, hello)
 
 	fmt.Println("client ready. commands:")
 	fmt.Println("  m dx dy   (movement, unreliable)")
 	fmt.Println("  a skill targetEID  (action, reliable)")
+	fmt.Println("  party invite|accept|kick charID, party leave  (reliable)")
+	fmt.Println("  r         (rebind to a new local port and resume the session)")
+	fmt.Println("  p         (link stats and server tick estimate)")
 	fmt.Println("  q")
 
 	in := bufio.NewScanner(os.Stdin)
@@ -78,7 +105,28 @@ func main() {
 			putU32(pl[0:4], tick)
 			putU16(pl[4:6], uint16(skill))
 			putU32(pl[6:10], uint32(target))
-			state.sendReliable(gateway.PAction, pl)
+			state.sendOrdered(gateway.PAction, pl)
+		case "party":
+			ops := map[string]uint8{"invite": gateway.PartyInvite, "accept": gateway.PartyAccept, "leave": gateway.PartyLeave, "kick": gateway.PartyKick}
+			var op uint8
+			if len(parts) >= 2 { op = ops[parts[1]] }
+			want := 3
+			if op == gateway.PartyLeave { want = 2 }
+			if op == 0 || len(parts) != want { fmt.Println("usage: party invite|accept|kick charID, party leave"); continue }
+			var cid uint64
+			if want == 3 { cid, _ = strconv.ParseUint(parts[2], 10, 64) }
+			pl := make([]byte, gateway.PartyLen)
+			pl[0] = op
+			putU64(pl[1:9], cid)
+			state.sendOrdered(gateway.PParty, pl)
+		case "r":
+			if err := state.rebind(); err != nil { fmt.Println("rebind:", err) }
+		case "p":
+			ls := state.link.Snapshot(time.Now())
+			state.mu.Lock()
+			last := state.lastServerTick
+			state.mu.Unlock()
+			fmt.Printf("rtt=%v jitter=%v loss=%.1f%% tick=%d (newest replicated %d)\n", ls.RTT.Round(time.Microsecond), ls.Jitter.Round(time.Microsecond), ls.Loss*100, state.estimatedServerTickNow(), last)
 		default:
 			fmt.Println("unknown")
 		}
@@ -97,8 +145,8 @@ type entityBuf struct {
 }
 
 func (b *entityBuf) add(sm sample) {
-	// ignore out-of-order far behind
-	if len(b.s) > 0 && sm.tick+200 < b.s[len(b.s)-1].tick {
+	// ignore out-of-order (frames can arrive late)
+	if len(b.s) > 0 && sm.tick < b.s[len(b.s)-1].tick {
 		return
 	}
 	// keep monotonic: if same tick, overwrite
@@ -143,151 +191,270 @@ func (b *entityBuf) interp(targetTick uint32) (x, y float64, ok bool) {
 
 type clientState struct {
 	proto uint16
-	c *net.UDPConn
+	c atomic.Pointer[net.UDPConn] // swapped by rebind
 
-	peer gatewayPeer
+	peer *netcode.Endpoint // reliable channel to the gateway
+	link netcode.LinkStats // our pings, see keepaliveLoop
 
 	mu sync.Mutex
 	interpDelay time.Duration
 	tickHz int
 
-	// clock sync (very simple): last server tick received + local time
+	// newest replicated tick + local time; the estimate until clock syncs
 	lastServerTick uint32
 	lastServerAt time.Time
+	clock tickSync // see clock.go
 
 	ents map[uint32]*entityBuf
+
+	// replication frames, touched by readLoop only (see frames.go)
+	rep repFrames
+
+	// encrypted channel (see netcode/secure.go)
+	kx *ecdh.PrivateKey
+	sec atomic.Pointer[netcode.SecureChannel]
+	secReady chan struct{}
+	challenge chan []byte // cookies from PChallenge
+
+	// from HELLO_OK, for resumption (guarded by mu)
+	sid []byte
+	resumeTok []byte
+	resumed chan struct{}
+
+	// ordered channel; osend is used from the input loop only, orecv from readLoop
+	osend netcode.OrderedSender
+	orecv *netcode.OrderedReceiver
 }
 
 func newClientState(proto uint16, c *net.UDPConn, interp time.Duration, tickHz int) *clientState {
 	st := &clientState{
 		proto: proto,
-		c: c,
 		interpDelay: interp,
 		tickHz: tickHz,
 		ents: make(map[uint32]*entityBuf),
+		rep: newRepFrames(),
+		secReady: make(chan struct{}),
+		challenge: make(chan []byte, 1),
+		resumed: make(chan struct{}, 1),
+		orecv: netcode.NewOrderedReceiver(),
+		peer: netcode.NewEndpoint(65536),
 	}
-	st.ensure()
+	st.c.Store(c)
+	kx, err := netcode.NewKeyPair()
+	if err != nil { panic(err) }
+	st.kx = kx
+	go st.retxLoop()
+	go st.keepaliveLoop()
+	go st.timeSyncLoop()
 	return st
 }
 
-func (p *clientState) ensure() {
-	if p.peer.init { return }
-	p.peer = gatewayPeer{
-		init: true,
-		nextSeq: 1,
-		pending: make(map[uint32]sent),
-		pendingBytes: 0,
-		maxPendingBytes: 65536,
-		recvMax: 0,
-		recvMask: 0,
-		rto: 200*time.Millisecond,
+func (p *clientState) sendUnreliable(ptype uint8, payload []byte) {
+	p.write(p.peer.Encode(netcode.Packet{
+		Proto: p.proto, Chan: netcode.ChanUnreliable, PType: ptype,
+		Payload: payload,
+	}))
+}
+
+// keyExchange sends our X25519 key until the gateway answers, echoing the
+// cookie once it challenges us.
+func (p *clientState) keyExchange() error {
+	var cookie []byte
+	for i := 0; i < 20; i++ {
+		pkt := netcode.EncodePacket(netcode.Packet{
+			Proto: p.proto, Chan: netcode.ChanUnreliable, PType: gateway.PKeyEx,
+			Payload: append(p.kx.PublicKey().Bytes(), cookie...),
+		}, nil)
+		_, _ = p.c.Load().Write(pkt)
+		select {
+		case <-p.secReady:
+			return nil
+		case cookie = <-p.challenge:
+		case <-time.After(250 * time.Millisecond):
+		}
 	}
-	go p.retxLoop()
+	return fmt.Errorf("no key exchange answer from gateway")
 }
 
-func (p *clientState) sendUnreliable(ptype uint8, payload []byte) {
-	p.ensure()
-	pkt := gateway.EncodePacket(gateway.Packet{
-		Proto: p.proto, Chan: gateway.ChanUnreliable, PType: ptype,
-		Seq: 0, Ack: p.peer.recvMax, AckBits: p.peer.recvMask,
-		Payload: payload,
-	}, nil)
-	_, _ = p.c.Write(pkt)
+// write seals pkt; before the key exchange completes there is nothing to send.
+func (p *clientState) write(pkt []byte) {
+	sec := p.sec.Load()
+	if sec == nil { return }
+	_, _ = p.c.Load().Write(sec.Seal(p.proto, pkt))
+}
+
+// rebind moves to a fresh local socket (what a NAT rebinding or network
+// switch looks like to the gateway) and resumes the session from there.
+func (p *clientState) rebind() error {
+	p.mu.Lock()
+	sid, tok := p.sid, p.resumeTok
+	p.mu.Unlock()
+	sec := p.sec.Load()
+	if sid == nil || sec == nil { return fmt.Errorf("no session yet") }
+
+	old := p.c.Load()
+	c, err := net.DialUDP("udp", nil, old.RemoteAddr().(*net.UDPAddr))
+	if err != nil { return err }
+	p.c.Store(c)
+	go p.readLoop(c)
+	_ = old.Close()
+
+	for i := 0; i < 10; i++ {
+		// resealed each try: a repeated counter would be dropped as a replay
+		inner := netcode.EncodePacket(netcode.Packet{
+			Proto: p.proto, Chan: netcode.ChanUnreliable, PType: gateway.PResume, Payload: tok,
+		}, nil)
+		pkt := netcode.EncodePacket(netcode.Packet{
+			Proto: p.proto, Chan: netcode.ChanUnreliable, PType: gateway.PResume,
+			Payload: append(append([]byte(nil), sid...), sec.Seal(p.proto, inner)...),
+		}, nil)
+		_, _ = c.Write(pkt)
+		select {
+		case <-p.resumed:
+			fmt.Println("resumed from", c.LocalAddr())
+			return nil
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("gateway did not confirm resume")
 }
 
 func (p *clientState) sendReliable(ptype uint8, payload []byte) {
-	p.ensure()
-	seq := p.peer.nextSeq
-	p.peer.nextSeq++
-	pkt := gateway.EncodePacket(gateway.Packet{
-		Proto: p.proto, Chan: gateway.ChanReliable, PType: ptype,
-		Seq: seq, Ack: p.peer.recvMax, AckBits: p.peer.recvMask,
+	p.sendReliableOn(netcode.ChanReliable, ptype, payload)
+}
+
+// sendOrdered delivers payload reliably and in order, fragmenting it if needed.
+func (p *clientState) sendOrdered(ptype uint8, payload []byte) {
+	frags, err := p.osend.Fragment(payload)
+	if err != nil {
+		fmt.Println("ordered send:", err)
+		return
+	}
+	for _, f := range frags { p.sendReliableOn(netcode.ChanOrdered, ptype, f) }
+}
+
+func (p *clientState) sendReliableOn(ch, ptype uint8, payload []byte) {
+	sms, err := p.peer.SendReliable(netcode.Packet{
+		Proto: p.proto, Chan: ch, PType: ptype,
 		Payload: payload,
-	}, nil)
-	if p.peer.pendingBytes+len(pkt) > p.peer.maxPendingBytes {
+	})
+	if err != nil {
 		fmt.Println("reliable backlog overflow (client)")
 		return
 	}
-	p.peer.pending[seq] = sent{pkt: pkt, sentAt: time.Now(), retries: 0}
-	p.peer.pendingBytes += len(pkt)
-	_, _ = p.c.Write(pkt)
+	p.write(sms[0].Pkt)
 }
 
-func (p *clientState) readLoop() {
+func (p *clientState) readLoop(c *net.UDPConn) {
 	buf := make([]byte, 64*1024)
 	for {
-		n, err := p.c.Read(buf)
+		n, err := c.Read(buf)
 		if err != nil { return }
-		p.ensure()
-		pk, err := gateway.DecodePacket(buf[:n])
+		sec := p.sec.Load()
+		if n < 2 || binary.LittleEndian.Uint16(buf[0:2]) != netcode.SealMagic {
+			// plaintext: only the key exchange answers, or a refusal
+			pk, err := netcode.DecodePacket(buf[:n])
+			if err != nil || sec != nil { continue }
+			if pk.PType == gateway.PDisconnect && pk.Proto != p.proto {
+				p.onDisconnect(pk.Payload)
+				continue
+			}
+			if pk.Proto != p.proto { continue }
+			if pk.PType == gateway.PChallenge {
+				select {
+				case p.challenge <- append([]byte(nil), pk.Payload...):
+				default:
+				}
+				continue
+			}
+			if pk.PType != gateway.PKeyExOk { continue }
+			sc, err := netcode.DeriveChannel(p.kx, pk.Payload, true)
+			if err != nil { continue }
+			p.sec.Store(sc)
+			close(p.secReady)
+			continue
+		}
+		if sec == nil { continue }
+		inner, err := sec.Open(buf[:n])
+		if err != nil { continue }
+		pk, err := netcode.DecodePacket(inner)
 		if err != nil { continue }
 		if pk.Proto != p.proto { continue }
 
 		// ack processing
-		p.peer.onAcks(pk.Ack, pk.AckBits)
-		if pk.Chan == gateway.ChanReliable {
-			p.peer.updateRecv(pk.Seq)
+		for _, sm := range p.peer.OnAcks(time.Now(), pk.Ack, pk.AckBits) { p.write(sm.Pkt) }
+		if pk.Reliable() {
+			p.peer.OnRecv(pk.Seq)
 		}
 
-		switch pk.PType {
-		case gateway.PText:
-			fmt.Println(string(pk.Payload))
-		case gateway.PRep:
-			line := string(pk.Payload)
-			fmt.Println(line)
-			p.consumeRepLine(line)
+		if pk.Chan != netcode.ChanOrdered {
+			p.handle(pk.PType, pk.Payload)
+			continue
 		}
+		msgs, err := p.orecv.Push(pk.PType, pk.Payload)
+		if err != nil { fmt.Println("ordered stream:", err) }
+		for _, m := range msgs { p.handle(m.PType, m.Data) }
 	}
 }
 
-// Rep lines are prefixed by gateway as:
-// "T <serverTick> <rest...>"
-func (p *clientState) consumeRepLine(line string) {
-	parts := strings.Fields(line)
-	if len(parts) < 3 || parts[0] != "T" {
-		return
+func (p *clientState) handle(ptype uint8, payload []byte) {
+	switch ptype {
+	case gateway.PText:
+		fmt.Println(string(payload))
+		p.onText(string(payload))
+	case gateway.PRepBin:
+		rb, err := gateway.DecodeRepBatch(payload)
+		if err != nil { return }
+		p.onRepBatch(rb)
+	case gateway.PPing:
+		if len(payload) == netcode.PingLen { p.sendUnreliable(gateway.PPong, payload) }
+	case gateway.PPong:
+		p.link.OnPong(payload, time.Now())
+	case gateway.PTimeSyncOk:
+		p.onTimeSyncOk(payload)
+	case gateway.PDisconnect:
+		p.onDisconnect(payload)
 	}
-	tick64, err := strconv.ParseUint(parts[1], 10, 32)
-	if err != nil { return }
-	serverTick := uint32(tick64)
-
-	p.mu.Lock()
-	p.lastServerTick = serverTick
-	p.lastServerAt = time.Now()
-	p.mu.Unlock()
+}
 
-	kind := parts[2]
-	switch kind {
-	case "SPAWN":
-		if len(parts) < 6 { return }
-		eid, _ := strconv.ParseUint(parts[3], 10, 32)
-		x64, _ := strconv.ParseInt(parts[4], 10, 16)
-		y64, _ := strconv.ParseInt(parts[5], 10, 16)
-		p.addSample(uint32(eid), serverTick, int16(x64), int16(y64))
-	case "MOV":
-		if len(parts) < 6 { return }
-		eid, _ := strconv.ParseUint(parts[3], 10, 32)
-		x64, _ := strconv.ParseInt(parts[4], 10, 16)
-		y64, _ := strconv.ParseInt(parts[5], 10, 16)
-		p.addSample(uint32(eid), serverTick, int16(x64), int16(y64))
-	case "DESPAWN":
-		if len(parts) < 4 { return }
-		eid, _ := strconv.ParseUint(parts[3], 10, 32)
+// onText picks the session handles out of HELLO_OK, notices RESUMED and
+// starts over on the target zone's ticks at XFER_PREP (zones, and instances
+// above all, do not share a tick).
+func (p *clientState) onText(msg string) {
+	switch {
+	case strings.HasPrefix(msg, "HELLO_OK "):
 		p.mu.Lock()
-		delete(p.ents, uint32(eid))
+		for _, kv := range strings.Fields(msg)[1:] {
+			k, v, _ := strings.Cut(kv, "=")
+			b, err := hex.DecodeString(v)
+			if err != nil { continue }
+			switch k {
+			case "sid": p.sid = b
+			case "resume": p.resumeTok = b
+			}
+		}
+		p.mu.Unlock()
+	case strings.HasPrefix(msg, "XFER_PREP "):
+		p.clock.reset()
+		p.rep = newRepFrames()
+		p.mu.Lock()
+		p.lastServerTick = 0
+		p.ents = make(map[uint32]*entityBuf)
 		p.mu.Unlock()
+	case msg == "RESUMED":
+		select {
+		case p.resumed <- struct{}{}:
+		default:
+		}
 	}
 }
 
-func (p *clientState) addSample(eid uint32, tick uint32, x, y int16) {
-	p.mu.Lock()
-	b := p.ents[eid]
-	if b == nil {
-		b = &entityBuf{}
-		p.ents[eid] = b
-	}
-	b.add(sample{tick: tick, x: x, y: y, at: time.Now()})
-	p.mu.Unlock()
+// onDisconnect reports why the gateway ended the session and exits, leaving
+// time for the ack (on shutdown the gateway waits for it).
+func (p *clientState) onDisconnect(payload []byte) {
+	if len(payload) < 1 { return }
+	fmt.Printf("disconnected: %s (%s)\n", gateway.DiscReasonString(payload[0]), payload[1:])
+	time.AfterFunc(100*time.Millisecond, func() { os.Exit(0) })
 }
 
 func (p *clientState) renderLoop() {
@@ -300,18 +467,11 @@ func (p *clientState) renderLoop() {
 		tickDur = time.Second / time.Duration(p.tickHz)
 	}
 	for range t.C {
+		estNowTick := p.estimatedServerTickNow()
+		// if no sync yet
+		if estNowTick == 0 { continue }
 		p.mu.Lock()
-		lastTick := p.lastServerTick
-		lastAt := p.lastServerAt
 		delay := p.interpDelay
-		// if no sync yet
-		if lastTick == 0 || lastAt.IsZero() {
-			p.mu.Unlock()
-			continue
-		}
-		// estimate current server tick based on elapsed local time since last packet
-		el := time.Since(lastAt)
-		estNowTick := lastTick + uint32(el / tickDur)
 		// render slightly behind
 		renderTick := estNowTick
 		if delay > 0 {
@@ -331,80 +491,30 @@ func (p *clientState) renderLoop() {
 	}
 }
 
+// retxLoop resends what timed out and acks reliable packets that nothing
+// outgoing carried an ack for (see netcode.AckDelay).
 func (p *clientState) retxLoop() {
-	t := time.NewTicker(50 * time.Millisecond)
+	t := time.NewTicker(netcode.AckDelay)
 	defer t.Stop()
-	for range t.C {
-		now := time.Now()
-		for seq, sm := range p.peer.pending {
-			if now.Sub(sm.sentAt) >= p.peer.rto {
-				if sm.retries >= 8 {
-					p.peer.pendingBytes -= len(p.peer.pending[seq].pkt)
-					if p.peer.pendingBytes < 0 { p.peer.pendingBytes = 0 }
-					delete(p.peer.pending, seq)
-					continue
-				}
-				sm.retries++
-				sm.sentAt = now
-				p.peer.pending[seq] = sm
-				_, _ = p.c.Write(sm.pkt)
-			}
+	for now := range t.C {
+		due, dead := p.peer.Due(now)
+		if dead {
+			fmt.Println("gateway stopped acking, giving up")
+			os.Exit(1)
 		}
+		for _, sm := range due { p.write(sm.Pkt) }
+		if p.peer.AckDue(now) { p.sendUnreliable(gateway.PAck, nil) }
 	}
 }
 
-type sent struct {
-	pkt []byte
-	sentAt time.Time
-	retries int
-}
-
-type gatewayPeer struct {
-	init bool
-	nextSeq uint32
-	pending map[uint32]sent
-	pendingBytes int
-	maxPendingBytes int
-
-	recvMax uint32
-	recvMask uint32
-
-	rto time.Duration
-}
-
-func (p *gatewayPeer) updateRecv(seq uint32) {
-	if seq == 0 { return }
-	if p.recvMax == 0 {
-		p.recvMax = seq; p.recvMask = 0; return
-	}
-	if seq > p.recvMax {
-		shift := seq - p.recvMax
-		if shift >= 32 { p.recvMask = 0 } else { p.recvMask = (p.recvMask << shift) | (1 << (shift-1)) }
-		p.recvMax = seq
-		return
-	}
-	d := p.recvMax - seq
-	if d == 0 { return }
-	if d <= 32 { p.recvMask |= 1 << (d-1) }
-}
-
-func ackedBy(ack uint32, ackBits uint32, seq uint32) bool {
-	if seq == 0 { return true }
-	if ack == seq { return true }
-	if seq > ack { return false }
-	d := ack - seq
-	if d == 0 { return true }
-	if d > 32 { return false }
-	return (ackBits & (1 << (d-1))) != 0
-}
-
-func (p *gatewayPeer) onAcks(ack uint32, ackBits uint32) {
-	for seq := range p.pending {
-		if ackedBy(ack, ackBits, seq) {
-			p.pendingBytes -= len(p.pending[seq].pkt)
-			if p.pendingBytes < 0 { p.pendingBytes = 0 }
-			delete(p.pending, seq)
-		}
+// keepaliveLoop pings the gateway: it keeps the session alive while we are
+// idle and measures the link (the "p" command prints it).
+func (p *clientState) keepaliveLoop() {
+	t := time.NewTicker(netcode.PingInterval)
+	defer t.Stop()
+	for now := range t.C {
+		if p.sec.Load() == nil { continue }
+		p.sendUnreliable(gateway.PPing, p.link.NextPing(now))
 	}
 }
 
@@ -10,21 +10,38 @@ import (
 	"time"
 
 	"game-server/internal/gateway"
+	"game-server/internal/shared"
+	"game-server/internal/shared/topology"
 )
 
 func main() {
 	var udpAddr string
 	var proto uint
 	flag.StringVar(&udpAddr, "udp", ":7777", "UDP listen address")
-	flag.UintVar(&proto, "proto", 1, "UDP protocol version")
+	flag.UintVar(&proto, "proto", gateway.ProtoVersion, "UDP protocol version")
 	var rateBps int
 	var burst int
 	var maxRel int
 	flag.IntVar(&rateBps, "rateBps", 20000, "per-session UDP send rate bytes/sec")
 	flag.IntVar(&burst, "burst", 40000, "per-session burst bytes")
 	flag.IntVar(&maxRel, "maxReliableBytes", 65536, "max pending reliable bytes per session")
+	var drain time.Duration
+	flag.DurationVar(&drain, "drain", 3*time.Second, "on shutdown, how long clients get to ack the notice")
 
-	zones := make(gateway.ZoneFlags)
+	var httpAddr string
+	flag.StringVar(&httpAddr, "http", "", "HTTP metrics address (e.g. :9102)")
+	var authKey, authIss, authAud, authChar string
+	var authInsecure bool
+	flag.StringVar(&authKey, "authKey", "", "identity service RSA public key (PEM) for PHello tokens")
+	flag.StringVar(&authIss, "authIssuer", "", "required token issuer (empty = any)")
+	flag.StringVar(&authAud, "authAudience", "Microservices", "required token audience (empty = any)")
+	flag.StringVar(&authChar, "authCharClaim", gateway.DefaultCharClaim, "token claim listing the account's characters")
+	flag.BoolVar(&authInsecure, "authInsecure", false, "trust the client's character id (local dev only)")
+
+	var worldPath string
+	flag.StringVar(&worldPath, "world", "configs/world.json", "world map, the same file the zones load")
+
+	zones := make(shared.ZoneAddrs)
 	flag.Var(zones, "zone", "Zone mapping: <zoneID>=<host:port> (repeatable)")
 	flag.Parse()
 
@@ -32,6 +49,22 @@ func main() {
 		log.Fatalf("provide at least one -zone")
 	}
 
+	world, err := topology.Load(worldPath)
+	if err != nil { log.Fatalf("world map: %v", err) }
+
+	var auth gateway.Authenticator
+	switch {
+	case authKey != "":
+		key, err := gateway.LoadRSAPublicKey(authKey)
+		if err != nil { log.Fatalf("auth key: %v", err) }
+		auth = &gateway.JWTAuth{Key: key, Issuer: authIss, Audience: authAud, Leeway: 30*time.Second, CharClaim: authChar}
+	case authInsecure:
+		log.Printf("WARNING: -authInsecure, clients pick their own character")
+		auth = gateway.InsecureAuth{}
+	default:
+		log.Fatalf("provide -authKey (or -authInsecure for local dev)")
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
@@ -41,9 +74,13 @@ func main() {
 		IdleTimeout: 30*time.Second,
 		ProtoVersion: uint16(proto),
 		TransferTimeout: 3*time.Second,
+		DrainTimeout: drain,
 		RateBytesPerSec: rateBps,
 		BurstBytes: burst,
 		MaxReliableBytes: maxRel,
+		HTTPAddr: httpAddr,
+		Auth: auth,
+		World: world,
 	})
 	if err != nil { log.Fatalf("gateway init: %v", err) }
 	if err := srv.Start(ctx); err != nil { log.Fatalf("gateway: %v", err) }
@@ -7,8 +7,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"game-server/internal/persist"
+	"game-server/internal/shared"
+	"game-server/internal/shared/topology"
 	"game-server/internal/zone"
 )
 
@@ -22,8 +25,21 @@ func main() {
 	flag.StringVar(&httpAddr, "http", "", "HTTP metrics address (e.g. :9101)")
 	flag.UintVar(&zoneID, "zone", 1, "Zone ID")
 	flag.StringVar(&storeDir, "store", "./data", "store directory")
+	var worldPath string
+	flag.StringVar(&worldPath, "world", "configs/world.json", "world map: zone areas, neighbours and portals")
+	peers := make(shared.ZoneAddrs)
+	flag.Var(peers, "peer", "neighbour zone for ghost entities: <zoneID>=<host:port> (repeatable)")
+	var drain time.Duration
+	flag.DurationVar(&drain, "drain", 5*time.Second, "on shutdown, how long saves and snapshots get to flush")
+	var maxInstances int
+	flag.IntVar(&maxInstances, "maxInstances", 64, "instanced zone: how many instances this process hosts at most")
+	var instanceIdle time.Duration
+	flag.DurationVar(&instanceIdle, "instanceIdle", 30*time.Second, "instanced zone: how long an empty instance is kept")
 	flag.Parse()
 
+	world, err := topology.Load(worldPath)
+	if err != nil { log.Fatalf("world map: %v", err) }
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
@@ -37,17 +53,7 @@ func main() {
 	snapQ := persist.NewSnapshotQueue(snapStore, 1000)
 	go func() { _ = snapQ.Run(ctx) }()
 
-	// toy transfer mapping:
-	// zone 1 transfers to 2 when X > 100
-	// zone 2 transfers to 1 when X < -100
-	var target uint32 = 2
-	var boundary int16 = 100
-	if zoneID == 2 {
-		target = 1
-		boundary = -100
-	}
-
-	s := zone.New(zone.Config{
+	cfg := zone.Config{
 		ListenAddr: listen,
 		HTTPAddr: httpAddr,
 		ZoneID: uint32(zoneID),
@@ -55,6 +61,7 @@ func main() {
 		AOIRadius: 25,
 		CellSize: 8,
 		BudgetBytes: 900,
+		DeltaMove: true,
 		StateEveryTicks: 5,
 		SaveEveryTicks: 20,
 		Store: store,
@@ -63,11 +70,20 @@ func main() {
 		SnapshotStore: snapStore,
 		SnapshotQ: snapQ,
 		AIBudgetPerTick: 200,
-		TransferTargetZone: target,
-		TransferBoundaryX: boundary,
+		World: world,
+		Peers: peers,
 		TransferTimeoutTicks: 60,
+		TransferRetryTicks: 40,
 		HistoryTicks: 40,
 		RewindMaxTicks: 5,
-	})
-	if err := s.Start(ctx); err != nil { log.Fatalf("zone: %v", err) }
+		DrainTimeout: drain,
+		MaxInstances: maxInstances,
+		InstanceIdle: instanceIdle,
+	}
+	if world.Instanced(shared.ZoneID(zoneID)) {
+		// a template: this process hosts its instances
+		if err := zone.NewHost(cfg).Start(ctx); err != nil { log.Fatalf("zone: %v", err) }
+		return
+	}
+	if err := zone.New(cfg).Start(ctx); err != nil { log.Fatalf("zone: %v", err) }
 }
@@ -0,0 +1,163 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"game-server/internal/shared"
+)
+
+// Authenticator checks the credential a client presents in PHello. The
+// gateway never trusts a character id from the client on its own.
+type Authenticator interface {
+	Authenticate(token string, now time.Time) (Identity, error)
+}
+
+// Identity is what a verified credential grants a session.
+type Identity struct {
+	Account string               // identity service subject
+	Chars   []shared.CharacterID // the account's characters; nil grants any (InsecureAuth)
+}
+
+// Character picks the session's character: the requested one if the account
+// owns it, or the account's only character when the client asks for none.
+func (id Identity) Character(req shared.CharacterID) (shared.CharacterID, bool) {
+	if id.Chars == nil { return req, true }
+	if req == 0 && len(id.Chars) == 1 { return id.Chars[0], true }
+	for _, c := range id.Chars {
+		if c == req { return c, true }
+	}
+	return 0, false
+}
+
+// JWTAuth verifies RS256 access tokens issued by the identity service,
+// offline, against its public key.
+type JWTAuth struct {
+	Key      *rsa.PublicKey
+	Issuer   string        // required iss; empty skips the check
+	Audience string        // required aud; empty skips the check
+	Leeway   time.Duration // clock skew allowed on exp/nbf
+	// CharClaim names the claim listing the account's characters; empty
+	// means DefaultCharClaim.
+	CharClaim string
+}
+
+// DefaultCharClaim is the claim the identity service lists the account's
+// characters in, one game id (number or numeric string) per value.
+const DefaultCharClaim = "cid"
+
+// LoadRSAPublicKey reads a PEM "PUBLIC KEY" (PKIX) or "RSA PUBLIC KEY" (PKCS#1) file.
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil { return nil, err }
+	blk, _ := pem.Decode(raw)
+	if blk == nil { return nil, fmt.Errorf("%s: no PEM block", path) }
+	if blk.Type == "RSA PUBLIC KEY" { return x509.ParsePKCS1PublicKey(blk.Bytes) }
+	k, err := x509.ParsePKIXPublicKey(blk.Bytes)
+	if err != nil { return nil, err }
+	rk, ok := k.(*rsa.PublicKey)
+	if !ok { return nil, fmt.Errorf("%s: not an RSA key", path) }
+	return rk, nil
+}
+
+type jwtClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"` // string or array
+	Exp *int64          `json:"exp"`
+	Nbf *int64          `json:"nbf"`
+}
+
+func (a *JWTAuth) Authenticate(token string, now time.Time) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 { return Identity{}, errors.New("malformed token") }
+
+	hdrRaw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil { return Identity{}, errors.New("malformed token header") }
+	var hdr struct{ Alg string `json:"alg"` }
+	if err := json.Unmarshal(hdrRaw, &hdr); err != nil { return Identity{}, errors.New("malformed token header") }
+	// pinning the algorithm rules out alg=none and HS256-with-public-key tricks
+	if hdr.Alg != "RS256" { return Identity{}, fmt.Errorf("unsupported alg %q", hdr.Alg) }
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil { return Identity{}, errors.New("malformed token signature") }
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(a.Key, crypto.SHA256, sum[:], sig); err != nil {
+		return Identity{}, errors.New("bad signature")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil { return Identity{}, errors.New("malformed token claims") }
+	var c jwtClaims
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(body, &c); err != nil { return Identity{}, errors.New("malformed token claims") }
+	if err := json.Unmarshal(body, &all); err != nil { return Identity{}, errors.New("malformed token claims") }
+
+	if c.Exp == nil || now.After(time.Unix(*c.Exp, 0).Add(a.Leeway)) { return Identity{}, errors.New("token expired") }
+	if c.Nbf != nil && now.Add(a.Leeway).Before(time.Unix(*c.Nbf, 0)) { return Identity{}, errors.New("token not yet valid") }
+	if a.Issuer != "" && c.Iss != a.Issuer { return Identity{}, errors.New("wrong issuer") }
+	if a.Audience != "" && !audHas(c.Aud, a.Audience) { return Identity{}, errors.New("wrong audience") }
+	if c.Sub == "" { return Identity{}, errors.New("missing sub") }
+
+	name := a.CharClaim
+	if name == "" { name = DefaultCharClaim }
+	chars, err := parseCharClaim(name, all[name])
+	if err != nil { return Identity{}, err }
+	return Identity{Account: c.Sub, Chars: chars}, nil
+}
+
+func audHas(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil { return one == want }
+	var many []string
+	if json.Unmarshal(raw, &many) != nil { return false }
+	for _, a := range many {
+		if a == want { return true }
+	}
+	return false
+}
+
+// parseCharClaim reads the character claim: one id, or an array of them as
+// a JWT writer emits for a repeated claim.
+func parseCharClaim(name string, raw json.RawMessage) ([]shared.CharacterID, error) {
+	if len(raw) == 0 { return nil, errors.New("missing " + name + " claim") }
+	vals := []json.RawMessage{raw}
+	if raw[0] == '[' {
+		if err := json.Unmarshal(raw, &vals); err != nil || len(vals) == 0 { return nil, errors.New("bad " + name + " claim") }
+	}
+	chars := make([]shared.CharacterID, 0, len(vals))
+	for _, v := range vals {
+		cid, ok := parseCharID(v)
+		if !ok { return nil, errors.New("bad " + name + " claim") }
+		chars = append(chars, cid)
+	}
+	return chars, nil
+}
+
+func parseCharID(raw json.RawMessage) (shared.CharacterID, bool) {
+	s := string(raw)
+	if len(s) > 0 && s[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil { return 0, false }
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v == 0 { return 0, false }
+	return shared.CharacterID(v), true
+}
+
+// InsecureAuth trusts the character id in PHello. Local development only.
+type InsecureAuth struct{}
+
+func (InsecureAuth) Authenticate(token string, now time.Time) (Identity, error) {
+	return Identity{}, nil
+}
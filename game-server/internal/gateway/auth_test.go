@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"game-server/internal/shared"
+)
+
+// gameID is CharacterConstants.ToGameId on the identity service: the first
+// 8 bytes of Guid.ToByteArray() little-endian, i.e. Data1 | Data2<<32 | Data3<<48.
+func gameID(t *testing.T, guid string) shared.CharacterID {
+	d1, err1 := strconv.ParseUint(guid[0:8], 16, 32)
+	d2, err2 := strconv.ParseUint(guid[9:13], 16, 16)
+	d3, err3 := strconv.ParseUint(guid[14:18], 16, 16)
+	if err1 != nil || err2 != nil || err3 != nil { t.Fatalf("bad guid %q", guid) }
+	return shared.CharacterID(d1 | d2<<32 | d3<<48)
+}
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, hdr, claims map[string]any) string {
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil { t.Fatal(err) }
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signing := enc(hdr) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil { t.Fatal(err) }
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthBackendToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil { t.Fatal(err) }
+	now := time.Unix(1_800_000_000, 0)
+	c1 := gameID(t, "3f2504e0-4f89-11d3-9a0c-0305e82c3301")
+	c2 := gameID(t, "7c9e6679-7425-40de-944b-e07fc1f90ae7")
+	if c1 != 1284457769619227872 { t.Fatalf("gameID = %d", c1) }
+
+	// what TokenService.CreateJwtAsync writes through JwtSecurityTokenHandler:
+	// a repeated claim becomes an array, UInteger64 values are numbers
+	hdr := map[string]any{"alg": "RS256", "kid": "main-key", "typ": "JWT"}
+	backend := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"sub": "b0a5f3c2-1f0e-4a39-9d55-2f0d3b7e9a11",
+			"name": "alice",
+			"email": "alice@example.com",
+			"jti": "5d1e3f7a-0c2b-4e8d-a1f6-9b7c3d2e1f00",
+			"http://schemas.microsoft.com/ws/2008/06/identity/claims/role": "Player",
+			"cid": []uint64{uint64(c1), uint64(c2)},
+			"exp": now.Add(time.Hour).Unix(),
+			"iss": "AuthService",
+			"aud": "Microservices",
+		}
+		if edit != nil { edit(c) }
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		auth    JWTAuth
+		hdr     map[string]any
+		claims  map[string]any
+		req     shared.CharacterID
+		want    shared.CharacterID // 0: Authenticate or Character refuses
+	}{
+		{name: "backend token, first character", claims: backend(nil), req: c1, want: c1},
+		{name: "backend token, second character", claims: backend(nil), req: c2, want: c2},
+		{name: "character of another account", claims: backend(nil), req: c1 + 1},
+		{name: "no request with several characters", claims: backend(nil)},
+		{name: "single character, no request", claims: backend(func(c map[string]any) { c["cid"] = uint64(c2) }), want: c2},
+		{name: "numeric string", claims: backend(func(c map[string]any) { c["cid"] = strconv.FormatUint(uint64(c1), 10) }), req: c1, want: c1},
+		{name: "account without characters", claims: backend(func(c map[string]any) { delete(c, "cid") }), req: c1},
+		{name: "configured claim name", auth: JWTAuth{CharClaim: "chars"},
+			claims: backend(func(c map[string]any) { c["chars"], c["cid"] = c["cid"], uint64(c1 + 1) }), req: c2, want: c2},
+		{name: "issuer and audience", auth: JWTAuth{Issuer: "AuthService", Audience: "Microservices"}, claims: backend(nil), req: c1, want: c1},
+		{name: "audience array", auth: JWTAuth{Audience: "Microservices"},
+			claims: backend(func(c map[string]any) { c["aud"] = []string{"Other", "Microservices"} }), req: c1, want: c1},
+		{name: "wrong issuer", auth: JWTAuth{Issuer: "Elsewhere"}, claims: backend(nil), req: c1},
+		{name: "wrong audience", auth: JWTAuth{Audience: "Game"}, claims: backend(nil), req: c1},
+		{name: "expired", claims: backend(func(c map[string]any) { c["exp"] = now.Add(-time.Minute).Unix() }), req: c1},
+		{name: "expired within leeway", auth: JWTAuth{Leeway: 2*time.Minute},
+			claims: backend(func(c map[string]any) { c["exp"] = now.Add(-time.Minute).Unix() }), req: c1, want: c1},
+		{name: "not yet valid", claims: backend(func(c map[string]any) { c["nbf"] = now.Add(time.Minute).Unix() }), req: c1},
+		{name: "no exp", claims: backend(func(c map[string]any) { delete(c, "exp") }), req: c1},
+		{name: "no sub", claims: backend(func(c map[string]any) { delete(c, "sub") }), req: c1},
+		{name: "alg none", hdr: map[string]any{"alg": "none"}, claims: backend(nil), req: c1},
+		{name: "bad character id", claims: backend(func(c map[string]any) { c["cid"] = []any{uint64(c1), "x"} }), req: c1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := tt.auth
+			a.Key = &key.PublicKey
+			h := tt.hdr
+			if h == nil { h = hdr }
+			id, err := a.Authenticate(signJWT(t, key, h, tt.claims), now)
+			got := shared.CharacterID(0)
+			if err == nil {
+				if id.Account != tt.claims["sub"] { t.Errorf("account = %q", id.Account) }
+				got, _ = id.Character(tt.req)
+			}
+			if got != tt.want { t.Errorf("character = %d (err %v), want %d", got, err, tt.want) }
+		})
+	}
+}
+
+func TestJWTAuthBadSignature(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now()
+	tok := signJWT(t, other, map[string]any{"alg": "RS256"}, map[string]any{"sub": "a", "cid": 1, "exp": now.Add(time.Hour).Unix()})
+	if _, err := (&JWTAuth{Key: &key.PublicKey}).Authenticate(tok, now); err == nil { t.Fatal("token signed by another key accepted") }
+}
+
+func TestInsecureAuthGrantsRequested(t *testing.T) {
+	id, _ := InsecureAuth{}.Authenticate("", time.Now())
+	if got, ok := id.Character(42); !ok || got != 42 { t.Fatalf("Character(42) = %d, %v", got, ok) }
+}
@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"game-server/internal/netcode"
+)
+
+// Tick clock and client time sync.
+//
+// Each zone link keeps a tickClock: wall time of the zone's tick 0, seeded
+// by the handshake (Hello.ServerTick) and corrected by MsgTickSync once a
+// second. A client's PTimeSync is answered with the zone's tick as of the
+// moment the request arrived; the client treats that as the midpoint of the
+// round trip (see cmd/client/clock.go).
+
+// PTimeSync payload:   [t0:i64 client clock]
+// PTimeSyncOk payload: [t0:i64][serverTick:u32][frac:u16 /65536][tickHz:u16]
+const (
+	TimeSyncLen   = 8
+	TimeSyncOkLen = 8 + 4 + 2 + 2
+)
+
+type tickClock struct {
+	mu    sync.Mutex
+	hz    float64
+	epoch time.Time // local time of tick 0
+}
+
+// observe takes "the zone is at tick now". Small errors are slewed out so the
+// ticks handed to clients do not jump; a tick or more off (zone stalled,
+// restarted) resets.
+func (c *tickClock) observe(hz uint16, tick uint32, now time.Time) {
+	if hz == 0 { return }
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hz = float64(hz)
+	implied := now.Add(-time.Duration(float64(tick) / c.hz * float64(time.Second)))
+	d := implied.Sub(c.epoch)
+	if c.epoch.IsZero() || d > time.Second/time.Duration(hz) || d < -time.Second/time.Duration(hz) {
+		c.epoch = implied
+		return
+	}
+	c.epoch = c.epoch.Add(d / 8)
+}
+
+// at returns the zone's tick at now, with its fractional part.
+func (c *tickClock) at(now time.Time) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch.IsZero() { return 0, false }
+	return now.Sub(c.epoch).Seconds() * c.hz, true
+}
+
+// handleTimeSync answers a client's PTimeSync from its zone's clock. While
+// the session has no zone (or the zone is down) the client gets nothing and
+// asks again later.
+func (s *Server) handleTimeSync(st *sessionState, p netcode.Packet) {
+	zid := st.Zone()
+	if len(p.Payload) != TimeSyncLen || zid == 0 { return }
+	now := time.Now()
+	s.zonesMu.Lock()
+	zl := s.zones[uint32(zid)]
+	s.zonesMu.Unlock()
+	if zl == nil { return }
+	tick, ok := zl.clock.at(now)
+	if !ok || tick < 0 { return }
+	b := make([]byte, TimeSyncOkLen)
+	copy(b[0:8], p.Payload)
+	whole := uint32(tick)
+	binary.LittleEndian.PutUint32(b[8:12], whole)
+	binary.LittleEndian.PutUint16(b[12:14], uint16((tick-float64(whole))*65536))
+	binary.LittleEndian.PutUint16(b[14:16], zl.tickHz)
+	// not shaped, like the pong: queueing would skew the client's estimate
+	s.writeSealed(st, st.peer.Encode(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PTimeSyncOk, Payload: b}))
+}
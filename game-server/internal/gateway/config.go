@@ -1,15 +1,30 @@
 package gateway
 
-import "time"
+import (
+	"time"
+
+	"game-server/internal/shared"
+	"game-server/internal/shared/topology"
+)
 
 type Config struct {
 	UDPListenAddr string
-	Zones         ZoneFlags
+	Zones         shared.ZoneAddrs
 	IdleTimeout   time.Duration
 	ProtoVersion  uint16
 	TransferTimeout time.Duration
+	DrainTimeout    time.Duration // on shutdown, how long clients get to ack the notice
 
 	RateBytesPerSec int
 	BurstBytes       int
 	MaxReliableBytes int
+
+	HTTPAddr string // metrics endpoint, empty = off
+
+	// World is the zone map: where sessions start and which zone may hand
+	// players to which.
+	World *topology.Map
+
+	// Auth verifies the token in PHello (see JWTAuth).
+	Auth Authenticator
 }
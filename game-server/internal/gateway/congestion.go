@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	"game-server/internal/shared"
+	"game-server/internal/shared/wire"
+)
+
+// Per-session congestion control (AIMD).
+//
+// Every ccInterval we look at what happened since the last look:
+//   - replication messages sent vs acked by the client (PRepAck)
+//   - reliable retransmissions
+//   - smoothed RTT against the lowest RTT seen (queueing delay)
+//
+// Any of those going bad cuts the send rate by ccDecrease (at most once per
+// RTT); a clean interval adds ccIncreaseFrac of the ceiling. The rate drives
+// the session's token bucket, and the matching per-tick byte budget is sent
+// to the zone (MsgPlayerBudget) so it stops producing what we could not send.
+
+const (
+	ccInterval     = 250 * time.Millisecond
+	ccDecrease     = 0.7
+	ccIncreaseFrac = 0.05 // of the ceiling, per clean interval
+	ccMinRate      = 2000 // bytes/sec
+	ccLossRatio    = 0.1  // unacked share of replication that counts as loss
+	ccMinSamples   = 8    // replication messages needed to judge loss
+	ccDelaySlack   = 50 * time.Millisecond
+
+	// share of the rate offered to the zone; the rest covers reliable
+	// traffic, packet headers and sealing
+	ccBudgetShare = 0.8
+)
+
+type congestion struct {
+	rate         float64
+	minRTT       time.Duration
+	lastDecrease time.Time
+
+	// cumulative stats at the previous interval
+	repSent, repAcked, retx int64
+
+	budget     uint32 // last budget sent to the zone
+	budgetZone shared.ZoneID
+}
+
+func (s *Server) congestionLoop(ctx context.Context) {
+	t := time.NewTicker(ccInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.sessionsMu.Lock()
+			sts := make([]*sessionState, 0, len(s.byRemote))
+			for _, st := range s.byRemote { sts = append(sts, st) }
+			s.sessionsMu.Unlock()
+			for _, st := range sts { s.updateCongestion(st, now) }
+		}
+	}
+}
+
+func (s *Server) updateCongestion(st *sessionState, now time.Time) {
+	cc := &st.cc
+	ceil := float64(s.cfg.RateBytesPerSec)
+	if cc.rate == 0 { cc.rate = ceil }
+
+	sent, acked, retx := st.stats.RepSent.Load(), st.stats.RepAcked.Load(), st.stats.Retransmits.Load()
+	dSent, dAcked, dRetx := sent-cc.repSent, acked-cc.repAcked, retx-cc.retx
+	cc.repSent, cc.repAcked, cc.retx = sent, acked, retx
+
+	srtt := st.peer.SRTT()
+	if srtt > 0 && (cc.minRTT == 0 || srtt < cc.minRTT) { cc.minRTT = srtt }
+
+	lossy := dSent >= ccMinSamples && float64(dSent-dAcked) > ccLossRatio*float64(dSent)
+	delayed := cc.minRTT > 0 && srtt > 2*cc.minRTT+ccDelaySlack
+	if lossy || dRetx > 0 || delayed {
+		hold := srtt
+		if hold < ccInterval { hold = ccInterval }
+		if now.Sub(cc.lastDecrease) >= hold {
+			cc.rate *= ccDecrease
+			cc.lastDecrease = now
+		}
+	} else {
+		cc.rate += ccIncreaseFrac * ceil
+	}
+	if cc.rate < ccMinRate { cc.rate = ccMinRate }
+	if cc.rate > ceil { cc.rate = ceil }
+
+	st.out.setRate(int(cc.rate), int(cc.rate*float64(s.cfg.BurstBytes)/ceil))
+	st.stats.Rate.Store(int64(cc.rate))
+	s.reportBudget(st)
+}
+
+// reportBudget tells the zone the per-tick budget matching the current rate,
+// when it moved by more than a tenth or the player changed zones.
+func (s *Server) reportBudget(st *sessionState) {
+	zid := st.Zone()
+	if st.CharID == 0 || zid == 0 { return }
+	s.zonesMu.Lock()
+	zl := s.zones[uint32(zid)]
+	s.zonesMu.Unlock()
+	if zl == nil || zl.tickHz == 0 || !zl.caps.Has(wire.CapBudget) { return }
+
+	cc := &st.cc
+	b := uint32(cc.rate * ccBudgetShare / float64(zl.tickHz))
+	if cc.budgetZone == zid && cc.budget != 0 {
+		d := int64(b) - int64(cc.budget)
+		if d < 0 { d = -d }
+		if d*10 <= int64(cc.budget) { return }
+	}
+	if zl.send(wire.MsgPlayerBudget, wire.EncodePlayerBudget(st.SID, b)) != nil { return }
+	cc.budget, cc.budgetZone = b, zid
+}
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// Stateless connection cookies.
+//
+// An address we hold no session for gets a PChallenge instead of a session:
+//
+//	cookie = [ts:u32][HMAC-SHA256(secret, addr || ts)[:16]]
+//
+// The client repeats its PKeyEx with the cookie appended; only a cookie that
+// verifies for the sender's address and is younger than cookieTTL creates a
+// session. A spoofed source never sees the cookie, so floods cost us an HMAC
+// and no memory, and the challenge is smaller than the packet that asked for
+// it, so it cannot be used to amplify traffic towards a victim.
+
+const CookieLen = 4 + 16
+
+const cookieTTL = 10 * time.Second
+
+type cookieJar struct {
+	secret [32]byte
+}
+
+func newCookieJar() *cookieJar {
+	j := &cookieJar{}
+	_, _ = rand.Read(j.secret[:])
+	return j
+}
+
+func (j *cookieJar) mac(remote string, ts uint32) []byte {
+	m := hmac.New(sha256.New, j.secret[:])
+	m.Write([]byte(remote))
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], ts)
+	m.Write(b[:])
+	return m.Sum(nil)[:CookieLen-4]
+}
+
+func (j *cookieJar) issue(remote string, now time.Time) []byte {
+	ts := uint32(now.Unix())
+	c := make([]byte, 4, CookieLen)
+	binary.LittleEndian.PutUint32(c, ts)
+	return append(c, j.mac(remote, ts)...)
+}
+
+func (j *cookieJar) verify(remote string, cookie []byte, now time.Time) bool {
+	if len(cookie) != CookieLen { return false }
+	ts := binary.LittleEndian.Uint32(cookie[0:4])
+	age := now.Sub(time.Unix(int64(ts), 0))
+	if age < -time.Second || age > cookieTTL { return false }
+	return hmac.Equal(cookie[4:], j.mac(remote, ts))
+}
@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCookieVerify(t *testing.T) {
+	j := newCookieJar()
+	now := time.Unix(1_800_000_000, 0)
+	c := j.issue("10.0.0.1:5000", now)
+	if len(c) != CookieLen { t.Fatalf("cookie is %d bytes", len(c)) }
+
+	flipped := append([]byte(nil), c...)
+	flipped[len(flipped)-1] ^= 1
+	restamped := append([]byte(nil), c...)
+	restamped[0]++ // a later timestamp under the old MAC
+
+	tests := []struct {
+		name   string
+		jar    *cookieJar
+		remote string
+		cookie []byte
+		at     time.Time
+		want   bool
+	}{
+		{name: "fresh", jar: j, remote: "10.0.0.1:5000", cookie: c, at: now, want: true},
+		{name: "at TTL", jar: j, remote: "10.0.0.1:5000", cookie: c, at: now.Add(cookieTTL), want: true},
+		{name: "expired", jar: j, remote: "10.0.0.1:5000", cookie: c, at: now.Add(cookieTTL + time.Second)},
+		{name: "clock slightly behind", jar: j, remote: "10.0.0.1:5000", cookie: c, at: now.Add(-time.Second), want: true},
+		{name: "from the future", jar: j, remote: "10.0.0.1:5000", cookie: c, at: now.Add(-2 * time.Second)},
+		{name: "other port", jar: j, remote: "10.0.0.1:5001", cookie: c, at: now},
+		{name: "other host", jar: j, remote: "10.0.0.2:5000", cookie: c, at: now},
+		{name: "other gateway", jar: newCookieJar(), remote: "10.0.0.1:5000", cookie: c, at: now},
+		{name: "bad MAC", jar: j, remote: "10.0.0.1:5000", cookie: flipped, at: now},
+		{name: "restamped", jar: j, remote: "10.0.0.1:5000", cookie: restamped, at: now.Add(time.Second)},
+		{name: "truncated", jar: j, remote: "10.0.0.1:5000", cookie: c[:CookieLen-1], at: now},
+		{name: "empty", jar: j, remote: "10.0.0.1:5000", at: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.jar.verify(tt.remote, tt.cookie, tt.at); got != tt.want { t.Errorf("verify = %v, want %v", got, tt.want) }
+		})
+	}
+}
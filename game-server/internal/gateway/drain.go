@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"log"
+	"time"
+)
+
+// drain is the gateway's shutdown: stop taking sessions, tell every client
+// (a reliable PDisconnect, so we wait for the acks up to DrainTimeout), then detach every
+// session from its zone so the zones save the characters now instead of
+// after their idle timeout. Start keeps reading UDP until drain returns.
+func (s *Server) drain() {
+	s.draining.Store(true)
+	start := time.Now()
+	s.sessionsMu.Lock()
+	sts := make([]*sessionState, 0, len(s.byRemote))
+	for _, st := range s.byRemote { sts = append(sts, st) }
+	s.sessionsMu.Unlock()
+	log.Printf("gateway draining: sessions=%d", len(sts))
+
+	var notified []*sessionState
+	for _, st := range sts {
+		if st.sec.Load() == nil { continue }
+		if s.sendReliable(st, PDisconnect, encodeDisconnect(DiscShutdown, "server shutting down")) { notified = append(notified, st) }
+	}
+	deadline := start.Add(s.cfg.DrainTimeout)
+	for time.Now().Before(deadline) && !s.noticesAcked(notified) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, st := range sts { s.dropSession(st, discNone, "gateway shutdown") }
+	log.Printf("gateway drained in %v (all notices acked: %v)", time.Since(start).Round(time.Millisecond), s.noticesAcked(notified))
+}
+
+// noticesAcked reports whether every still-live session in sts has nothing
+// unacked left.
+func (s *Server) noticesAcked(sts []*sessionState) bool {
+	for _, st := range sts {
+		if _, ok := s.getBySID(st.SID); !ok { continue }
+		if st.peer.PendingBytes() > 0 { return false }
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"log"
+
+	"game-server/internal/shared"
+	"game-server/internal/shared/wire"
+)
+
+// Instanced zones. A transfer whose target is an instanced zone of the world
+// map goes to the instance of the player's party (see party.go), or of the
+// player alone, rather than to the zone itself. We keep one live instance
+// per (template, group); when there is none yet we ask the template's host
+// for one (MsgInstanceCreate on our link to the template's id, see
+// zone.Host), park the prepare in inflight under the template id, and dial
+// the new instance once it answers. The host reports instances it tore down
+// (MsgInstanceClosed) and we forget them.
+
+type instanceKey struct {
+	template shared.ZoneID
+	group uint64 // party id, or the character's id when party is false
+	party bool
+}
+
+// instanceReq is a MsgInstanceCreate in flight and the transfers waiting
+// for its answer.
+type instanceReq struct {
+	key instanceKey
+	waiting []instanceWaiter
+}
+
+type instanceWaiter struct {
+	sid shared.SessionID
+	xfer uint64
+}
+
+// instanceKeyFor says which instance of template st enters: its party's, or
+// alone its own, keyed by character so a reconnect finds it again.
+func (s *Server) instanceKeyFor(st *sessionState, template shared.ZoneID) instanceKey {
+	s.partyMu.Lock()
+	defer s.partyMu.Unlock()
+	if p := s.partyOf[st.CharID]; p != nil { return instanceKey{template: template, group: p.id, party: true} }
+	return instanceKey{template: template, group: uint64(st.CharID)}
+}
+
+// mapZone is the world-map zone of zid: the template for an instance.
+func (s *Server) mapZone(zid uint32) shared.ZoneID {
+	s.instMu.Lock()
+	defer s.instMu.Unlock()
+	if key, ok := s.instances[zid]; ok { return key.template }
+	return shared.ZoneID(zid)
+}
+
+func (s *Server) isInstance(zid uint32) bool {
+	s.instMu.Lock()
+	defer s.instMu.Unlock()
+	_, ok := s.instances[zid]
+	return ok
+}
+
+// wantZone reports whether zid is still worth redialing: a configured zone
+// or an instance we have not forgotten.
+func (s *Server) wantZone(zid uint32) bool {
+	if _, ok := s.cfg.Zones[zid]; ok { return true }
+	return s.isInstance(zid)
+}
+
+// requestInstance parks transfer xs of st (its To is still the template)
+// until key's instance exists, asking the host for one unless a request for
+// the same key is already out.
+func (s *Server) requestInstance(st *sessionState, key instanceKey, xs *xferState) {
+	s.xferMu.Lock()
+	s.inflight[st.SID] = xs
+	s.xferMu.Unlock()
+
+	w := instanceWaiter{sid: st.SID, xfer: xs.ID}
+	s.instMu.Lock()
+	for _, ir := range s.instReqs {
+		if ir.key == key {
+			ir.waiting = append(ir.waiting, w)
+			s.instMu.Unlock()
+			return
+		}
+	}
+	s.instReqSeq++
+	req := s.instReqSeq
+	s.instReqs[req] = &instanceReq{key: key, waiting: []instanceWaiter{w}}
+	s.instMu.Unlock()
+
+	s.zonesMu.Lock()
+	zl := s.zones[uint32(key.template)]
+	s.zonesMu.Unlock()
+	if zl == nil || !zl.caps.Has(wire.CapInstances) {
+		s.instanceCreated(req, 0, "no instance host")
+		return
+	}
+	if err := zl.send(wire.MsgInstanceCreate, wire.EncodeInstanceCreate(req)); err != nil {
+		s.instanceCreated(req, 0, "no instance host")
+	}
+}
+
+// instanceCreated settles request req: instance id (0 if the host could not
+// make one, why says why) is dialed and the waiting transfers go on to it,
+// or are aborted back to their source zones.
+func (s *Server) instanceCreated(req uint32, id shared.ZoneID, why string) {
+	s.instMu.Lock()
+	ir := s.instReqs[req]
+	delete(s.instReqs, req)
+	s.instMu.Unlock()
+	if ir == nil { return }
+
+	if id != 0 {
+		zl, err := dialZone(uint32(id), s.cfg.Zones[uint32(ir.key.template)])
+		if err != nil {
+			id, why = 0, err.Error()
+		} else {
+			s.instMu.Lock()
+			s.instances[uint32(id)] = ir.key
+			s.instByKey[ir.key] = uint32(id)
+			s.instMu.Unlock()
+			s.zonesMu.Lock()
+			s.zones[uint32(id)] = zl
+			s.zonesMu.Unlock()
+			go s.superviseZone(s.run, zl)
+		}
+	}
+	if id == 0 { log.Printf("zone %d: no instance for %d transfers: %s", ir.key.template, len(ir.waiting), why) }
+
+	for _, w := range ir.waiting {
+		s.xferMu.Lock()
+		xs := s.inflight[w.sid]
+		ok := xs != nil && xs.ID == w.xfer && xs.To == ir.key.template
+		if ok && id != 0 { xs.To = id }
+		if ok && id == 0 { delete(s.inflight, w.sid) }
+		s.xferMu.Unlock()
+		if !ok { continue } // timed out or superseded meanwhile
+		if id == 0 {
+			s.abortTransfer(w.sid, xs, "no_instance")
+			continue
+		}
+		if st, ok := s.getBySID(w.sid); ok { s.attachTarget(st, xs) }
+	}
+}
+
+// failInstanceReqs settles every request out to template's host, whose link
+// just went down: no answer is coming.
+func (s *Server) failInstanceReqs(template uint32) {
+	s.instMu.Lock()
+	var reqs []uint32
+	for req, ir := range s.instReqs {
+		if uint32(ir.key.template) == template { reqs = append(reqs, req) }
+	}
+	s.instMu.Unlock()
+	for _, req := range reqs { s.instanceCreated(req, 0, "instance host down") }
+}
+
+// forgetInstance drops instance id, closed by its host or lost with it.
+// Nobody should be in it; anyone who still is has nowhere to play.
+func (s *Server) forgetInstance(id uint32, why string) {
+	s.instMu.Lock()
+	key, ok := s.instances[id]
+	if ok {
+		delete(s.instances, id)
+		if s.instByKey[key] == id { delete(s.instByKey, key) }
+	}
+	s.instMu.Unlock()
+	if !ok { return }
+	log.Printf("instance %d of zone %d forgotten: %s", id, key.template, why)
+
+	s.zonesMu.Lock()
+	zl := s.zones[id]
+	delete(s.zones, id)
+	s.zonesMu.Unlock()
+	if zl != nil { _ = zl.conn.Close() } // its supervisor will not redial
+
+	abort := make(map[shared.SessionID]*xferState)
+	s.xferMu.Lock()
+	for sid, xs := range s.inflight {
+		if uint32(xs.To) == id {
+			abort[sid] = xs
+			delete(s.inflight, sid)
+		}
+	}
+	s.xferMu.Unlock()
+	for sid, xs := range abort { s.abortTransfer(sid, xs, "no_instance") }
+	for _, st := range s.sessionsInZone(shared.ZoneID(id)) { s.dropSession(st, DiscKicked, why) }
+}
+
+// instanceFor returns key's live instance, if there is one.
+func (s *Server) instanceFor(key instanceKey) (shared.ZoneID, bool) {
+	s.instMu.Lock()
+	defer s.instMu.Unlock()
+	id, ok := s.instByKey[key]
+	return shared.ZoneID(id), ok
+}
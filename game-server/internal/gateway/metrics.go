@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// serveMetrics exports per-session outbound counters in Prometheus text
+// format (same no-deps approach as internal/metrics).
+func (s *Server) serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.sessionsMu.Lock()
+		sts := make([]*sessionState, 0, len(s.byRemote))
+		for _, st := range s.byRemote { sts = append(sts, st) }
+		s.sessionsMu.Unlock()
+		sort.Slice(sts, func(i, j int) bool { return sts[i].SID.String() < sts[j].SID.String() })
+
+		fmt.Fprintf(w, "gateway_sessions %d\n", len(sts))
+		for _, st := range sts {
+			l := fmt.Sprintf("{sid=%q,char=\"%d\"}", st.SID.String(), st.CharID)
+			fmt.Fprintf(w, "gateway_session_tx_bytes_total%s %d\n", l, st.stats.TxBytes.Load())
+			fmt.Fprintf(w, "gateway_session_rep_sent_total%s %d\n", l, st.stats.RepSent.Load())
+			fmt.Fprintf(w, "gateway_session_rep_coalesced_total%s %d\n", l, st.stats.RepCoalesced.Load())
+			fmt.Fprintf(w, "gateway_session_rel_queued_total%s %d\n", l, st.stats.RelQueued.Load())
+			fmt.Fprintf(w, "gateway_session_rel_rejected_total%s %d\n", l, st.stats.RelRejected.Load())
+			fmt.Fprintf(w, "gateway_session_retransmits_total%s %d\n", l, st.stats.Retransmits.Load())
+			fmt.Fprintf(w, "gateway_session_rate_bytes%s %d\n", l, st.stats.Rate.Load())
+			ls := st.link.Snapshot(time.Now())
+			fmt.Fprintf(w, "gateway_session_rtt_ms%s %d\n", l, ls.RTT.Milliseconds())
+			fmt.Fprintf(w, "gateway_session_jitter_ms%s %d\n", l, ls.Jitter.Milliseconds())
+			fmt.Fprintf(w, "gateway_session_ping_loss_ratio%s %.3f\n", l, ls.Loss)
+		}
+	})
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() { _ = srv.ListenAndServe() }()
+	return srv
+}
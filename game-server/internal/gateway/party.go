@@ -0,0 +1,232 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"game-server/internal/shared"
+	"game-server/internal/shared/wire"
+)
+
+// Parties: a few characters playing together. Members always see each other
+// in a zone they share, whatever the distance (MsgPlayerParty to their
+// zones), and enter the same instance of an instanced zone (see
+// instanceKeyFor). Party state lives here, keyed by character, so zone
+// transfers do not touch it; a character whose session ends leaves its party.
+//
+// PParty payload: [op:u8][cid:u64]. Only the leader invites and kicks; an
+// invite holds for partyInviteTTL and an invitee has at most one, the
+// newest. Players hear back as reliable text:
+//
+//	PARTY_INVITE from=<cid>
+//	PARTY_INVITED <cid>
+//	PARTY id=<id> leader=<cid> members=<cid>,<cid>,...   (after every change)
+//	PARTY_LEFT <why>
+//	PARTY_ERR <why>
+const (
+	PartyInvite uint8 = 1
+	PartyAccept uint8 = 2 // cid is the inviter
+	PartyLeave  uint8 = 3 // cid unused
+	PartyKick   uint8 = 4
+
+	PartyLen = 1 + 8
+
+	partyMax       = 5
+	partyInviteTTL = 60 * time.Second
+)
+
+type party struct {
+	id      uint64
+	leader  shared.CharacterID
+	members []shared.CharacterID // in joining order
+}
+
+type partyInvite struct {
+	from shared.CharacterID
+	at   time.Time
+}
+
+// partyNote is something to tell a character once partyMu is released.
+type partyNote struct {
+	cid    shared.CharacterID
+	text   string
+	others []shared.CharacterID // for its zone; nil = leave it alone
+}
+
+func (s *Server) handleParty(st *sessionState, payload []byte) {
+	if len(payload) != PartyLen || st.CharID == 0 { return }
+	op := payload[0]
+	cid := shared.CharacterID(binary.LittleEndian.Uint64(payload[1:9]))
+	me := st.CharID
+
+	var notes []partyNote
+	var why string
+	now := time.Now()
+	s.partyMu.Lock()
+	switch op {
+	case PartyInvite:
+		p := s.partyOf[me]
+		switch {
+		case cid == me:
+			why = "cannot invite yourself"
+		case p != nil && p.leader != me:
+			why = "only the leader invites"
+		case p != nil && len(p.members) >= partyMax:
+			why = "party full"
+		case s.partyOf[cid] != nil:
+			why = "already in a party"
+		case s.sessionByChar(cid) == nil:
+			why = "not online"
+		default:
+			s.invites[cid] = partyInvite{from: me, at: now}
+			notes = append(notes,
+				partyNote{cid: cid, text: sprintf("PARTY_INVITE from=%d", me)},
+				partyNote{cid: me, text: sprintf("PARTY_INVITED %d", cid)})
+		}
+	case PartyAccept:
+		inv, ok := s.invites[me]
+		if ok && inv.from == cid { delete(s.invites, me) }
+		p := s.partyOf[cid]
+		switch {
+		case !ok || inv.from != cid || now.Sub(inv.at) > partyInviteTTL:
+			why = sprintf("no invite from %d", cid)
+		case s.partyOf[me] != nil:
+			why = "already in a party"
+		case p != nil && p.leader != cid:
+			why = "invite no longer valid"
+		case p != nil && len(p.members) >= partyMax:
+			why = "party full"
+		case s.sessionByChar(cid) == nil:
+			why = "not online"
+		default:
+			if p == nil {
+				s.partySeq++
+				p = &party{id: s.partySeq, leader: cid, members: []shared.CharacterID{cid}}
+				s.parties[p.id] = p
+				s.partyOf[cid] = p
+			}
+			p.members = append(p.members, me)
+			s.partyOf[me] = p
+			notes = s.partyNotesLocked(p, nil)
+		}
+	case PartyLeave:
+		if s.partyOf[me] == nil {
+			why = "not in a party"
+		} else {
+			notes = s.leavePartyLocked(me, "left")
+		}
+	case PartyKick:
+		p := s.partyOf[me]
+		switch {
+		case p == nil || p.leader != me:
+			why = "only the leader kicks"
+		case cid == me || s.partyOf[cid] != p:
+			why = sprintf("%d is not in your party", cid)
+		default:
+			notes = s.leavePartyLocked(cid, "kicked")
+		}
+	default:
+		why = "bad party op"
+	}
+	s.partyMu.Unlock()
+
+	if why != "" {
+		s.sendReliableText(st, "PARTY_ERR "+why)
+		return
+	}
+	s.deliverPartyNotes(notes)
+}
+
+// leavePartyLocked takes cid out of its party, handing the lead on; a party
+// left with one member is disbanded.
+func (s *Server) leavePartyLocked(cid shared.CharacterID, why string) []partyNote {
+	p := s.partyOf[cid]
+	if p == nil { return nil }
+	delete(s.partyOf, cid)
+	for i, m := range p.members {
+		if m == cid {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	notes := []partyNote{{cid: cid, text: "PARTY_LEFT " + why, others: []shared.CharacterID{}}}
+	if len(p.members) == 1 {
+		last := p.members[0]
+		delete(s.partyOf, last)
+		delete(s.parties, p.id)
+		return append(notes, partyNote{cid: last, text: "PARTY_LEFT disbanded", others: []shared.CharacterID{}})
+	}
+	if p.leader == cid { p.leader = p.members[0] }
+	return s.partyNotesLocked(p, notes)
+}
+
+// partyNotesLocked appends p's current state for each of its members.
+func (s *Server) partyNotesLocked(p *party, notes []partyNote) []partyNote {
+	ids := make([]string, len(p.members))
+	for i, m := range p.members { ids[i] = strconv.FormatUint(uint64(m), 10) }
+	text := sprintf("PARTY id=%d leader=%d members=%s", p.id, p.leader, strings.Join(ids, ","))
+	for _, m := range p.members {
+		others := make([]shared.CharacterID, 0, len(p.members)-1)
+		for _, o := range p.members {
+			if o != m { others = append(others, o) }
+		}
+		notes = append(notes, partyNote{cid: m, text: text, others: others})
+	}
+	return notes
+}
+
+func (s *Server) deliverPartyNotes(notes []partyNote) {
+	for _, n := range notes {
+		st := s.sessionByChar(n.cid)
+		if st == nil { continue }
+		s.sendReliableText(st, n.text)
+		if n.others != nil { s.sendParty(st, n.others) }
+	}
+}
+
+// sendParty tells st's zone who else is in its party.
+func (s *Server) sendParty(st *sessionState, others []shared.CharacterID) {
+	zid := st.Zone()
+	if zid == 0 { return }
+	s.zonesMu.Lock()
+	zl := s.zones[uint32(zid)]
+	s.zonesMu.Unlock()
+	if zl == nil || !zl.caps.Has(wire.CapParty) { return }
+	_ = zl.send(wire.MsgPlayerParty, wire.EncodePlayerParty(st.SID, others))
+}
+
+// syncParty repeats st's party to its zone after an attach there, which
+// starts the player with none.
+func (s *Server) syncParty(st *sessionState) {
+	s.partyMu.Lock()
+	var others []shared.CharacterID
+	if p := s.partyOf[st.CharID]; p != nil {
+		for _, m := range p.members {
+			if m != st.CharID { others = append(others, m) }
+		}
+	}
+	s.partyMu.Unlock()
+	if len(others) > 0 { s.sendParty(st, others) }
+}
+
+// partyGone takes the character of an ended session out of its party.
+func (s *Server) partyGone(st *sessionState) {
+	if st.CharID == 0 { return }
+	s.partyMu.Lock()
+	delete(s.invites, st.CharID)
+	notes := s.leavePartyLocked(st.CharID, "disconnected")
+	s.partyMu.Unlock()
+	s.deliverPartyNotes(notes)
+}
+
+// sessionByChar finds the session playing cid, if any.
+func (s *Server) sessionByChar(cid shared.CharacterID) *sessionState {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for _, st := range s.byRemote {
+		if st.CharID == cid { return st }
+	}
+	return nil
+}
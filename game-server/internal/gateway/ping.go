@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	"game-server/internal/netcode"
+	"game-server/internal/shared"
+	"game-server/internal/shared/wire"
+)
+
+// Keepalive and link measurement. Every netcode.PingInterval each session
+// with a channel gets a PPing; the client's PPong gives RTT, jitter and loss
+// (see netcode/ping.go). Clients ping us too, which is what keeps an idle
+// session clear of cleanupLoop. The numbers go to the player's zone
+// (MsgPlayerLink) for lag compensation, whenever they move noticeably.
+
+const (
+	linkReportRTT    = 5 * time.Millisecond // smallest RTT or jitter change worth reporting
+	linkReportLoss   = 10                   // permille
+	linkReportMaxAge = 10 * time.Second     // report at least this often anyway
+)
+
+type linkReport struct {
+	last wire.LinkStats
+	zone shared.ZoneID
+	at   time.Time
+}
+
+func (s *Server) pingLoop(ctx context.Context) {
+	t := time.NewTicker(netcode.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.sessionsMu.Lock()
+			sts := make([]*sessionState, 0, len(s.byRemote))
+			for _, st := range s.byRemote { sts = append(sts, st) }
+			s.sessionsMu.Unlock()
+			for _, st := range sts {
+				if st.sec.Load() == nil { continue }
+				// not shaped, same as the pong (see dispatch)
+				s.writeSealed(st, st.peer.Encode(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PPing, Payload: st.link.NextPing(now)}))
+				s.reportLink(st, now)
+			}
+		}
+	}
+}
+
+// reportLink sends the session's link stats to its zone if they changed
+// enough since the last report, the player changed zones, or the last report
+// is old.
+func (s *Server) reportLink(st *sessionState, now time.Time) {
+	zid := st.Zone()
+	if st.CharID == 0 || zid == 0 { return }
+	snap := st.link.Snapshot(now)
+	if snap.RTT == 0 { return }
+	s.zonesMu.Lock()
+	zl := s.zones[uint32(zid)]
+	s.zonesMu.Unlock()
+	if zl == nil || !zl.caps.Has(wire.CapLinkStats) { return }
+
+	ls := wire.LinkStats{
+		// rounded up: a sub-millisecond RTT must not read as "unmeasured"
+		RTTMs:        clampU16((snap.RTT + time.Millisecond - 1).Milliseconds()),
+		JitterMs:     clampU16(snap.Jitter.Milliseconds()),
+		LossPermille: uint16(snap.Loss * 1000),
+	}
+	r := &st.linkRep
+	if r.zone == zid && now.Sub(r.at) < linkReportMaxAge &&
+		absDiff(ls.RTTMs, r.last.RTTMs) < uint16(linkReportRTT.Milliseconds()) &&
+		absDiff(ls.JitterMs, r.last.JitterMs) < uint16(linkReportRTT.Milliseconds()) &&
+		absDiff(ls.LossPermille, r.last.LossPermille) < linkReportLoss {
+		return
+	}
+	if zl.send(wire.MsgPlayerLink, wire.EncodePlayerLink(st.SID, ls)) != nil { return }
+	r.last, r.zone, r.at = ls, zid, now
+}
+
+func clampU16(v int64) uint16 {
+	if v < 0 { return 0 }
+	if v > 0xFFFF { return 0xFFFF }
+	return uint16(v)
+}
+
+func absDiff(a, b uint16) uint16 {
+	if a > b { return a - b }
+	return b - a
+}
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"game-server/internal/netcode"
+	"game-server/internal/shared/wire"
+)
+
+// Replication batch formats carried in PRepBin payloads.
+const (
+	RepFmtAbs   uint8 = 1 // absolute positions, wire.RepEvent encoding
+	RepFmtDelta uint8 = 2 // packed move events, see wire.AppendPackedRepEvents
+)
+
+// RepBatch payload (PRepBin):
+// [fmt:u8][serverTick:u32][baseTick:u32][chan:u8][part:u8][parts:u8][n:u16] events...
+//
+// RepFmtAbs events use the same per-op encoding as wire.EncodeReplicate;
+// RepFmtDelta events use the packed move encoding of wire.EncodeReplicateDelta.
+// A zone replicate message that does not fit one datagram is split into
+// parts; the client acks (serverTick, chan) with PRepAck once it has them all.
+const RepBatchHeaderLen = 1 + 4 + 4 + 1 + 1 + 1 + 2
+
+// maxRepBatchBody is the space left for events once sealing, packet and batch headers are paid.
+const maxRepBatchBody = netcode.MaxDatagram - netcode.SealOverhead - netcode.HeaderLen - RepBatchHeaderLen
+
+type RepBatch struct {
+	Format     uint8
+	ServerTick uint32
+	BaseTick   uint32
+	Chan       wire.RepChannel
+	Part       uint8
+	Parts      uint8
+	Events     []wire.RepEvent
+}
+
+func EncodeRepBatch(rb RepBatch) []byte {
+	events := rb.Events
+	if len(events) > 65535 { events = events[:65535] }
+	b := make([]byte, RepBatchHeaderLen, RepBatchHeaderLen+repBodySize(rb.Format, events))
+	b[0] = rb.Format
+	binary.LittleEndian.PutUint32(b[1:5], rb.ServerTick)
+	binary.LittleEndian.PutUint32(b[5:9], rb.BaseTick)
+	b[9] = byte(rb.Chan)
+	b[10] = rb.Part
+	b[11] = rb.Parts
+	binary.LittleEndian.PutUint16(b[12:14], uint16(len(events)))
+	if rb.Format == RepFmtDelta {
+		return wire.AppendPackedRepEvents(b, events)
+	}
+	for _, e := range events { b = wire.AppendRepEvent(b, e) }
+	return b
+}
+
+func DecodeRepBatch(b []byte) (RepBatch, error) {
+	if len(b) < RepBatchHeaderLen { return RepBatch{}, errors.New("short rep batch") }
+	rb := RepBatch{
+		Format: b[0],
+		ServerTick: binary.LittleEndian.Uint32(b[1:5]),
+		BaseTick: binary.LittleEndian.Uint32(b[5:9]),
+		Chan: wire.RepChannel(b[9]),
+		Part: b[10],
+		Parts: b[11],
+	}
+	if rb.Parts == 0 || rb.Part >= rb.Parts { return RepBatch{}, errors.New("bad rep batch part") }
+	n := int(binary.LittleEndian.Uint16(b[12:14]))
+	var off int
+	var err error
+	switch rb.Format {
+	case RepFmtAbs:
+		rb.Events, off, err = wire.DecodeRepEvents(b[RepBatchHeaderLen:], n)
+	case RepFmtDelta:
+		rb.Events, off, err = wire.DecodePackedRepEvents(b[RepBatchHeaderLen:], n)
+	default:
+		return RepBatch{}, errors.New("unknown rep batch format")
+	}
+	if err != nil { return RepBatch{}, err }
+	if RepBatchHeaderLen+off != len(b) { return RepBatch{}, errors.New("extra bytes in rep batch") }
+	return rb, nil
+}
+
+func repBodySize(format uint8, events []wire.RepEvent) int {
+	if format == RepFmtDelta {
+		return wire.PackedRepEventsSize(events)
+	}
+	sz := 0
+	for _, e := range events { sz += wire.RepEventSize(e) }
+	return sz
+}
+
+// splitRepBatches packs events into as few datagram-sized batches as possible,
+// preserving order. A single oversized event still gets its own batch. Parts
+// are capped at 255; anything beyond is dropped (the zone budget keeps
+// messages far below that).
+func splitRepBatches(format uint8, serverTick, baseTick uint32, ch wire.RepChannel, events []wire.RepEvent) [][]byte {
+	var cuts [][]wire.RepEvent
+	start, body := 0, 0
+	for i, e := range events {
+		sz := wire.RepEventSize(e)
+		if format == RepFmtDelta {
+			sz = wire.PackedRepEventSize(e)
+			if (i-start)%4 == 0 { sz++ } // next op code byte
+		}
+		if i > start && body+sz > maxRepBatchBody {
+			cuts = append(cuts, events[start:i])
+			start, body = i, 0
+			if format == RepFmtDelta { sz = wire.PackedRepEventSize(e) + 1 }
+		}
+		body += sz
+	}
+	if start < len(events) || len(cuts) == 0 {
+		cuts = append(cuts, events[start:])
+	}
+	if len(cuts) > 255 { cuts = cuts[:255] }
+
+	out := make([][]byte, 0, len(cuts))
+	for i, evs := range cuts {
+		out = append(out, EncodeRepBatch(RepBatch{
+			Format: format, ServerTick: serverTick, BaseTick: baseTick, Chan: ch,
+			Part: uint8(i), Parts: uint8(len(cuts)), Events: evs,
+		}))
+	}
+	return out
+}
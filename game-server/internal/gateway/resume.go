@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"time"
+
+	"game-server/internal/netcode"
+	"game-server/internal/shared"
+)
+
+// Session resumption across address changes (NAT rebinding, network switch).
+//
+// HELLO_OK carries a resume token. A client that finds itself on a new
+// address sends a plaintext PResume:
+//
+//	[sid:16][sealed packet: PType PResume, payload [token:16]]
+//
+// The inner packet is sealed with the session's channel keys, so it proves
+// possession of those keys as well as the token, and its counter is subject
+// to the usual replay window. On success the session (reliable state, zone
+// attachment and all) is rekeyed under the new address; the old address is
+// forgotten.
+
+const ResumeTokenLen = 16
+
+func (s *Server) handleResume(remote string, raddr *net.UDPAddr, p netcode.Packet) {
+	if len(p.Payload) < 16 { return }
+	var sid shared.SessionID
+	copy(sid[:], p.Payload[:16])
+	st, ok := s.getBySID(sid)
+	if !ok { return }
+	sec := st.sec.Load()
+	if sec == nil || st.CharID == 0 { return }
+	inner, err := sec.Open(p.Payload[16:])
+	if err != nil { return }
+	ip, err := netcode.DecodePacket(inner)
+	if err != nil || ip.PType != PResume || len(ip.Payload) != ResumeTokenLen { return }
+	if subtle.ConstantTimeCompare(ip.Payload, st.resumeTok[:]) != 1 { return }
+
+	s.sessionsMu.Lock()
+	old := s.bySID[sid]
+	if other, ok := s.byRemote[remote]; ok && other != st {
+		// the new address already has a half-open session; an authenticated one is not ours to take
+		if other.CharID != 0 {
+			s.sessionsMu.Unlock()
+			return
+		}
+		delete(s.bySID, other.SID)
+	}
+	delete(s.byRemote, old)
+	s.byRemote[remote] = st
+	s.bySID[sid] = remote
+	st.raddr.Store(raddr)
+	st.LastHeard = time.Now()
+	s.sessionsMu.Unlock()
+
+	if old != remote {
+		log.Printf("session %s resumed: %s -> %s", sid, old, remote)
+	}
+	s.sendReliableText(st, "RESUMED")
+}
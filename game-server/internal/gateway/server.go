@@ -3,12 +3,18 @@ package gateway
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"game-server/internal/netcode"
 	"game-server/internal/shared"
 	"game-server/internal/shared/wire"
 )
@@ -27,6 +33,27 @@ type Server struct {
 	// transfer inflight (Step13)
 	xferMu sync.Mutex
 	inflight map[shared.SessionID]*xferState
+
+	// instances of instanced zones (see instance.go): live ones with their
+	// key, and MsgInstanceCreate requests out
+	instMu sync.Mutex
+	instances map[uint32]instanceKey
+	instByKey map[instanceKey]uint32
+	instReqs map[uint32]*instanceReq
+	instReqSeq uint32
+
+	run context.Context // Start's loop context; instance links are supervised under it
+
+	// parties by id and by member, and pending invites by invitee (see party.go)
+	partyMu sync.Mutex
+	parties map[uint64]*party
+	partyOf map[shared.CharacterID]*party
+	invites map[shared.CharacterID]partyInvite
+	partySeq uint64
+
+	cookies *cookieJar
+
+	draining atomic.Bool // shutting down: no new sessions (see drain.go)
 }
 
 type zoneLink struct {
@@ -34,26 +61,64 @@ type zoneLink struct {
 	addr string
 	conn net.Conn
 	r *bufio.Reader
+	wmu sync.Mutex // zoneSend runs from the UDP loop and background loops
 	w *bufio.Writer
+
+	// from the handshake
+	tickHz uint16
+	caps wire.Caps
+
+	clock tickClock // zone tick vs our time, see clock.go
 }
 
+// gatewayCaps is everything this gateway build can handle on a zone link.
+const gatewayCaps = wire.CapDeltaMove | wire.CapRepAck | wire.CapBudget | wire.CapLinkStats | wire.CapTickSync | wire.CapKick | wire.CapInstances | wire.CapParty | wire.CapXferQuery
+
 type sessionState struct {
 	SID shared.SessionID
 	CharID shared.CharacterID
-	ZoneID shared.ZoneID
+	Account string // token subject, set once authenticated
+	zid atomic.Uint32 // current zone, see Zone
 	Interest wire.InterestMask
 	LastHeard time.Time
 	Proto uint16
 
-	peer *reliablePeer
-	raddr *net.UDPAddr
-	bucket tokenBucket
+	peer *netcode.Endpoint
+	raddr atomic.Pointer[net.UDPAddr] // moves on resume (see resume.go); read by every send
+	out *shaper // outbound token bucket and queues, see shaper.go
+	stats sessionStats
+	cc congestion // owned by congestionLoop
+	link netcode.LinkStats // our pings to the client, see ping.go
+	linkRep linkReport     // owned by pingLoop
+
+	// encrypted channel, set by the key exchange (see netcode/secure.go)
+	sec atomic.Pointer[netcode.SecureChannel]
+	keyExClient []byte // client public key the channel was derived from
+	keyExReply []byte  // our PKeyExOk, resent for a retried PKeyEx
+
+	resumeTok [ResumeTokenLen]byte // handed out in HELLO_OK, see resume.go
+
+	omu sync.Mutex // guards osend: fragments of one message take consecutive oseqs
+	osend netcode.OrderedSender
+	orecv *netcode.OrderedReceiver
 }
 
+// Zone is the zone st's traffic goes to. Transfers move it from zone link
+// and timer goroutines while the UDP loop reads it.
+func (st *sessionState) Zone() shared.ZoneID { return shared.ZoneID(st.zid.Load()) }
+
+func (st *sessionState) setZone(z shared.ZoneID) { st.zid.Store(uint32(z)) }
+
 type xferState struct {
+	ID uint64 // minted by the source zone, see wire.EncodeTransferPrepare
 	From shared.ZoneID
 	To shared.ZoneID
 	Started time.Time
+
+	// prepared state, kept so the target can be re-attached if its link drops
+	Interest wire.InterestMask
+	X, Y int16
+	HP uint16
 }
 
 type tokenBucket struct {
@@ -82,10 +147,12 @@ func (b *tokenBucket) refill(now time.Time) {
 	}
 }
 
+// take spends n tokens if there are enough. A full bucket admits any single
+// send, going into debt, so nothing larger than burst is stuck forever.
 func (b *tokenBucket) take(now time.Time, n int) bool {
 	b.refill(now)
 	if n <= 0 { return true }
-	if b.tokens < n { return false }
+	if b.tokens < n && b.tokens < b.burst { return false }
 	b.tokens -= n
 	return true
 }
@@ -96,7 +163,16 @@ func New(cfg Config) (*Server, error) {
 	if len(cfg.Zones) == 0 { return nil, errors.New("no zones configured") }
 	if cfg.IdleTimeout <= 0 { cfg.IdleTimeout = 30*time.Second }
 	if cfg.TransferTimeout <= 0 { cfg.TransferTimeout = 3*time.Second }
+	if cfg.DrainTimeout <= 0 { cfg.DrainTimeout = 3*time.Second }
 	if cfg.ProtoVersion == 0 { cfg.ProtoVersion = 1 }
+	if cfg.RateBytesPerSec <= 0 { cfg.RateBytesPerSec = 20000 }
+	if cfg.BurstBytes <= 0 { cfg.BurstBytes = 2*cfg.RateBytesPerSec }
+	if cfg.Auth == nil { return nil, errors.New("no authenticator configured") }
+	if cfg.World == nil { return nil, errors.New("no world map configured") }
+	for zid := range cfg.Zones {
+		if _, ok := cfg.World.Zone(shared.ZoneID(zid)); !ok { return nil, fmt.Errorf("zone %d is not on the world map", zid) }
+	}
+	if _, ok := cfg.Zones[uint32(cfg.World.Start)]; !ok { return nil, fmt.Errorf("no address for start zone %d", cfg.World.Start) }
 
 	return &Server{
 		cfg: cfg,
@@ -104,6 +180,13 @@ func New(cfg Config) (*Server, error) {
 		byRemote: make(map[string]*sessionState),
 		bySID: make(map[shared.SessionID]string),
 		inflight: make(map[shared.SessionID]*xferState),
+		instances: make(map[uint32]instanceKey),
+		instByKey: make(map[instanceKey]uint32),
+		instReqs: make(map[uint32]*instanceReq),
+		parties: make(map[uint64]*party),
+		partyOf: make(map[shared.CharacterID]*party),
+		invites: make(map[shared.CharacterID]partyInvite),
+		cookies: newCookieJar(),
 	}, nil
 }
 
@@ -114,26 +197,53 @@ func (s *Server) Start(ctx context.Context) error {
 	if err != nil { return err }
 	defer s.udpConn.Close()
 
+	// first connect must succeed (a rejected handshake is fatal); after that
+	// each link is supervised and redialed on loss
 	for zid, addr := range s.cfg.Zones {
-		if err := s.connectZone(zid, addr); err != nil { return err }
+		zl, err := dialZone(zid, addr)
+		if err != nil { return err }
+		s.zonesMu.Lock()
+		s.zones[zid] = zl
+		s.zonesMu.Unlock()
 	}
 	defer s.closeZones()
 
+	// the loops outlive ctx until the drain is over: it still needs
+	// retransmits, shaping and the zone links (see drain.go)
+	run, stop := context.WithCancel(context.Background())
+	defer stop()
+	s.run = run
+
 	s.zonesMu.Lock()
 	for _, zl := range s.zones {
-		go s.zoneReadLoop(ctx, zl)
+		go s.superviseZone(run, zl)
 	}
 	s.zonesMu.Unlock()
 
-	go s.cleanupLoop(ctx)
-	go s.transferTimeoutLoop(ctx)
-	go s.retransmitLoop(ctx)
+	go s.cleanupLoop(run)
+	go s.transferTimeoutLoop(run)
+	go s.retransmitLoop(run)
+	go s.shapeLoop(run)
+	go s.congestionLoop(run)
+	go s.pingLoop(run)
+	if s.cfg.HTTPAddr != "" {
+		s.serveMetrics(s.cfg.HTTPAddr)
+		log.Printf("gateway metrics http=%s", s.cfg.HTTPAddr)
+	}
 
 	log.Printf("gateway up: udp=%s zones=%d proto=%d", s.cfg.UDPListenAddr, len(s.cfg.Zones), s.cfg.ProtoVersion)
 
+	drained := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		s.drain()
+		close(drained)
+	}()
+
+	// keep reading while draining: the clients' acks come in here
 	buf := make([]byte, 64*1024)
 	for {
-		select { case <-ctx.Done(): return nil; default: }
+		select { case <-drained: return nil; default: }
 		_ = s.udpConn.SetReadDeadline(time.Now().Add(500*time.Millisecond))
 		n, raddr, err := s.udpConn.ReadFromUDP(buf)
 		if err != nil {
@@ -144,19 +254,59 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 }
 
-func (s *Server) connectZone(zid uint32, addr string) error {
-	c, err := net.Dial("tcp", addr)
-	if err != nil { return err }
+func dialZone(zid uint32, addr string) (*zoneLink, error) {
+	c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil { return nil, err }
 	zl := &zoneLink{
 		id: zid, addr: addr,
 		conn: c,
 		r: bufio.NewReaderSize(c, 64*1024),
 		w: bufio.NewWriterSize(c, 64*1024),
 	}
-	s.zonesMu.Lock()
-	s.zones[zid] = zl
-	s.zonesMu.Unlock()
-	return nil
+	if err := zl.handshake(); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("zone %d handshake: %w", zid, err)
+	}
+	log.Printf("zone %d linked: addr=%s tickHz=%d caps=%#x", zid, addr, zl.tickHz, uint32(zl.caps))
+	return zl, nil
+}
+
+func (zl *zoneLink) send(typ wire.MsgType, payload []byte) error {
+	zl.wmu.Lock()
+	defer zl.wmu.Unlock()
+	return wire.WriteFrame(zl.w, typ, payload)
+}
+
+var errRejected = errors.New("rejected by zone")
+
+// handshake sends our hello and waits for the zone's answer. A zone that
+// rejects us (ErrHandshake) or speaks another wire version is a hard error.
+func (zl *zoneLink) handshake() error {
+	_ = zl.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer func() { _ = zl.conn.SetReadDeadline(time.Time{}) }()
+
+	hello := wire.Hello{Version: wire.WireVersion, ZoneID: shared.ZoneID(zl.id), Caps: gatewayCaps}
+	if err := zl.send(wire.MsgHello, wire.EncodeHello(hello)); err != nil {
+		return err
+	}
+	fr, err := wire.ReadFrame(zl.r)
+	if err != nil { return err }
+	switch fr.Type {
+	case wire.MsgHelloAck:
+		h, err := wire.DecodeHello(fr.Payload)
+		if err != nil { return err }
+		if err := wire.CheckHello(h, shared.ZoneID(zl.id)); err != nil { return err }
+		zl.tickHz = h.TickHz
+		zl.caps = h.Caps & gatewayCaps
+		zl.clock.observe(h.TickHz, h.ServerTick, time.Now())
+		return nil
+	case wire.MsgError:
+		code, msg, err := wire.DecodeError(fr.Payload)
+		if err != nil { return err }
+		return fmt.Errorf("%w: code=%d msg=%q", errRejected, code, msg)
+	default:
+		return fmt.Errorf("unexpected frame %d during handshake", fr.Type)
+	}
 }
 
 func (s *Server) closeZones() {
@@ -170,76 +320,156 @@ func (s *Server) zoneSend(zid uint32, typ wire.MsgType, payload []byte) error {
 	s.zonesMu.Lock()
 	zl := s.zones[zid]
 	s.zonesMu.Unlock()
-	if zl == nil { return errors.New("unknown zone") }
-	return wire.WriteFrame(zl.w, typ, payload)
+	if zl == nil { return errors.New("zone unavailable") }
+	return zl.send(typ, payload)
 }
 
 func (s *Server) handleUDPPacket(raddr *net.UDPAddr, b []byte) {
-	p, err := DecodePacket(b)
+	if len(b) < 2 { return }
+	remote := raddr.String()
+	if binaryLEU16(b[0:2]) != netcode.SealMagic {
+		// plaintext is only good for the key exchange and resumption
+		p, err := netcode.DecodePacket(b)
+		if err != nil { return }
+		if p.Proto != s.cfg.ProtoVersion {
+			// tell a client of another build why it gets nothing (the answer is
+			// smaller than the PKeyEx, so no use for reflection)
+			if p.PType == PKeyEx && !s.draining.Load() {
+				pkt := netcode.EncodePacket(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PDisconnect, Payload: encodeDisconnect(DiscProtoMismatch, sprintf("proto %d", s.cfg.ProtoVersion))}, nil)
+				_, _ = s.udpConn.WriteToUDP(pkt, raddr)
+			}
+			return
+		}
+		switch p.PType {
+		case PKeyEx:
+			if s.draining.Load() { return }
+			s.handleKeyEx(remote, raddr, p)
+		case PResume:
+			s.handleResume(remote, raddr, p)
+		}
+		return
+	}
+	st := s.getByRemote(remote)
+	if st == nil { return }
+	sec := st.sec.Load()
+	if sec == nil { return }
+	inner, err := sec.Open(b)
+	if err != nil { return }
+	p, err := netcode.DecodePacket(inner)
 	if err != nil {
 		return
 	}
 	if p.Proto != s.cfg.ProtoVersion {
 		return
 	}
-	remote := raddr.String()
-
-	st := s.getOrCreate(remote, raddr, p.Proto)
 
 	// Process ACKs for reliable channel (both on any packet)
-	st.peer.onAcks(time.Now(), p.Ack, p.AckBits)
+	if fast := st.peer.OnAcks(time.Now(), p.Ack, p.AckBits); len(fast) > 0 {
+		s.fastRetransmit(st, fast)
+	}
 
 	// Update receive window if incoming is reliable
-	if p.Chan == ChanReliable {
-		st.peer.updateRecv(p.Seq)
+	if p.Reliable() {
+		st.peer.OnRecv(p.Seq)
 	}
 
 	st.LastHeard = time.Now()
 
+	if p.Chan != netcode.ChanOrdered {
+		s.dispatch(st, remote, p)
+		return
+	}
+	msgs, err := st.orecv.Push(p.PType, p.Payload)
+	for _, m := range msgs {
+		s.dispatch(st, remote, netcode.Packet{Proto: p.Proto, Chan: netcode.ChanOrdered, PType: m.PType, Payload: m.Data})
+	}
+	if err != nil {
+		// an ordered stream cannot skip ahead, so the session cannot go on
+		log.Printf("ordered stream: remote=%s err=%v", remote, err)
+		s.dropSession(st, DiscProtocol, err.Error())
+	}
+}
+
+// dispatch acts on one message from the client, after reliability and ordering.
+func (s *Server) dispatch(st *sessionState, remote string, p netcode.Packet) {
 	switch p.PType {
 	case PHello:
-		if p.Chan != ChanReliable {
+		if !p.Reliable() || s.draining.Load() {
 			return
 		}
-		if len(p.Payload) < 8+4 { return }
+		if len(p.Payload) < 8+4+2 { return }
 		cid := shared.CharacterID(binaryLEU64(p.Payload[0:8]))
 		interest := wire.InterestMask(binaryLEU32(p.Payload[8:12]))
+		tokLen := int(binaryLEU16(p.Payload[12:14]))
+		if len(p.Payload) < 14+tokLen { return }
+		id, err := s.cfg.Auth.Authenticate(string(p.Payload[14:14+tokLen]), time.Now())
+		if err != nil {
+			log.Printf("auth failed: remote=%s err=%v", remote, err)
+			s.dropSession(st, DiscAuthFailed, err.Error())
+			return
+		}
+		// the token lists the account's characters; asking for another one is
+		// refused rather than silently swapped
+		cid, ok := id.Character(cid)
+		if !ok || (st.CharID != 0 && st.CharID != cid) {
+			s.dropSession(st, DiscAuthFailed, "character not granted by token")
+			return
+		}
 		if cid == 0 { return }
 		if interest == 0 {
 			interest = wire.InterestMove | wire.InterestState | wire.InterestEvent | wire.InterestCombat
 		}
+		st.Account = id.Account
 		st.CharID = cid
 		st.Interest = interest
 
-		// choose default zone (min id)
-		if st.ZoneID == 0 {
-			var min uint32 = 0
-			for zid := range s.cfg.Zones {
-				if min == 0 || zid < min { min = zid }
-			}
-			st.ZoneID = shared.ZoneID(min)
-		}
-		_ = s.zoneSend(uint32(st.ZoneID), wire.MsgAttachPlayer, wire.EncodeAttachPlayer(st.SID, st.CharID, st.ZoneID, st.Interest))
+		// new sessions enter the world map's start zone
+		st.zid.CompareAndSwap(0, uint32(s.cfg.World.Start))
+		zid := st.Zone()
+		_ = s.zoneSend(uint32(zid), wire.MsgAttachPlayer, wire.EncodeAttachPlayer(st.SID, st.CharID, zid, st.Interest))
 
 		// Send a reliable text ACK to client
-		s.sendReliableText(st, "HELLO_OK sid="+st.SID.String())
+		s.sendReliableText(st, "HELLO_OK sid="+st.SID.String()+" resume="+hex.EncodeToString(st.resumeTok[:]))
 
 	case PInput:
 		if len(p.Payload) < 4+2+2 { return }
-		if st.ZoneID == 0 { return }
+		if st.Zone() == 0 { return }
 		tick := binaryLEU32(p.Payload[0:4])
 		mx := int16(binaryLEU16(p.Payload[4:6]))
 		my := int16(binaryLEU16(p.Payload[6:8]))
-		_ = s.zoneSend(uint32(st.ZoneID), wire.MsgPlayerInput, wire.EncodePlayerInput(st.SID, tick, mx, my))
+		_ = s.zoneSend(uint32(st.Zone()), wire.MsgPlayerInput, wire.EncodePlayerInput(st.SID, tick, mx, my))
 
 	case PAction:
-		if p.Chan != ChanReliable { return }
+		if !p.Reliable() { return }
 		if len(p.Payload) < 4+2+4 { return }
-		if st.ZoneID == 0 { return }
+		if st.Zone() == 0 { return }
 		tick := binaryLEU32(p.Payload[0:4])
 		skill := binaryLEU16(p.Payload[4:6])
 		target := shared.EntityID(binaryLEU32(p.Payload[6:10]))
-		_ = s.zoneSend(uint32(st.ZoneID), wire.MsgPlayerAction, wire.EncodePlayerAction(st.SID, tick, skill, target))
+		_ = s.zoneSend(uint32(st.Zone()), wire.MsgPlayerAction, wire.EncodePlayerAction(st.SID, tick, skill, target))
+
+	case PRepAck:
+		if len(p.Payload) < 4+1 { return }
+		if st.Zone() == 0 { return }
+		tick := binaryLEU32(p.Payload[0:4])
+		ch := wire.RepChannel(p.Payload[4])
+		st.stats.RepAcked.Add(1)
+		_ = s.zoneSend(uint32(st.Zone()), wire.MsgRepAck, wire.EncodeRepAck(st.SID, tick, ch))
+
+	case PPing:
+		if len(p.Payload) != netcode.PingLen { return }
+		// not shaped: waiting for tokens would add to the client's RTT sample
+		s.writeSealed(st, st.peer.Encode(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PPong, Payload: p.Payload}))
+
+	case PPong:
+		st.link.OnPong(p.Payload, time.Now())
+
+	case PTimeSync:
+		s.handleTimeSync(st, p)
+
+	case PParty:
+		if !p.Reliable() { return }
+		s.handleParty(st, p.Payload)
 
 	default:
 	}
@@ -249,25 +479,32 @@ func (s *Server) getOrCreate(remote string, raddr *net.UDPAddr, proto uint16) *s
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
 	if st, ok := s.byRemote[remote]; ok {
-		st.raddr = raddr
+		st.raddr.Store(raddr)
 		return st
 	}
 	st := &sessionState{
 		SID: shared.NewSessionID(),
 		CharID: 0,
-		ZoneID: 0,
 		Interest: 0,
 		LastHeard: time.Now(),
 		Proto: proto,
-		peer: newPeer(s.cfg.MaxReliableBytes),
-		raddr: raddr,
-		bucket: newBucket(s.cfg.RateBytesPerSec, s.cfg.BurstBytes),
+		peer: netcode.NewEndpoint(s.cfg.MaxReliableBytes),
+		out: newShaper(s.cfg.RateBytesPerSec, s.cfg.BurstBytes),
+		orecv: netcode.NewOrderedReceiver(),
 	}
+	st.raddr.Store(raddr)
+	_, _ = rand.Read(st.resumeTok[:])
 	s.byRemote[remote] = st
 	s.bySID[st.SID] = remote
 	return st
 }
 
+func (s *Server) getByRemote(remote string) *sessionState {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return s.byRemote[remote]
+}
+
 func (s *Server) getBySID(sid shared.SessionID) (*sessionState, bool) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
@@ -286,21 +523,13 @@ func (s *Server) cleanupLoop(ctx context.Context) {
 			return
 		case <-t.C:
 			now := time.Now()
-			var toDetach []struct{ sid shared.SessionID; zid shared.ZoneID }
+			var idle []*sessionState
 			s.sessionsMu.Lock()
-			for ra, st := range s.byRemote {
-				if now.Sub(st.LastHeard) > s.cfg.IdleTimeout {
-					toDetach = append(toDetach, struct{sid shared.SessionID; zid shared.ZoneID}{st.SID, st.ZoneID})
-					delete(s.bySID, st.SID)
-					delete(s.byRemote, ra)
-				}
+			for _, st := range s.byRemote {
+				if now.Sub(st.LastHeard) > s.cfg.IdleTimeout { idle = append(idle, st) }
 			}
 			s.sessionsMu.Unlock()
-			for _, d := range toDetach {
-				if d.zid != 0 {
-					_ = s.zoneSend(uint32(d.zid), wire.MsgDetachPlayer, wire.EncodeDetachPlayer(d.sid))
-				}
-			}
+			for _, st := range idle { s.dropSession(st, DiscIdle, "idle timeout") }
 		}
 	}
 }
@@ -314,20 +543,18 @@ func (s *Server) transferTimeoutLoop(ctx context.Context) {
 			return
 		case <-t.C:
 			now := time.Now()
-			var abort []struct{ sid shared.SessionID; from shared.ZoneID }
+			abort := make(map[shared.SessionID]*xferState)
 			s.xferMu.Lock()
 			for sid, xs := range s.inflight {
 				if now.Sub(xs.Started) > s.cfg.TransferTimeout {
-					abort = append(abort, struct{sid shared.SessionID; from shared.ZoneID}{sid, xs.From})
+					abort[sid] = xs
 					delete(s.inflight, sid)
 				}
 			}
 			s.xferMu.Unlock()
-			for _, a := range abort {
-				_ = s.zoneSend(uint32(a.from), wire.MsgTransferAbort, wire.EncodeTransferAbort(a.sid))
-				if st, ok := s.getBySID(a.sid); ok {
-					s.sendReliableText(st, "XFER_ABORT timeout")
-				}
+			for sid, xs := range abort {
+				_ = s.zoneSend(uint32(xs.To), wire.MsgDetachPlayer, wire.EncodeDetachPlayer(sid))
+				s.abortTransfer(sid, xs, "timeout")
 			}
 		}
 	}
@@ -345,66 +572,152 @@ func (s *Server) retransmitLoop(ctx context.Context) {
 			now := time.Now()
 			// iterate sessions and resend pending
 			var sends []struct{
-				addr *net.UDPAddr
-				pkt []byte
 				st *sessionState
-				seq uint32
+				sm *netcode.Sent
 			}
+			var dead []*sessionState
 			s.sessionsMu.Lock()
 			for _, st := range s.byRemote {
-				if st.raddr == nil || st.peer == nil { continue }
-				for seq, sm := range st.peer.pending {
-					if now.Sub(sm.sentAt) >= st.peer.rto {
-						if sm.retries >= st.peer.maxRetries {
-							delete(st.peer.pending, seq)
-							continue
-						}
-						sm.retries++
-						sm.sentAt = now
-						sends = append(sends, struct{
-							addr *net.UDPAddr; pkt []byte; st *sessionState; seq uint32
-						}{addr: st.raddr, pkt: sm.pkt, st: st, seq: seq})
-					}
+				if st.raddr.Load() == nil || st.peer == nil { continue }
+				// messages still waiting in the shaper have not left yet and are skipped
+				due, gone := st.peer.Due(now)
+				if gone {
+					// the client has not acked through every retry: the link is gone
+					dead = append(dead, st)
+					continue
+				}
+				for _, sm := range due {
+					st.stats.Retransmits.Add(1)
+					sends = append(sends, struct{
+						st *sessionState; sm *netcode.Sent
+					}{st: st, sm: sm})
 				}
 			}
 			s.sessionsMu.Unlock()
+			for _, st := range dead { s.dropSession(st, DiscLinkLost, "reliable retries exhausted") }
 			for _, it := range sends {
-				_, _ = s.udpConn.WriteToUDP(it.pkt, it.addr)
+				s.sendShapedReliable(it.st, it.sm)
 				_ = buf
 			}
 		}
 	}
 }
 
-func (s *Server) sendReliableText(st *sessionState, msg string) {
-	if st == nil || st.raddr == nil { return }
-	seq := st.peer.allocSeq()
-	payload := []byte(msg)
-	pkt := EncodePacket(Packet{
+// fastRetransmit resends messages the client's acks show as skipped over,
+// without waiting for their timers (no backoff: this is loss, not a dead link).
+func (s *Server) fastRetransmit(st *sessionState, sms []*netcode.Sent) {
+	for _, sm := range sms {
+		st.stats.Retransmits.Add(1)
+		s.sendShapedReliable(st, sm)
+	}
+}
+
+// sendReliableText reports false if the message was refused because the
+// session's unacked backlog is at MaxReliableBytes.
+func (s *Server) sendReliableText(st *sessionState, msg string) bool {
+	return s.sendReliable(st, PText, []byte(msg))
+}
+
+func (s *Server) sendReliable(st *sessionState, ptype uint8, payload []byte) bool {
+	if st == nil || st.raddr.Load() == nil { return false }
+	sms, err := st.peer.SendReliable(netcode.Packet{
 		Proto: s.cfg.ProtoVersion,
-		Chan: ChanReliable,
-		PType: PText,
-		Seq: seq,
-		Ack: st.peer.recvMax,
-		AckBits: st.peer.recvMask,
+		Chan: netcode.ChanReliable,
+		PType: ptype,
 		Payload: payload,
-	}, nil)
-	st.peer.pending[seq] = &sentMsg{seq: seq, pkt: pkt, sentAt: time.Now(), retries: 0}
-	_, _ = s.udpConn.WriteToUDP(pkt, st.raddr)
+	})
+	if err != nil {
+		st.stats.RelRejected.Add(1)
+		log.Printf("session %s reliable backlog full (%d bytes), dropping ptype=%d %q", st.SID, st.peer.PendingBytes(), ptype, payload)
+		return false
+	}
+	s.sendShapedReliable(st, sms[0])
+	return true
+}
+
+// sendOrdered delivers msg reliably and in order, fragmenting it if needed.
+func (s *Server) sendOrdered(st *sessionState, ptype uint8, msg []byte) {
+	if st == nil || st.raddr.Load() == nil { return }
+	st.omu.Lock()
+	frags, err := st.osend.Fragment(msg)
+	st.omu.Unlock()
+	if err != nil {
+		log.Printf("ordered send to %s: %v", st.SID, err)
+		return
+	}
+	ps := make([]netcode.Packet, 0, len(frags))
+	for _, f := range frags {
+		ps = append(ps, netcode.Packet{
+			Proto: s.cfg.ProtoVersion,
+			Chan: netcode.ChanOrdered,
+			PType: ptype,
+			Payload: f,
+		})
+	}
+	sms, err := st.peer.SendReliable(ps...)
+	if err != nil {
+		// ordered delivery cannot skip a message, so a full backlog ends the session
+		s.dropSession(st, DiscBacklog, "ordered backlog over MaxReliableBytes")
+		return
+	}
+	for _, sm := range sms { s.sendShapedReliable(st, sm) }
 }
 
-func (s *Server) sendUnreliableRep(st *sessionState, line string) {
-	if st == nil || st.raddr == nil { return }
-	pkt := EncodePacket(Packet{
+// repPacket wraps one replication batch for st (see sendShapedRep).
+func (s *Server) repPacket(st *sessionState, payload []byte) []byte {
+	return st.peer.Encode(netcode.Packet{
 		Proto: s.cfg.ProtoVersion,
-		Chan: ChanUnreliable,
-		PType: PRep,
-		Seq: 0,
-		Ack: st.peer.recvMax,
-		AckBits: st.peer.recvMask,
-		Payload: []byte(line),
-	}, nil)
-	_, _ = s.udpConn.WriteToUDP(pkt, st.raddr)
+		Chan: netcode.ChanUnreliable,
+		PType: PRepBin,
+		Payload: payload,
+	})
+}
+
+// writeSealed encrypts pkt for st. Sessions without a channel get nothing:
+// game traffic never goes out in the clear.
+func (s *Server) writeSealed(st *sessionState, pkt []byte) {
+	sec := st.sec.Load()
+	if sec == nil { return }
+	n, _ := s.udpConn.WriteToUDP(sec.Seal(s.cfg.ProtoVersion, pkt), st.raddr.Load())
+	st.stats.TxBytes.Add(int64(n))
+}
+
+// handleKeyEx answers a plaintext PKeyEx. Unknown addresses must first echo
+// a cookie (see cookie.go). A retried PKeyEx gets the same answer; a new key
+// is only taken before the session is authenticated, so a spoofed PKeyEx
+// cannot reset a player's channel.
+func (s *Server) handleKeyEx(remote string, raddr *net.UDPAddr, p netcode.Packet) {
+	if len(p.Payload) != netcode.KeyExLen && len(p.Payload) != netcode.KeyExLen+CookieLen { return }
+	st := s.getByRemote(remote)
+	if st == nil {
+		now := time.Now()
+		if !s.cookies.verify(remote, p.Payload[netcode.KeyExLen:], now) {
+			pkt := netcode.EncodePacket(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PChallenge, Payload: s.cookies.issue(remote, now)}, nil)
+			_, _ = s.udpConn.WriteToUDP(pkt, raddr)
+			return
+		}
+		st = s.getOrCreate(remote, raddr, p.Proto)
+	}
+	pub := p.Payload[:netcode.KeyExLen]
+	reply := func() {
+		pkt := netcode.EncodePacket(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PKeyExOk, Payload: st.keyExReply}, nil)
+		_, _ = s.udpConn.WriteToUDP(pkt, raddr)
+	}
+	if st.sec.Load() != nil {
+		if string(st.keyExClient) == string(pub) {
+			reply()
+			return
+		}
+		if st.CharID != 0 { return }
+	}
+	priv, err := netcode.NewKeyPair()
+	if err != nil { return }
+	sec, err := netcode.DeriveChannel(priv, pub, false)
+	if err != nil { return }
+	st.keyExClient = append([]byte(nil), pub...)
+	st.keyExReply = priv.PublicKey().Bytes()
+	st.sec.Store(sec)
+	reply()
 }
 
 func (s *Server) zoneReadLoop(ctx context.Context, zl *zoneLink) {
@@ -417,71 +730,81 @@ func (s *Server) zoneReadLoop(ctx context.Context, zl *zoneLink) {
 		}
 		switch fr.Type {
 		case wire.MsgAttachAck:
-			s.tryCommitOnAttachAck(zl.id)
+			sid, xfer, err := wire.DecodeAttachAck(fr.Payload)
+			if err != nil || xfer == 0 { continue }
+			s.commitTransfer(zl.id, sid, xfer)
+		case wire.MsgAttachNack:
+			sid, xfer, code, why, err := wire.DecodeAttachNack(fr.Payload)
+			if err != nil { continue }
+			log.Printf("zone %d refused attach sid=%s xfer=%d: code=%d %s", zl.id, sid.String(), xfer, code, why)
+			if xfer != 0 {
+				s.xferMu.Lock()
+				xs := s.inflight[sid]
+				if xs == nil || xs.ID != xfer || uint32(xs.To) != zl.id {
+					s.xferMu.Unlock()
+					continue
+				}
+				delete(s.inflight, sid)
+				s.xferMu.Unlock()
+				s.abortTransfer(sid, xs, why)
+				continue
+			}
+			// a plain attach: the session has nowhere to play
+			if st, ok := s.getBySID(sid); ok && uint32(st.Zone()) == zl.id { s.dropSession(st, DiscKicked, why) }
+		case wire.MsgTickSync:
+			tick, err := wire.DecodeTickSync(fr.Payload)
+			if err != nil { continue }
+			zl.clock.observe(zl.tickHz, tick, time.Now())
 		case wire.MsgReplicate:
-			sid, serverTick, ch, events, err := wire.DecodeReplicate(fr.Payload)
+			sid, serverTick, baseTick, ch, events, err := wire.DecodeReplicate(fr.Payload)
 			if err != nil { continue }
 			st, ok := s.getBySID(sid)
 			if !ok { continue }
-			// ship as human-readable lines (demo), unreliable
+			// ship as binary batches, unreliable
 			switch ch {
-			case wire.ChanMove:
-				for _, ev := range events {
-					switch ev.Op {
-					case wire.RepSpawn:
-						s.sendUnreliableRep(st, sprintf("T %d SPAWN %d %d %d kind=%d mask=%d", serverTick, uint32(ev.EID), ev.X, ev.Y, ev.Kind, uint32(ev.Mask)))
-					case wire.RepDespawn:
-						s.sendUnreliableRep(st, sprintf("T %d DESPAWN %d", serverTick, uint32(ev.EID)))
-					case wire.RepMove:
-						s.sendUnreliableRep(st, sprintf("T %d MOV %d %d %d", serverTick, uint32(ev.EID), ev.X, ev.Y))
-					}
-				}
-			case wire.ChanState:
-				for _, ev := range events {
-					if ev.Op == wire.RepStateHP {
-						s.sendUnreliableRep(st, sprintf("T %d STAT %d hp=%d", serverTick, uint32(ev.EID), ev.Val))
-					}
-				}
+			case wire.ChanMove, wire.ChanState:
+				s.sendShapedRep(st, ch, splitRepBatches(RepFmtAbs, serverTick, baseTick, ch, events))
 			case wire.ChanEvent:
 				for _, ev := range events {
 					if ev.Op == wire.RepEventText {
-						// demo: send reliable event text
-						s.sendReliableText(st, "EV "+ev.Text)
+						// events must not overtake each other (hit before death)
+						s.sendOrdered(st, PText, []byte("EV "+ev.Text))
 					}
 				}
 			}
-		case wire.MsgTransferPrepare:
-			sid, _, target, interest, x, y, hp, err := wire.DecodeTransferPrepare(fr.Payload)
+		case wire.MsgReplicateDelta:
+			sid, serverTick, baseTick, ch, events, err := wire.DecodeReplicateDelta(fr.Payload)
 			if err != nil { continue }
-
 			st, ok := s.getBySID(sid)
 			if !ok { continue }
+			s.sendShapedRep(st, ch, splitRepBatches(RepFmtDelta, serverTick, baseTick, ch, events))
+		case wire.MsgTransferPrepare:
+			sid, _, target, interest, x, y, hp, xfer, err := wire.DecodeTransferPrepare(fr.Payload)
+			if err != nil { continue }
+			s.prepareTransfer(zl, sid, target, &xferState{ID: xfer, Interest: interest, X: x, Y: y, HP: hp})
+		case wire.MsgTransferQuery:
+			sid, xfer, err := wire.DecodeTransferQuery(fr.Payload)
+			if err != nil { continue }
+			s.settleTransfer(zl, sid, xfer)
+		case wire.MsgInstanceCreated:
+			req, inst, code, why, err := wire.DecodeInstanceCreated(fr.Payload)
+			if err != nil { continue }
+			if inst == 0 { why = sprintf("code=%d %s", code, why) }
+			// dialing the instance blocks; the link keeps being read meanwhile
+			go s.instanceCreated(req, inst, why)
+		case wire.MsgInstanceClosed:
+			inst, err := wire.DecodeInstanceClosed(fr.Payload)
+			if err != nil { continue }
+			// only the template's host speaks for its instances
+			if s.mapZone(uint32(inst)) == shared.ZoneID(zl.id) { s.forgetInstance(uint32(inst), "instance closed") }
 
-			// validate target exists
-			s.zonesMu.Lock()
-			_, okTarget := s.zones[uint32(target)]
-			s.zonesMu.Unlock()
-			if !okTarget {
-				_ = s.zoneSend(uint32(st.ZoneID), wire.MsgTransferAbort, wire.EncodeTransferAbort(sid))
-				s.sendReliableText(st, "XFER_ABORT bad_target")
-				continue
-			}
-
-			s.xferMu.Lock()
-			s.inflight[sid] = &xferState{
-				From: st.ZoneID,
-				To: shared.ZoneID(target),
-				Started: time.Now(),
+		case wire.MsgKick:
+			sid, why, err := wire.DecodeKick(fr.Payload)
+			if err != nil { continue }
+			// only the zone the session is in may evict it
+			if st, ok := s.getBySID(sid); ok && uint32(st.Zone()) == zl.id {
+				s.dropSession(st, DiscKicked, why)
 			}
-			s.xferMu.Unlock()
-
-			// attach to target
-			_ = s.zoneSend(uint32(target), wire.MsgAttachWithState, wire.EncodeAttachWithState(sid, st.CharID, shared.ZoneID(target), interest, x, y, hp))
-			// route to target
-			st.ZoneID = shared.ZoneID(target)
-			st.Interest = interest
-			s.sendReliableText(st, sprintf("XFER_PREP %d->%d", zl.id, target))
-
 		case wire.MsgError:
 			code, msg, _ := wire.DecodeError(fr.Payload)
 			log.Printf("zone %d error: code=%d msg=%q", zl.id, code, msg)
@@ -489,41 +812,157 @@ func (s *Server) zoneReadLoop(ctx context.Context, zl *zoneLink) {
 	}
 }
 
-func (s *Server) tryCommitOnAttachAck(ackZoneID uint32) {
-	var commits []struct{ sid shared.SessionID; from shared.ZoneID }
+// prepareTransfer handles zone zl's MsgTransferPrepare of sid to target; xs
+// carries the prepared state. An instanced target stands for the instance
+// of the player's group, which may have to be created first (see
+// instance.go).
+func (s *Server) prepareTransfer(zl *zoneLink, sid shared.SessionID, target shared.ZoneID, xs *xferState) {
+	st, ok := s.getBySID(sid)
+	if !ok { return }
+
 	s.xferMu.Lock()
-	for sid, xs := range s.inflight {
-		if uint32(xs.To) == ackZoneID {
-			commits = append(commits, struct{sid shared.SessionID; from shared.ZoneID}{sid, xs.From})
-			delete(s.inflight, sid)
+	old := s.inflight[sid]
+	s.xferMu.Unlock()
+	if old != nil && old.ID == xs.ID { return } // repeated prepare
+	if (old == nil && uint32(st.Zone()) != zl.id) || (old != nil && uint32(old.From) != zl.id) {
+		// the session is no longer this zone's (it missed a commit):
+		// it must let go of the player rather than hand it on
+		_ = zl.send(wire.MsgDetachPlayer, wire.EncodeDetachPlayer(sid))
+		return
+	}
+	if old != nil {
+		// the source gave up on the earlier transfer and started a new one
+		s.xferMu.Lock()
+		delete(s.inflight, sid)
+		s.xferMu.Unlock()
+		_ = s.zoneSend(uint32(old.To), wire.MsgDetachPlayer, wire.EncodeDetachPlayer(sid))
+		st.setZone(old.From)
+	}
+	xs.From, xs.To, xs.Started = st.Zone(), target, time.Now()
+
+	// validate target exists and the map lets the sender hand over to it
+	s.zonesMu.Lock()
+	_, okTarget := s.zones[uint32(target)]
+	s.zonesMu.Unlock()
+	if !okTarget || !s.cfg.World.Reachable(s.mapZone(zl.id), target) {
+		_ = zl.send(wire.MsgTransferAbort, wire.EncodeTransferAbort(sid, xs.ID))
+		s.sendReliableText(st, "XFER_ABORT bad_target")
+		return
+	}
+	if s.cfg.World.Instanced(target) {
+		key := s.instanceKeyFor(st, target)
+		inst, ok := s.instanceFor(key)
+		if !ok {
+			s.requestInstance(st, key, xs)
+			return
 		}
+		xs.To = inst
 	}
+
+	s.xferMu.Lock()
+	s.inflight[sid] = xs
 	s.xferMu.Unlock()
+	s.attachTarget(st, xs)
+}
 
-	for _, c := range commits {
-		_ = s.zoneSend(uint32(c.from), wire.MsgTransferCommit, wire.EncodeTransferCommit(c.sid))
-		if st, ok := s.getBySID(c.sid); ok {
-			s.sendReliableText(st, "XFER_COMMIT")
-		}
+// attachTarget attaches st's player to the target of transfer xs with the
+// prepared state and routes the session there.
+func (s *Server) attachTarget(st *sessionState, xs *xferState) {
+	_ = s.zoneSend(uint32(xs.To), wire.MsgAttachWithState, wire.EncodeAttachWithState(st.SID, st.CharID, xs.To, xs.Interest, xs.X, xs.Y, xs.HP, xs.ID))
+	st.setZone(xs.To)
+	st.Interest = xs.Interest
+	s.sendReliableText(st, sprintf("XFER_PREP %d->%d", xs.From, xs.To))
+	s.syncParty(st)
+}
+
+// commitTransfer finishes transfer xfer of sid once zone zid, its target,
+// acked the attach. Acks for anything else (plain attaches, transfers that
+// timed out or were superseded) change nothing.
+func (s *Server) commitTransfer(zid uint32, sid shared.SessionID, xfer uint64) {
+	s.xferMu.Lock()
+	xs := s.inflight[sid]
+	if xs == nil || xs.ID != xfer || uint32(xs.To) != zid {
+		s.xferMu.Unlock()
+		return
+	}
+	delete(s.inflight, sid)
+	s.xferMu.Unlock()
+
+	_ = s.zoneSend(uint32(xs.From), wire.MsgTransferCommit, wire.EncodeTransferCommit(sid, xfer))
+	if st, ok := s.getBySID(sid); ok {
+		s.sendReliableText(st, "XFER_COMMIT")
 	}
 }
 
-func (s *Server) dropSession(st *sessionState, why string) {
+// settleTransfer answers zone zl, the source of transfer xfer of sid, which
+// is still waiting for the outcome. An open transfer is left to
+// transferTimeoutLoop; otherwise the outcome is told again: a commit if the
+// session plays elsewhere now, an abort if it is still zl's (we never saw
+// the prepare, or aborted it), a detach if the session is gone.
+func (s *Server) settleTransfer(zl *zoneLink, sid shared.SessionID, xfer uint64) {
+	s.xferMu.Lock()
+	xs := s.inflight[sid]
+	s.xferMu.Unlock()
+	if xs != nil && xs.ID == xfer { return }
+	st, ok := s.getBySID(sid)
+	switch {
+	case !ok:
+		_ = zl.send(wire.MsgDetachPlayer, wire.EncodeDetachPlayer(sid))
+	case uint32(st.Zone()) != zl.id:
+		_ = zl.send(wire.MsgTransferCommit, wire.EncodeTransferCommit(sid, xfer))
+	default:
+		_ = zl.send(wire.MsgTransferAbort, wire.EncodeTransferAbort(sid, xfer))
+	}
+}
+
+// abortTransfer undoes a transfer already taken out of inflight: the source
+// unfreezes the player and the session is routed back to it rather than left
+// on a zone that never took it.
+func (s *Server) abortTransfer(sid shared.SessionID, xs *xferState, why string) {
+	_ = s.zoneSend(uint32(xs.From), wire.MsgTransferAbort, wire.EncodeTransferAbort(sid, xs.ID))
+	if st, ok := s.getBySID(sid); ok {
+		st.zid.CompareAndSwap(uint32(xs.To), uint32(xs.From))
+		s.sendReliableText(st, "XFER_ABORT "+why)
+	}
+}
+
+// dropSession ends st: unless reason is discNone the client gets a
+// PDisconnect first (best effort, nothing is left to retransmit it), then its
+// player is detached from the zone (and from a transfer target, if one was in
+// flight). Only the first caller for a session does anything.
+func (s *Server) dropSession(st *sessionState, reason uint8, why string) {
 	if st == nil {
 		return
 	}
-	log.Printf("drop session sid=%s why=%s", st.SID.String(), why)
-	// best-effort detach from zone
-	if st.ZoneID != 0 {
-		_ = s.zoneSend(uint32(st.ZoneID), wire.MsgDetachPlayer, wire.EncodeDetachPlayer(st.SID))
-	}
-	// remove from maps
+	// remove from maps; only the first caller gets past this
 	s.sessionsMu.Lock()
-	defer s.sessionsMu.Unlock()
-	if st.raddr != nil {
-		delete(s.byRemote, st.raddr.String())
+	ra, ok := s.bySID[st.SID]
+	if !ok || s.byRemote[ra] != st {
+		s.sessionsMu.Unlock()
+		return
 	}
+	delete(s.byRemote, ra)
 	delete(s.bySID, st.SID)
+	s.sessionsMu.Unlock()
+	log.Printf("drop session sid=%s remote=%s char=%d why=%s", st.SID.String(), ra, st.CharID, why)
+	if reason != discNone && st.sec.Load() != nil {
+		s.writeSealed(st, st.peer.Encode(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PDisconnect, Payload: encodeDisconnect(reason, why)}))
+	}
+
+	s.xferMu.Lock()
+	xs := s.inflight[st.SID]
+	delete(s.inflight, st.SID)
+	s.xferMu.Unlock()
+
+	// best-effort detach from zone; mid-transfer the session already points
+	// at the target, and the source still holds the player frozen
+	detach := []shared.ZoneID{st.Zone()}
+	if xs != nil { detach = append(detach, xs.From, xs.To) }
+	for i, zid := range detach {
+		if zid == 0 || slices.Contains(detach[:i], zid) { continue }
+		_ = s.zoneSend(uint32(zid), wire.MsgDetachPlayer, wire.EncodeDetachPlayer(st.SID))
+	}
+	s.partyGone(st)
 }
 
 // ---- tiny little-endian helpers (avoid extra deps) ----
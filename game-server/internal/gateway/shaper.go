@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"game-server/internal/netcode"
+	"game-server/internal/shared/wire"
+)
+
+// Outbound shaping. Every datagram to a client is paid for from the
+// session's token bucket (sealed size).
+//
+//   - reliable packets that do not fit are queued FIFO and go out, in order,
+//     as tokens refill; nothing is dropped (retransmits included)
+//   - an unreliable replication message (all its parts) that does not fit
+//     is parked; a newer message for the same channel replaces it. That is
+//     safe because replication is diffed against the client's acked
+//     baseline, so the newer message covers whatever the older one carried
+//
+// Reliable traffic goes first: replication waits while reliable is queued.
+
+const shapeInterval = 10 * time.Millisecond
+
+type shaper struct {
+	mu     sync.Mutex
+	bucket tokenBucket
+	rel    []*netcode.Sent              // queued reliable packets, oldest first
+	rep    map[wire.RepChannel][][]byte // parked replication message per channel
+}
+
+// sessionStats are the per-session outbound counters exported on /metrics.
+type sessionStats struct {
+	TxBytes      atomic.Int64
+	RepSent      atomic.Int64 // replication messages sent
+	RepCoalesced atomic.Int64 // parked messages replaced by a newer one (dropped)
+	RelQueued    atomic.Int64 // reliable packets that had to wait for tokens
+	RelRejected  atomic.Int64 // reliable messages refused at MaxReliableBytes
+	RepAcked     atomic.Int64 // replication messages the client acked
+	Retransmits  atomic.Int64
+	Rate         atomic.Int64 // current congestion-controlled send rate, bytes/sec
+}
+
+func newShaper(rate, burst int) *shaper {
+	return &shaper{bucket: newBucket(rate, burst), rep: make(map[wire.RepChannel][][]byte)}
+}
+
+// setRate retunes the bucket (congestion control, see congestion.go).
+func (sh *shaper) setRate(rate, burst int) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.bucket.refill(time.Now()) // settle tokens earned at the old rate
+	sh.bucket.rate = rate
+	if burst < rate/10 { burst = rate/10 }
+	sh.bucket.burst = burst
+	if sh.bucket.tokens > burst { sh.bucket.tokens = burst }
+}
+
+func sealedSize(pkt []byte) int { return len(pkt) + netcode.SealOverhead }
+
+// sendShapedReliable writes sm now if the bucket allows, else queues it.
+func (s *Server) sendShapedReliable(st *sessionState, sm *netcode.Sent) {
+	sh := st.out
+	sh.mu.Lock()
+	if len(sh.rel) > 0 || !sh.bucket.take(time.Now(), sealedSize(sm.Pkt)) {
+		if st.peer.Hold(sm) {
+			sh.rel = append(sh.rel, sm)
+			st.stats.RelQueued.Add(1)
+		}
+		sh.mu.Unlock()
+		return
+	}
+	sh.mu.Unlock()
+	s.writeSealed(st, sm.Pkt)
+}
+
+// sendShapedRep writes all parts of one replication message, or parks it.
+func (s *Server) sendShapedRep(st *sessionState, ch wire.RepChannel, batches [][]byte) {
+	pkts := make([][]byte, 0, len(batches))
+	size := 0
+	for _, b := range batches {
+		pkt := s.repPacket(st, b)
+		pkts = append(pkts, pkt)
+		size += sealedSize(pkt)
+	}
+	sh := st.out
+	sh.mu.Lock()
+	if len(sh.rel) > 0 || !sh.bucket.take(time.Now(), size) {
+		if sh.rep[ch] != nil { st.stats.RepCoalesced.Add(1) }
+		sh.rep[ch] = pkts
+		sh.mu.Unlock()
+		return
+	}
+	// anything parked for ch is older than what we just sent
+	if sh.rep[ch] != nil {
+		delete(sh.rep, ch)
+		st.stats.RepCoalesced.Add(1)
+	}
+	sh.mu.Unlock()
+	for _, pkt := range pkts { s.writeSealed(st, pkt) }
+	st.stats.RepSent.Add(1)
+}
+
+// flushShaped sends what the bucket now allows: queued reliable first, then
+// parked replication (whole messages only).
+func (s *Server) flushShaped(st *sessionState, now time.Time) {
+	sh := st.out
+	var out [][]byte
+	var reps int
+	sh.mu.Lock()
+	for len(sh.rel) > 0 && sh.bucket.take(now, sealedSize(sh.rel[0].Pkt)) {
+		sm := sh.rel[0]
+		sh.rel = sh.rel[1:]
+		st.peer.Release(sm, now) // the RTO starts when it actually leaves
+		out = append(out, sm.Pkt)
+	}
+	if len(sh.rel) == 0 {
+		for _, ch := range []wire.RepChannel{wire.ChanMove, wire.ChanState} {
+			pkts := sh.rep[ch]
+			if pkts == nil { continue }
+			size := 0
+			for _, p := range pkts { size += sealedSize(p) }
+			if !sh.bucket.take(now, size) { break }
+			delete(sh.rep, ch)
+			out = append(out, pkts...)
+			reps++
+		}
+	}
+	sh.mu.Unlock()
+	for _, pkt := range out { s.writeSealed(st, pkt) }
+	st.stats.RepSent.Add(int64(reps))
+}
+
+// flushAck sends an empty PAck when the client's reliable packets found no
+// outgoing traffic to ride on. Not shaped: it is a header's worth of bytes
+// and holding it back would only cause retransmits.
+func (s *Server) flushAck(st *sessionState, now time.Time) {
+	if st.sec.Load() == nil || !st.peer.AckDue(now) { return }
+	s.writeSealed(st, st.peer.Encode(netcode.Packet{Proto: s.cfg.ProtoVersion, Chan: netcode.ChanUnreliable, PType: PAck}))
+}
+
+func (s *Server) shapeLoop(ctx context.Context) {
+	t := time.NewTicker(shapeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.sessionsMu.Lock()
+			sts := make([]*sessionState, 0, len(s.byRemote))
+			for _, st := range s.byRemote { sts = append(sts, st) }
+			s.sessionsMu.Unlock()
+			for _, st := range sts {
+				s.flushShaped(st, now)
+				s.flushAck(st, now)
+			}
+		}
+	}
+}
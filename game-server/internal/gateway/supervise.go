@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"game-server/internal/shared"
+	"game-server/internal/shared/wire"
+)
+
+// Zone link supervision: a link that fails is taken out of routing, its
+// sessions are told the zone is unavailable, and we redial with exponential
+// backoff. Once the handshake succeeds again every session routed to that
+// zone is re-attached (the zone detached them when the link dropped).
+
+const (
+	redialMin = 200 * time.Millisecond
+	redialMax = 5 * time.Second
+)
+
+func (s *Server) superviseZone(ctx context.Context, zl *zoneLink) {
+	for {
+		s.zoneReadLoop(ctx, zl)
+		if ctx.Err() != nil { return }
+		s.zoneDown(zl)
+		zl = s.redialZone(ctx, zl.id, zl.addr)
+		if zl == nil { return }
+		s.zoneUp(zl)
+	}
+}
+
+func (s *Server) zoneDown(zl *zoneLink) {
+	s.zonesMu.Lock()
+	if s.zones[zl.id] == zl { delete(s.zones, zl.id) }
+	s.zonesMu.Unlock()
+	_ = zl.conn.Close()
+	s.failInstanceReqs(zl.id)
+
+	sts := s.sessionsInZone(shared.ZoneID(zl.id))
+	log.Printf("zone %d link down, %d sessions waiting", zl.id, len(sts))
+	for _, st := range sts {
+		s.sendReliableText(st, sprintf("ZONE_DOWN %d", zl.id))
+	}
+}
+
+// redialZone returns nil when ctx is done or the zone is no longer wanted:
+// an instance that was closed, or that its host no longer has.
+func (s *Server) redialZone(ctx context.Context, zid uint32, addr string) *zoneLink {
+	backoff := redialMin
+	for attempt := 1; ; attempt++ {
+		// +-20% jitter so a fleet of gateways does not redial in lockstep
+		d := backoff + time.Duration((rand.Float64()*0.4-0.2)*float64(backoff))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d):
+		}
+		if !s.wantZone(zid) { return nil }
+		zl, err := dialZone(zid, addr)
+		if err == nil { return zl }
+		if errors.Is(err, errRejected) && s.isInstance(zid) {
+			s.forgetInstance(zid, "instance lost")
+			return nil
+		}
+		log.Printf("zone %d redial attempt %d failed: %v", zid, attempt, err)
+		backoff *= 2
+		if backoff > redialMax { backoff = redialMax }
+	}
+}
+
+func (s *Server) zoneUp(zl *zoneLink) {
+	s.zonesMu.Lock()
+	s.zones[zl.id] = zl
+	s.zonesMu.Unlock()
+
+	zid := shared.ZoneID(zl.id)
+	sts := s.sessionsInZone(zid)
+	for _, st := range sts {
+		if st.CharID == 0 { continue }
+		// a session mid-transfer into this zone carries its prepared state
+		s.xferMu.Lock()
+		xs := s.inflight[st.SID]
+		s.xferMu.Unlock()
+		if xs != nil && xs.To == zid {
+			_ = zl.send(wire.MsgAttachWithState, wire.EncodeAttachWithState(st.SID, st.CharID, zid, xs.Interest, xs.X, xs.Y, xs.HP, xs.ID))
+		} else {
+			_ = zl.send(wire.MsgAttachPlayer, wire.EncodeAttachPlayer(st.SID, st.CharID, zid, st.Interest))
+		}
+		s.syncParty(st)
+		s.sendReliableText(st, sprintf("ZONE_UP %d", zl.id))
+	}
+	log.Printf("zone %d link up, re-attached %d sessions", zl.id, len(sts))
+}
+
+func (s *Server) sessionsInZone(zid shared.ZoneID) []*sessionState {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	var out []*sessionState
+	for _, st := range s.byRemote {
+		if st.Zone() == zid { out = append(out, st) }
+	}
+	return out
+}
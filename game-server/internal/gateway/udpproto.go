@@ -1,76 +1,65 @@
 package gateway
 
-import (
-	"encoding/binary"
-	"errors"
-)
-
-const (
-	UdpMagic uint16 = 0x4D4D // 'MM'
-)
-
-// Channels
-const (
-	ChanUnreliable uint8 = 0
-	ChanReliable   uint8 = 1
-)
+// ProtoVersion is the UDP protocol version both binaries default to. Bump it
+// with every change old peers cannot read:
+//   2: PHello carries the identity token
+//   3: packets sealed after a PKeyEx key exchange
+//   4: 64-packet ack window, HeaderLen 22
+const ProtoVersion = 4
 
-// Payload types
+// Gateway <-> client payload types, carried in netcode.Packet.PType.
 const (
-	PHello  uint8 = 1
+	PHello  uint8 = 1 // [cid:u64][interest:u32][tokLen:u16][token], cid 0 = take it from the token
 	PInput  uint8 = 2
 	PAction uint8 = 3
 	PText   uint8 = 4
-	PRep    uint8 = 5 // replicate line (demo)
+	PRep    uint8 = 5 // replicate line (demo, superseded by PRepBin)
+	PRepBin uint8 = 6 // binary replicate batch, see EncodeRepBatch
+	PRepAck uint8 = 7 // client -> gateway: [serverTick:u32][chan:u8] fully received
+	PKeyEx   uint8 = 8 // plaintext client -> gateway: [x25519 pub:32][cookie, once challenged]
+	PKeyExOk uint8 = 9 // plaintext gateway -> client: [x25519 pub:32]
+	PChallenge uint8 = 10 // plaintext gateway -> client: [cookie], see cookie.go
+	PResume  uint8 = 11 // plaintext client -> gateway: [sid:16][sealed PResume [token:16]], see resume.go
+	PAck     uint8 = 12 // empty; acks reliable packets when there is nothing else to send
+	PPing    uint8 = 13 // either way: [id:u32][sentAt:i64], see netcode/ping.go
+	PPong    uint8 = 14 // echoes a PPing payload
+	PTimeSync   uint8 = 15 // client -> gateway: [t0:i64], see clock.go
+	PTimeSyncOk uint8 = 16 // gateway -> client: [t0:i64][serverTick:u32][frac:u16][tickHz:u16]
+	PDisconnect uint8 = 17 // gateway -> client: [reason:u8][text]; the session is gone
+	PParty      uint8 = 18 // client -> gateway: [op:u8][cid:u64], see party.go
 )
 
-// Packet:
-// [magic:u16][proto:u16][chan:u8][ptype:u8][seq:u32][ack:u32][ackBits:u32][payload...]
-const HeaderLen = 2+2+1+1+4+4+4
+// Disconnect reasons carried in PDisconnect.
+const (
+	DiscIdle          uint8 = 1
+	DiscKicked        uint8 = 2 // by the zone (MsgKick) or an operator; text says why
+	DiscShutdown      uint8 = 3
+	DiscAuthFailed    uint8 = 4
+	DiscProtoMismatch uint8 = 5 // sent in the clear, the client never got a channel
+	DiscLinkLost      uint8 = 6 // reliable retries exhausted
+	DiscBacklog       uint8 = 7 // ordered backlog over MaxReliableBytes
+	DiscProtocol      uint8 = 8 // the client broke the ordered stream
 
-type Packet struct {
-	Proto   uint16
-	Chan    uint8
-	PType   uint8
-	Seq     uint32
-	Ack     uint32
-	AckBits uint32
-	Payload []byte
-}
+	// discNone drops a session without a PDisconnect (already sent)
+	discNone uint8 = 0
+)
 
-func EncodePacket(p Packet, dst []byte) []byte {
-	n := HeaderLen + len(p.Payload)
-	if cap(dst) < n {
-		dst = make([]byte, n)
-	} else {
-		dst = dst[:n]
+// DiscReasonString names a PDisconnect reason for logs and players.
+func DiscReasonString(r uint8) string {
+	switch r {
+	case DiscIdle: return "idle"
+	case DiscKicked: return "kicked"
+	case DiscShutdown: return "server shutdown"
+	case DiscAuthFailed: return "auth failed"
+	case DiscProtoMismatch: return "protocol mismatch"
+	case DiscLinkLost: return "link lost"
+	case DiscBacklog: return "backlog overflow"
+	case DiscProtocol: return "protocol error"
 	}
-	binary.LittleEndian.PutUint16(dst[0:2], UdpMagic)
-	binary.LittleEndian.PutUint16(dst[2:4], p.Proto)
-	dst[4] = p.Chan
-	dst[5] = p.PType
-	binary.LittleEndian.PutUint32(dst[6:10], p.Seq)
-	binary.LittleEndian.PutUint32(dst[10:14], p.Ack)
-	binary.LittleEndian.PutUint32(dst[14:18], p.AckBits)
-	copy(dst[18:], p.Payload)
-	return dst
+	return "unknown"
 }
 
-func DecodePacket(b []byte) (Packet, error) {
-	if len(b) < HeaderLen {
-		return Packet{}, errors.New("short packet")
-	}
-	if binary.LittleEndian.Uint16(b[0:2]) != UdpMagic {
-		return Packet{}, errors.New("bad magic")
-	}
-	p := Packet{
-		Proto: binary.LittleEndian.Uint16(b[2:4]),
-		Chan: b[4],
-		PType: b[5],
-		Seq: binary.LittleEndian.Uint32(b[6:10]),
-		Ack: binary.LittleEndian.Uint32(b[10:14]),
-		AckBits: binary.LittleEndian.Uint32(b[14:18]),
-		Payload: b[18:],
-	}
-	return p, nil
+func encodeDisconnect(reason uint8, text string) []byte {
+	return append([]byte{reason}, text...)
 }
+
@@ -0,0 +1,113 @@
+package netcode
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Ordered reliable channel (ChanOrdered).
+//
+// ChanOrdered packets ride the same seq/ack/retransmit machinery as
+// ChanReliable; on top of that every payload starts with
+//
+//	[oseq:u32][frag:u16][frags:u16] data...
+//
+// oseq numbers fragments consecutively per direction. The receiver hands
+// fragments to the application strictly in oseq order, drops duplicates, and
+// joins the frags pieces of a message before delivering it. Messages bigger
+// than one datagram are split by OrderedSender.Fragment.
+
+const OrderedHeaderLen = 4 + 2 + 2
+
+// MaxOrderedFrag is the largest fragment body that still fits one sealed datagram.
+const MaxOrderedFrag = MaxDatagram - SealOverhead - HeaderLen - OrderedHeaderLen
+
+// MaxOrderedMessage bounds a reassembled message (and what we buffer for it).
+const MaxOrderedMessage = 256 * 1024
+
+// orderedWindow is how far ahead of the next expected oseq we buffer.
+const orderedWindow = 1024
+
+type OrderedSender struct {
+	next uint32
+}
+
+// Fragment splits msg into ordered payloads, ready to be sent as ChanOrdered
+// packets of the same PType, in order.
+func (o *OrderedSender) Fragment(msg []byte) ([][]byte, error) {
+	if len(msg) > MaxOrderedMessage { return nil, errors.New("ordered message too large") }
+	frags := (len(msg) + MaxOrderedFrag - 1) / MaxOrderedFrag
+	if frags == 0 { frags = 1 }
+	out := make([][]byte, 0, frags)
+	for i := 0; i < frags; i++ {
+		end := (i + 1) * MaxOrderedFrag
+		if end > len(msg) { end = len(msg) }
+		b := make([]byte, OrderedHeaderLen, OrderedHeaderLen+end-i*MaxOrderedFrag)
+		binary.LittleEndian.PutUint32(b[0:4], o.next)
+		binary.LittleEndian.PutUint16(b[4:6], uint16(i))
+		binary.LittleEndian.PutUint16(b[6:8], uint16(frags))
+		out = append(out, append(b, msg[i*MaxOrderedFrag:end]...))
+		o.next++
+	}
+	return out, nil
+}
+
+type OrderedMsg struct {
+	PType uint8
+	Data  []byte
+}
+
+type orderedFrag struct {
+	ptype       uint8
+	frag, frags uint16
+	data        []byte
+}
+
+type OrderedReceiver struct {
+	next    uint32
+	pending map[uint32]orderedFrag
+	partial []byte
+	pfrags  int // fragments joined into partial so far
+}
+
+func NewOrderedReceiver() *OrderedReceiver {
+	return &OrderedReceiver{pending: make(map[uint32]orderedFrag)}
+}
+
+// Push takes one ChanOrdered payload and returns every message it completes,
+// in order. Duplicates and fragments outside the window return nothing.
+func (r *OrderedReceiver) Push(ptype uint8, payload []byte) ([]OrderedMsg, error) {
+	if len(payload) < OrderedHeaderLen { return nil, errors.New("short ordered payload") }
+	oseq := binary.LittleEndian.Uint32(payload[0:4])
+	f := orderedFrag{
+		ptype: ptype,
+		frag: binary.LittleEndian.Uint16(payload[4:6]),
+		frags: binary.LittleEndian.Uint16(payload[6:8]),
+		data: append([]byte(nil), payload[OrderedHeaderLen:]...),
+	}
+	if f.frags == 0 || f.frag >= f.frags { return nil, errors.New("bad ordered fragment") }
+	// wraparound-safe "already delivered" / "too far ahead"
+	if d := oseq - r.next; int32(d) < 0 || d >= orderedWindow { return nil, nil }
+	if _, dup := r.pending[oseq]; dup { return nil, nil }
+	r.pending[oseq] = f
+
+	var out []OrderedMsg
+	for {
+		f, ok := r.pending[r.next]
+		if !ok { break }
+		delete(r.pending, r.next)
+		r.next++
+		if int(f.frag) != r.pfrags || len(r.partial)+len(f.data) > MaxOrderedMessage {
+			// sender bug or hostile peer: the stream cannot be trusted past
+			// here; drop the half-joined message so nothing builds on it
+			r.partial, r.pfrags = nil, 0
+			return out, errors.New("ordered stream out of step")
+		}
+		r.partial = append(r.partial, f.data...)
+		r.pfrags++
+		if r.pfrags < int(f.frags) { continue }
+		out = append(out, OrderedMsg{PType: f.ptype, Data: r.partial})
+		r.partial, r.pfrags = nil, 0
+	}
+	return out, nil
+}
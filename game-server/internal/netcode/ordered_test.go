@@ -0,0 +1,102 @@
+package netcode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func orderedPayload(oseq uint32, frag, frags uint16, data string) []byte {
+	b := make([]byte, OrderedHeaderLen, OrderedHeaderLen+len(data))
+	binary.LittleEndian.PutUint32(b[0:4], oseq)
+	binary.LittleEndian.PutUint16(b[4:6], frag)
+	binary.LittleEndian.PutUint16(b[6:8], frags)
+	return append(b, data...)
+}
+
+func TestOrderedReceiver(t *testing.T) {
+	type push struct {
+		oseq        uint32
+		frag, frags uint16
+		data        string
+	}
+	tests := []struct {
+		name   string
+		pushes []push
+		want   []string // messages delivered, in order
+	}{
+		{name: "in order", pushes: []push{{0, 0, 1, "a"}, {1, 0, 1, "b"}}, want: []string{"a", "b"}},
+		{name: "reordered", pushes: []push{{2, 0, 1, "c"}, {1, 0, 1, "b"}, {0, 0, 1, "a"}}, want: []string{"a", "b", "c"}},
+		{name: "fragments", pushes: []push{{0, 0, 3, "ab"}, {1, 1, 3, "cd"}, {2, 2, 3, "e"}}, want: []string{"abcde"}},
+		{name: "fragments reversed", pushes: []push{{2, 2, 3, "e"}, {1, 1, 3, "cd"}, {0, 0, 3, "ab"}}, want: []string{"abcde"}},
+		{name: "duplicate", pushes: []push{{0, 0, 1, "a"}, {0, 0, 1, "a"}, {1, 0, 1, "b"}, {1, 0, 1, "b"}}, want: []string{"a", "b"}},
+		{name: "duplicate while buffered", pushes: []push{{1, 0, 1, "b"}, {1, 0, 1, "x"}, {0, 0, 1, "a"}}, want: []string{"a", "b"}},
+		{name: "beyond the window", pushes: []push{{orderedWindow, 0, 1, "z"}, {0, 0, 1, "a"}}, want: []string{"a"}},
+		{name: "empty message", pushes: []push{{0, 0, 1, ""}}, want: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewOrderedReceiver()
+			var got []string
+			for _, p := range tt.pushes {
+				msgs, err := r.Push(7, orderedPayload(p.oseq, p.frag, p.frags, p.data))
+				if err != nil { t.Fatalf("push %+v: %v", p, err) }
+				for _, m := range msgs {
+					if m.PType != 7 { t.Errorf("ptype %d", m.PType) }
+					got = append(got, string(m.Data))
+				}
+			}
+			if len(got) != len(tt.want) { t.Fatalf("got %q, want %q", got, tt.want) }
+			for i := range got {
+				if got[i] != tt.want[i] { t.Fatalf("got %q, want %q", got, tt.want) }
+			}
+		})
+	}
+}
+
+func TestOrderedReceiverRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "short", payload: []byte{1, 2, 3}},
+		{name: "no fragments", payload: orderedPayload(0, 0, 0, "a")},
+		{name: "fragment past the count", payload: orderedPayload(0, 2, 2, "a")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewOrderedReceiver().Push(1, tt.payload); err == nil { t.Error("accepted") }
+		})
+	}
+}
+
+// A stream that goes out of step reports it once and then carries on with
+// the next whole message instead of joining onto the broken one.
+func TestOrderedReceiverOutOfStep(t *testing.T) {
+	r := NewOrderedReceiver()
+	if _, err := r.Push(1, orderedPayload(0, 0, 2, "half")); err != nil { t.Fatal(err) }
+	if _, err := r.Push(1, orderedPayload(1, 0, 1, "skip")); err == nil { t.Fatal("out-of-step fragment accepted") }
+	msgs, err := r.Push(1, orderedPayload(2, 0, 1, "next"))
+	if err != nil { t.Fatalf("stream wedged: %v", err) }
+	if len(msgs) != 1 || string(msgs[0].Data) != "next" { t.Fatalf("got %+v", msgs) }
+}
+
+func TestOrderedFragmentRoundTrip(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789"), (3*MaxOrderedFrag+5)/10+1)
+	var s OrderedSender
+	if _, err := s.Fragment([]byte("first")); err != nil { t.Fatal(err) }
+	frags, err := s.Fragment(msg)
+	if err != nil { t.Fatal(err) }
+	if len(frags) != 4 { t.Fatalf("%d fragments", len(frags)) }
+
+	r := NewOrderedReceiver()
+	if out, _ := r.Push(2, orderedPayload(0, 0, 1, "first")); len(out) != 1 { t.Fatal("first message not delivered") }
+	for i := len(frags) - 1; i >= 0; i-- {
+		if len(frags[i]) > OrderedHeaderLen+MaxOrderedFrag { t.Errorf("fragment %d is %d bytes", i, len(frags[i])) }
+		out, err := r.Push(2, frags[i])
+		if err != nil { t.Fatal(err) }
+		if i > 0 && len(out) != 0 { t.Fatalf("delivered before fragment 0 arrived") }
+		if i == 0 && (len(out) != 1 || !bytes.Equal(out[0].Data, msg)) { t.Fatalf("reassembled message differs") }
+	}
+	if _, err := s.Fragment(make([]byte, MaxOrderedMessage+1)); err == nil { t.Error("oversized message fragmented") }
+}
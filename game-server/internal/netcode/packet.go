@@ -0,0 +1,77 @@
+package netcode
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Datagram framing shared by the gateway and clients. What a PType means is
+// up to the application (see gateway/udpproto.go).
+
+const (
+	UdpMagic uint16 = 0x4D4D // 'MM'
+)
+
+// MaxDatagram is the UDP payload size we aim to stay under (safe for most paths).
+const MaxDatagram = 1200
+
+// Channels
+const (
+	ChanUnreliable uint8 = 0
+	ChanReliable   uint8 = 1
+	ChanOrdered    uint8 = 2 // reliable, in order, fragmented (see ordered.go)
+)
+
+// Packet:
+// [magic:u16][proto:u16][chan:u8][ptype:u8][seq:u32][ack:u32][ackBits:u64][payload...]
+const HeaderLen = 2+2+1+1+4+4+8
+
+type Packet struct {
+	Proto   uint16
+	Chan    uint8
+	PType   uint8
+	Seq     uint32
+	Ack     uint32
+	AckBits uint64 // AckWindow packets behind Ack, see UpdateAckWindow
+	Payload []byte
+}
+
+// Reliable reports whether the packet is acked and retransmitted.
+func (p Packet) Reliable() bool { return p.Chan == ChanReliable || p.Chan == ChanOrdered }
+
+func EncodePacket(p Packet, dst []byte) []byte {
+	n := HeaderLen + len(p.Payload)
+	if cap(dst) < n {
+		dst = make([]byte, n)
+	} else {
+		dst = dst[:n]
+	}
+	binary.LittleEndian.PutUint16(dst[0:2], UdpMagic)
+	binary.LittleEndian.PutUint16(dst[2:4], p.Proto)
+	dst[4] = p.Chan
+	dst[5] = p.PType
+	binary.LittleEndian.PutUint32(dst[6:10], p.Seq)
+	binary.LittleEndian.PutUint32(dst[10:14], p.Ack)
+	binary.LittleEndian.PutUint64(dst[14:22], p.AckBits)
+	copy(dst[22:], p.Payload)
+	return dst
+}
+
+func DecodePacket(b []byte) (Packet, error) {
+	if len(b) < HeaderLen {
+		return Packet{}, errors.New("short packet")
+	}
+	if binary.LittleEndian.Uint16(b[0:2]) != UdpMagic {
+		return Packet{}, errors.New("bad magic")
+	}
+	p := Packet{
+		Proto: binary.LittleEndian.Uint16(b[2:4]),
+		Chan: b[4],
+		PType: b[5],
+		Seq: binary.LittleEndian.Uint32(b[6:10]),
+		Ack: binary.LittleEndian.Uint32(b[10:14]),
+		AckBits: binary.LittleEndian.Uint64(b[14:22]),
+		Payload: b[22:],
+	}
+	return p, nil
+}
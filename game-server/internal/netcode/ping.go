@@ -0,0 +1,110 @@
+package netcode
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Keepalive pings. Either side sends a ping every PingInterval and the
+// other echoes the payload straight back in a pong, so the sender reads the
+// RTT off its own clock (the two clocks never have to agree). The pings also
+// keep an idle session from timing out and carry acks when there is no data.
+//
+// Ping/pong payload: [id:u32][sentAt:i64 unix nanos, sender's clock]
+
+const PingLen = 4 + 8
+
+const (
+	PingInterval = time.Second
+	// a ping not answered this long after it went out counts as lost
+	PingLostAfter = 2 * time.Second
+	pingWindow    = 32 // pings remembered for matching pongs and loss
+)
+
+func EncodePing(id uint32, at time.Time) []byte {
+	b := make([]byte, PingLen)
+	binary.LittleEndian.PutUint32(b[0:4], id)
+	binary.LittleEndian.PutUint64(b[4:12], uint64(at.UnixNano()))
+	return b
+}
+
+func DecodePing(b []byte) (id uint32, at time.Time, err error) {
+	if len(b) != PingLen { return 0, at, errors.New("bad ping payload") }
+	id = binary.LittleEndian.Uint32(b[0:4])
+	at = time.Unix(0, int64(binary.LittleEndian.Uint64(b[4:12])))
+	return id, at, nil
+}
+
+// LinkStats is the sending side of the pings: RTT, jitter and loss of one
+// link. Safe for concurrent use.
+type LinkStats struct {
+	mu     sync.Mutex
+	nextID uint32
+	sent   [pingWindow]pingRec
+	rtt    time.Duration // smoothed
+	jitter time.Duration // mean deviation between consecutive samples
+	last   time.Duration // previous sample
+}
+
+type pingRec struct {
+	id       uint32
+	at       time.Time
+	answered bool
+}
+
+// LinkSnapshot is a point-in-time read of LinkStats.
+type LinkSnapshot struct {
+	RTT    time.Duration // zero until the first pong
+	Jitter time.Duration
+	Loss   float64 // share of recent pings never answered, 0..1
+}
+
+// NextPing records a ping sent at now and returns its payload.
+func (l *LinkStats) NextPing(now time.Time) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	l.sent[l.nextID%pingWindow] = pingRec{id: l.nextID, at: now}
+	return EncodePing(l.nextID, now)
+}
+
+// OnPong takes the echoed payload and returns the RTT sample. Pongs for pings
+// we did not send (or already counted) are ignored.
+func (l *LinkStats) OnPong(payload []byte, now time.Time) (time.Duration, bool) {
+	id, at, err := DecodePing(payload)
+	if err != nil { return 0, false }
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := &l.sent[id%pingWindow]
+	if r.id != id || r.answered || !r.at.Equal(at) { return 0, false }
+	r.answered = true
+	sample := now.Sub(r.at)
+	if sample < 0 { return 0, false }
+	if l.rtt == 0 {
+		l.rtt = sample
+	} else {
+		// RFC 3550-style: jitter moves 1/16 of the way to each new deviation
+		d := sample - l.last
+		if d < 0 { d = -d }
+		l.jitter += (d - l.jitter) / 16
+		l.rtt += (sample - l.rtt) / 8
+	}
+	l.last = sample
+	return sample, true
+}
+
+func (l *LinkStats) Snapshot(now time.Time) LinkSnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	due, lost := 0, 0
+	for _, r := range l.sent {
+		if r.id == 0 || now.Sub(r.at) < PingLostAfter { continue }
+		due++
+		if !r.answered { lost++ }
+	}
+	s := LinkSnapshot{RTT: l.rtt, Jitter: l.jitter}
+	if due > 0 { s.Loss = float64(lost) / float64(due) }
+	return s
+}
@@ -0,0 +1,310 @@
+package netcode
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Sent is a reliable packet waiting for its ack. Seq and Pkt never change;
+// the rest belongs to the Endpoint that issued it.
+type Sent struct {
+	Seq uint32
+	Pkt []byte // encoded packet, resent as is
+
+	sentAt  time.Time
+	retries int
+	held    bool // waiting in a sender-side queue, not on the wire yet
+
+	rto      time.Duration // this message's timer; doubles on every timeout
+	fastRetx bool          // already resent because later packets were acked
+}
+
+// Ack window and loss detection shared by both ends of the link.
+const (
+	// AckWindow is how many packets behind Ack the AckBits bitmap covers.
+	AckWindow = 64
+	// FastRetxThreshold: a packet this far behind the newest acked one is
+	// taken as lost and resent at once instead of waiting for its RTO.
+	FastRetxThreshold = 3
+	// MaxRTO caps per-message backoff.
+	MaxRTO = 4 * time.Second
+	// AckDelay is how long a received reliable packet may wait for outgoing
+	// data to carry its ack before an empty ack is due (see AckDue).
+	AckDelay = 10 * time.Millisecond
+)
+
+// UpdateAckWindow folds a received reliable seq into (max, mask); bit i of
+// mask set means max-1-i was received.
+func UpdateAckWindow(max uint32, mask uint64, seq uint32) (uint32, uint64) {
+	if seq == 0 { return max, mask }
+	if max == 0 { return seq, 0 }
+	if seq > max {
+		shift := seq - max
+		if shift > AckWindow {
+			mask = 0
+		} else {
+			mask = mask<<shift | 1<<(shift-1)
+		}
+		return seq, mask
+	}
+	if d := max - seq; d > 0 && d <= AckWindow { mask |= 1 << (d - 1) }
+	return max, mask
+}
+
+// AckedBy reports whether (ack, ackBits) covers seq.
+func AckedBy(ack uint32, ackBits uint64, seq uint32) bool {
+	if seq == 0 || ack == seq { return true }
+	if seq > ack { return false }
+	d := ack - seq
+	if d > AckWindow { return false }
+	return ackBits&(1<<(d-1)) != 0
+}
+
+// FastRetxDue reports whether an unacked seq should be resent now because a
+// packet FastRetxThreshold or more newer has been acked (an implicit NACK).
+func FastRetxDue(largestAcked, seq uint32) bool {
+	return largestAcked > seq && largestAcked-seq >= FastRetxThreshold
+}
+
+// BackoffRTO is the next timer for a message that just timed out.
+func BackoffRTO(rto time.Duration) time.Duration {
+	rto *= 2
+	if rto > MaxRTO { rto = MaxRTO }
+	return rto
+}
+
+type rttEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	inited bool
+}
+
+func (r *rttEstimator) update(sample time.Duration) {
+	if sample <= 0 {
+		return
+	}
+	// Jacobson/Karels (RFC6298-ish constants)
+	const (
+		alpha = 1.0 / 8.0
+		beta  = 1.0 / 4.0
+	)
+	if !r.inited {
+		r.srtt = sample
+		r.rttvar = sample / 2
+		r.rto = clamp(sample*3, 200*time.Millisecond, 2*time.Second)
+		r.inited = true
+		return
+	}
+	// rttvar = (1-beta)*rttvar + beta*|srtt-sample|
+	if r.srtt > sample {
+		r.rttvar = time.Duration((1-beta)*float64(r.rttvar) + beta*float64(r.srtt-sample))
+	} else {
+		r.rttvar = time.Duration((1-beta)*float64(r.rttvar) + beta*float64(sample-r.srtt))
+	}
+	// srtt = (1-alpha)*srtt + alpha*sample
+	r.srtt = time.Duration((1-alpha)*float64(r.srtt) + alpha*float64(sample))
+	r.rto = clamp(r.srtt+4*r.rttvar, 200*time.Millisecond, 2*time.Second)
+}
+
+func clamp(v, lo, hi time.Duration) time.Duration {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// ErrBacklogFull is returned by SendReliable when the unacked backlog would
+// go over the endpoint's limit.
+var ErrBacklogFull = errors.New("reliable backlog full")
+
+// Endpoint is one side of a reliable link: seq allocation, the receive ack
+// window, unacked messages with their timers, and the RTT estimate. It is
+// safe for concurrent use; the read loop, the senders and the retransmit
+// timer all share it.
+type Endpoint struct {
+	mu sync.Mutex
+
+	// send
+	nextSeq         uint32
+	pending         map[uint32]*Sent
+	pendingBytes    int
+	maxPendingBytes int
+
+	// recv
+	recvMax  uint32
+	recvMask uint64 // bits for last AckWindow packets behind recvMax
+	ackOwed  time.Time // first reliable packet not yet acked by anything we sent
+
+	est        rttEstimator
+	maxRetries int
+}
+
+func NewEndpoint(maxPendingBytes int) *Endpoint {
+	if maxPendingBytes <= 0 {
+		maxPendingBytes = 65536
+	}
+	e := &Endpoint{
+		nextSeq:         1,
+		pending:         make(map[uint32]*Sent),
+		maxRetries:      8,
+		maxPendingBytes: maxPendingBytes,
+	}
+	// default RTO before first sample
+	e.est.rto = 200 * time.Millisecond
+	return e
+}
+
+func (e *Endpoint) currentRTO() time.Duration {
+	if e.est.rto <= 0 {
+		return 200 * time.Millisecond
+	}
+	return e.est.rto
+}
+
+// RTO is the timer a new message starts with.
+func (e *Endpoint) RTO() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.currentRTO()
+}
+
+// SRTT is the smoothed round trip; zero until the first sample.
+func (e *Endpoint) SRTT() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.est.srtt
+}
+
+func (e *Endpoint) PendingBytes() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pendingBytes
+}
+
+// Encode stamps p with our current ack window and encodes it. Use it for
+// unreliable packets; reliable ones go through SendReliable.
+func (e *Endpoint) Encode(p Packet) []byte {
+	e.mu.Lock()
+	p.Ack, p.AckBits = e.recvMax, e.recvMask
+	e.ackOwed = time.Time{}
+	e.mu.Unlock()
+	return EncodePacket(p, nil)
+}
+
+// SendReliable assigns sequence numbers to ps, encodes them and tracks them
+// until acked. It is all or nothing: if the lot does not fit in the backlog
+// nothing is queued and ErrBacklogFull is returned. The caller puts the
+// packets on the wire.
+func (e *Endpoint) SendReliable(ps ...Packet) ([]*Sent, error) {
+	size := 0
+	for _, p := range ps { size += HeaderLen + len(p.Payload) }
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pendingBytes+size > e.maxPendingBytes { return nil, ErrBacklogFull }
+	now := time.Now()
+	out := make([]*Sent, 0, len(ps))
+	for _, p := range ps {
+		p.Seq = e.allocSeq()
+		p.Ack, p.AckBits = e.recvMax, e.recvMask
+		e.ackOwed = time.Time{}
+		sm := &Sent{Seq: p.Seq, Pkt: EncodePacket(p, nil), sentAt: now, rto: e.currentRTO()}
+		e.pending[sm.Seq] = sm
+		e.pendingBytes += len(sm.Pkt)
+		out = append(out, sm)
+	}
+	return out, nil
+}
+
+func (e *Endpoint) allocSeq() uint32 {
+	s := e.nextSeq
+	e.nextSeq++
+	if e.nextSeq == 0 {
+		e.nextSeq = 1
+	}
+	return s
+}
+
+// OnRecv tracks which reliable seq we've seen.
+func (e *Endpoint) OnRecv(seq uint32) {
+	e.mu.Lock()
+	e.recvMax, e.recvMask = UpdateAckWindow(e.recvMax, e.recvMask, seq)
+	if e.ackOwed.IsZero() { e.ackOwed = time.Now() }
+	e.mu.Unlock()
+}
+
+// AckDue reports whether a received reliable packet has waited AckDelay
+// with nothing going out to piggy-back its ack on; the caller should send
+// an empty packet through Encode.
+func (e *Endpoint) AckDue(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !e.ackOwed.IsZero() && now.Sub(e.ackOwed) >= AckDelay
+}
+
+// OnAcks retires acked messages and returns the ones due for fast
+// retransmit, already counted as resent at now; the caller writes them.
+func (e *Endpoint) OnAcks(now time.Time, ack uint32, ackBits uint64) []*Sent {
+	var fast []*Sent
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for seq, sm := range e.pending {
+		if !AckedBy(ack, ackBits, seq) {
+			if !sm.fastRetx && !sm.held && FastRetxDue(ack, seq) {
+				sm.fastRetx = true
+				sm.retries++
+				sm.sentAt = now
+				fast = append(fast, sm)
+			}
+			continue
+		}
+		// RTT sample from first-send time of this msg
+		if !sm.sentAt.IsZero() && sm.retries == 0 {
+			e.est.update(now.Sub(sm.sentAt))
+		}
+		e.pendingBytes -= len(sm.Pkt)
+		if e.pendingBytes < 0 {
+			e.pendingBytes = 0
+		}
+		delete(e.pending, seq)
+	}
+	return fast
+}
+
+// Due returns the messages whose timers ran out, backing each one off, or
+// dead=true once one has gone unacked through every retry.
+func (e *Endpoint) Due(now time.Time) (resend []*Sent, dead bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, sm := range e.pending {
+		if sm.held || now.Sub(sm.sentAt) < sm.rto { continue }
+		if sm.retries >= e.maxRetries { return nil, true }
+		sm.retries++
+		sm.sentAt = now
+		sm.rto = BackoffRTO(sm.rto)
+		resend = append(resend, sm)
+	}
+	return resend, false
+}
+
+// Hold marks sm as queued by the sender (e.g. an outbound shaper): its timer
+// is paused until Release. It reports false if sm was already held.
+func (e *Endpoint) Hold(sm *Sent) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sm.held { return false }
+	sm.held = true
+	return true
+}
+
+// Release marks a held message as written at now; its timer starts there.
+func (e *Endpoint) Release(sm *Sent, now time.Time) {
+	e.mu.Lock()
+	sm.held = false
+	sm.sentAt = now
+	e.mu.Unlock()
+}
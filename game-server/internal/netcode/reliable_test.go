@@ -0,0 +1,120 @@
+package netcode
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateAckWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		recv     []uint32
+		max      uint32
+		mask     uint64
+	}{
+		{name: "nothing", max: 0, mask: 0},
+		{name: "seq 0 is not a reliable seq", recv: []uint32{0}, max: 0, mask: 0},
+		{name: "first", recv: []uint32{5}, max: 5, mask: 0},
+		{name: "in order", recv: []uint32{4, 5}, max: 5, mask: 1},
+		{name: "gap", recv: []uint32{3, 5}, max: 5, mask: 1 << 1},
+		{name: "late arrival fills the gap", recv: []uint32{3, 5, 4}, max: 5, mask: 1<<1 | 1},
+		{name: "duplicate", recv: []uint32{5, 5}, max: 5, mask: 0},
+		{name: "oldest bit", recv: []uint32{2, 66}, max: 66, mask: 1 << 63},
+		{name: "jump past the window", recv: []uint32{1, 66}, max: 66, mask: 0},
+		{name: "too old to record", recv: []uint32{70, 5}, max: 70, mask: 0},
+		{name: "full window", recv: seqs(1, 65), max: 65, mask: ^uint64(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var max uint32
+			var mask uint64
+			for _, s := range tt.recv { max, mask = UpdateAckWindow(max, mask, s) }
+			if max != tt.max || mask != tt.mask { t.Errorf("got (%d, %#x), want (%d, %#x)", max, mask, tt.max, tt.mask) }
+		})
+	}
+}
+
+func seqs(from, to uint32) []uint32 {
+	var out []uint32
+	for s := from; s <= to; s++ { out = append(out, s) }
+	return out
+}
+
+func TestAckedBy(t *testing.T) {
+	tests := []struct {
+		name    string
+		ack     uint32
+		ackBits uint64
+		seq     uint32
+		want    bool
+	}{
+		{name: "the ack itself", ack: 10, seq: 10, want: true},
+		{name: "seq 0 needs no ack", ack: 10, seq: 0, want: true},
+		{name: "newer than ack", ack: 10, ackBits: ^uint64(0), seq: 11, want: false},
+		{name: "bit 0", ack: 10, ackBits: 1, seq: 9, want: true},
+		{name: "bit clear", ack: 10, ackBits: 1, seq: 8, want: false},
+		{name: "bit 63", ack: 100, ackBits: 1 << 63, seq: 36, want: true},
+		{name: "outside the window", ack: 100, ackBits: ^uint64(0), seq: 35, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AckedBy(tt.ack, tt.ackBits, tt.seq); got != tt.want { t.Errorf("AckedBy(%d, %#x, %d) = %v", tt.ack, tt.ackBits, tt.seq, got) }
+		})
+	}
+}
+
+// Whatever UpdateAckWindow records, AckedBy must read back.
+func TestAckWindowRoundTrip(t *testing.T) {
+	recv := []uint32{3, 7, 8, 20, 19, 60, 71}
+	var max uint32
+	var mask uint64
+	for _, s := range recv { max, mask = UpdateAckWindow(max, mask, s) }
+	got := map[uint32]bool{}
+	for _, s := range recv { got[s] = true }
+	for s := uint32(1); s <= max; s++ {
+		want := got[s] && max-s <= AckWindow
+		if AckedBy(max, mask, s) != want { t.Errorf("seq %d: acked = %v, want %v", s, !want, want) }
+	}
+}
+
+func TestFastRetxDue(t *testing.T) {
+	tests := []struct {
+		largestAcked, seq uint32
+		want              bool
+	}{
+		{largestAcked: 10, seq: 10, want: false},
+		{largestAcked: 10, seq: 11, want: false},
+		{largestAcked: 10, seq: 8, want: false},
+		{largestAcked: 10, seq: 10 - FastRetxThreshold, want: true},
+		{largestAcked: 10, seq: 1, want: true},
+	}
+	for _, tt := range tests {
+		if got := FastRetxDue(tt.largestAcked, tt.seq); got != tt.want { t.Errorf("FastRetxDue(%d, %d) = %v", tt.largestAcked, tt.seq, got) }
+	}
+}
+
+func TestBackoffRTO(t *testing.T) {
+	tests := []struct{ in, want time.Duration }{
+		{200 * time.Millisecond, 400 * time.Millisecond},
+		{3 * time.Second, MaxRTO},
+		{MaxRTO, MaxRTO},
+	}
+	for _, tt := range tests {
+		if got := BackoffRTO(tt.in); got != tt.want { t.Errorf("BackoffRTO(%v) = %v, want %v", tt.in, got, tt.want) }
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := Packet{Proto: 4, Chan: ChanOrdered, PType: 9, Seq: 77, Ack: 76, AckBits: 1<<63 | 5, Payload: []byte("hello")}
+	b := EncodePacket(p, nil)
+	if len(b) != HeaderLen+len(p.Payload) { t.Fatalf("encoded %d bytes", len(b)) }
+	got, err := DecodePacket(b)
+	if err != nil { t.Fatal(err) }
+	if got.Proto != p.Proto || got.Chan != p.Chan || got.PType != p.PType || got.Seq != p.Seq ||
+		got.Ack != p.Ack || got.AckBits != p.AckBits || string(got.Payload) != string(p.Payload) {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+	if _, err := DecodePacket(b[:HeaderLen-1]); err == nil { t.Error("short packet decoded") }
+	b[0] ^= 0xFF
+	if _, err := DecodePacket(b); err == nil { t.Error("bad magic decoded") }
+}
@@ -0,0 +1,143 @@
+package netcode
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted UDP channel.
+//
+// Before anything else the client sends a plaintext PKeyEx carrying an
+// ephemeral X25519 public key; the gateway answers PKeyExOk with its own.
+// Both sides derive one ChaCha20-Poly1305 key per direction and from then on
+// every datagram is sealed:
+//
+//	[SealMagic:u16][proto:u16][ctr:u64] AEAD(packet, aad = those 12 bytes)
+//
+// ctr is a per-direction send counter used as the nonce, so retransmissions
+// of the same reliable packet are resealed under a fresh nonce. The receiver
+// keeps a sliding window over ctr and drops anything replayed or too old.
+// Spoofing a client address no longer gets a packet past Open.
+
+const SealMagic uint16 = 0xC0DE
+
+const SealHeaderLen = 2 + 2 + 8
+
+// SealOverhead is what sealing adds to a plaintext packet.
+const SealOverhead = SealHeaderLen + chacha20poly1305.Overhead
+
+// KeyExLen is the PKeyEx / PKeyExOk payload: an X25519 public key.
+const KeyExLen = 32
+
+const keyInfo = "game-server udp v1"
+
+// replayWindow is how many counters behind the newest one are still accepted.
+const replayWindow = 64
+
+func NewKeyPair() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// SecureChannel holds the keys of one client/gateway pair. Seal may be
+// called from several goroutines; Open from one reader only.
+type SecureChannel struct {
+	send, recv cipher.AEAD
+	sendCtr    atomic.Uint64
+
+	mu      sync.Mutex // guards the replay window
+	recvMax uint64
+	recvWin uint64 // bit i set = recvMax-1-i seen
+}
+
+// DeriveChannel runs X25519 against the peer's public key and expands the
+// shared secret into the two directional keys. client selects which key is
+// used for sending.
+func DeriveChannel(priv *ecdh.PrivateKey, peerPub []byte, client bool) (*SecureChannel, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil { return nil, err }
+	shared, err := priv.ECDH(pub)
+	if err != nil { return nil, err }
+
+	// salt binds both public keys so each side derives from the same transcript
+	clientPub, serverPub := priv.PublicKey().Bytes(), peerPub
+	if !client { clientPub, serverPub = peerPub, priv.PublicKey().Bytes() }
+	salt := append(append([]byte{}, clientPub...), serverPub...)
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(keyInfo)), keys); err != nil {
+		return nil, err
+	}
+	c2s, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil { return nil, err }
+	s2c, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil { return nil, err }
+
+	sc := &SecureChannel{send: s2c, recv: c2s}
+	if client { sc.send, sc.recv = c2s, s2c }
+	return sc, nil
+}
+
+func nonceFor(ctr uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(n[4:], ctr)
+	return n
+}
+
+// Seal wraps an encoded packet for the wire.
+func (c *SecureChannel) Seal(proto uint16, pkt []byte) []byte {
+	ctr := c.sendCtr.Add(1)
+	out := make([]byte, SealHeaderLen, SealHeaderLen+len(pkt)+chacha20poly1305.Overhead)
+	binary.LittleEndian.PutUint16(out[0:2], SealMagic)
+	binary.LittleEndian.PutUint16(out[2:4], proto)
+	binary.LittleEndian.PutUint64(out[4:12], ctr)
+	return c.send.Seal(out, nonceFor(ctr), pkt, out[:SealHeaderLen])
+}
+
+// Open authenticates and decrypts a sealed datagram, rejecting replays.
+func (c *SecureChannel) Open(b []byte) ([]byte, error) {
+	if len(b) < SealOverhead { return nil, errors.New("short sealed packet") }
+	if binary.LittleEndian.Uint16(b[0:2]) != SealMagic { return nil, errors.New("bad magic") }
+	ctr := binary.LittleEndian.Uint64(b[4:12])
+	if ctr == 0 { return nil, errors.New("bad counter") }
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seenLocked(ctr) { return nil, errors.New("replayed packet") }
+	pkt, err := c.recv.Open(nil, nonceFor(ctr), b[SealHeaderLen:], b[:SealHeaderLen])
+	if err != nil { return nil, err }
+	// only authentic packets move the window
+	c.markLocked(ctr)
+	return pkt, nil
+}
+
+func (c *SecureChannel) seenLocked(ctr uint64) bool {
+	if ctr > c.recvMax { return false }
+	if ctr == c.recvMax { return true }
+	d := c.recvMax - ctr
+	if d > replayWindow { return true } // too old to tell, treat as replay
+	return c.recvWin&(1<<(d-1)) != 0
+}
+
+func (c *SecureChannel) markLocked(ctr uint64) {
+	if ctr > c.recvMax {
+		shift := ctr - c.recvMax
+		if shift > replayWindow {
+			c.recvWin = 0
+		} else {
+			c.recvWin = c.recvWin<<shift | 1<<(shift-1)
+		}
+		c.recvMax = ctr
+		return
+	}
+	c.recvWin |= 1 << (c.recvMax - ctr - 1)
+}
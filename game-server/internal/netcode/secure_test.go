@@ -0,0 +1,76 @@
+package netcode
+
+import (
+	"testing"
+)
+
+func channelPair(t *testing.T) (client, server *SecureChannel) {
+	ck, err := NewKeyPair()
+	if err != nil { t.Fatal(err) }
+	sk, err := NewKeyPair()
+	if err != nil { t.Fatal(err) }
+	client, err = DeriveChannel(ck, sk.PublicKey().Bytes(), true)
+	if err != nil { t.Fatal(err) }
+	server, err = DeriveChannel(sk, ck.PublicKey().Bytes(), false)
+	if err != nil { t.Fatal(err) }
+	return client, server
+}
+
+func TestSecureChannelRoundTrip(t *testing.T) {
+	c, s := channelPair(t)
+	b := c.Seal(4, []byte("to server"))
+	if len(b) != SealOverhead+len("to server") { t.Errorf("sealed %d bytes", len(b)) }
+	got, err := s.Open(b)
+	if err != nil || string(got) != "to server" { t.Fatalf("Open = %q, %v", got, err) }
+	got, err = c.Open(s.Seal(4, []byte("to client")))
+	if err != nil || string(got) != "to client" { t.Fatalf("Open = %q, %v", got, err) }
+
+	// a packet only opens in the direction it was sealed for
+	if _, err := c.Open(c.Seal(4, []byte("x"))); err == nil { t.Error("client opened its own packet") }
+
+	tampered := c.Seal(4, []byte("payload"))
+	tampered[len(tampered)-1] ^= 1
+	if _, err := s.Open(tampered); err == nil { t.Error("tampered packet opened") }
+	header := c.Seal(4, []byte("payload"))
+	header[2] ^= 1 // proto is authenticated too
+	if _, err := s.Open(header); err == nil { t.Error("packet with a changed header opened") }
+}
+
+func TestSecureChannelReplayWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int  // counters to open, in this order
+		ok    []bool // whether each is accepted
+	}{
+		{name: "in order", order: []int{1, 2, 3}, ok: []bool{true, true, true}},
+		{name: "reordered", order: []int{3, 1, 2}, ok: []bool{true, true, true}},
+		{name: "replay of the newest", order: []int{1, 2, 2}, ok: []bool{true, true, false}},
+		{name: "replay inside the window", order: []int{5, 3, 3}, ok: []bool{true, true, false}},
+		{name: "oldest the window holds", order: []int{70, 6}, ok: []bool{true, true}},
+		{name: "older than the window", order: []int{70, 5}, ok: []bool{true, false}},
+		{name: "too old after a jump", order: []int{1, 100, 1}, ok: []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := channelPair(t)
+			sealed := make([][]byte, 101) // sealed[i] carries counter i
+			for i := 1; i < len(sealed); i++ { sealed[i] = c.Seal(4, []byte{byte(i)}) }
+			for i, ctr := range tt.order {
+				_, err := s.Open(sealed[ctr])
+				if (err == nil) != tt.ok[i] { t.Errorf("open #%d (counter %d): err = %v, want ok = %v", i, ctr, err, tt.ok[i]) }
+			}
+		})
+	}
+}
+
+// Only authentic packets move the window: a forged high counter must not
+// push genuine packets out of it.
+func TestSecureChannelForgeryKeepsWindow(t *testing.T) {
+	c, s := channelPair(t)
+	first := c.Seal(4, []byte("a"))
+	forged := c.Seal(4, []byte("b"))
+	forged[4] = 200 // counter 200, no longer matching the tag
+	if _, err := s.Open(forged); err == nil { t.Fatal("forged packet opened") }
+	if _, err := s.Open(first); err != nil { t.Fatalf("genuine packet refused after a forgery: %v", err) }
+	if _, err := s.Open([]byte{1, 2, 3}); err == nil { t.Error("short packet opened") }
+}
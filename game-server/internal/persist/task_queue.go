@@ -2,6 +2,7 @@ package persist
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -16,6 +17,8 @@ type SaveQueue struct {
 	order []shared.CharacterID
 	maxPending int
 	wake chan struct{}
+
+	flushMu sync.Mutex // one writer at a time, so an older state never lands last
 }
 
 func NewSaveQueue(store Store, maxPending int) *SaveQueue {
@@ -60,7 +63,30 @@ func (q *SaveQueue) Run(ctx context.Context) error {
 	}
 }
 
+// Flush writes everything pending now, for shutdown. It gives up when ctx
+// ends and reports how much was left behind. Holding flushMu throughout, it
+// also waits out a batch Run is still writing.
+func (q *SaveQueue) Flush(ctx context.Context) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	for {
+		q.mu.Lock()
+		left := len(q.order)
+		q.mu.Unlock()
+		if left == 0 { return nil }
+		if ctx.Err() != nil { return fmt.Errorf("save queue: %d characters not flushed: %w", left, ctx.Err()) }
+		q.flushLocked(ctx, 256)
+	}
+}
+
 func (q *SaveQueue) flushSome(ctx context.Context, n int) {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	q.flushLocked(ctx, n)
+}
+
+// flushLocked writes up to n pending states; the caller holds flushMu.
+func (q *SaveQueue) flushLocked(ctx context.Context, n int) {
 	if n <= 0 { return }
 	var batch []CharacterState
 	q.mu.Lock()
@@ -85,6 +111,8 @@ type SnapshotQueue struct {
 	order []uint32
 	maxPending int
 	wake chan struct{}
+
+	flushMu sync.Mutex // one writer at a time, so an older state never lands last
 }
 
 func NewSnapshotQueue(store SnapshotStore, maxPending int) *SnapshotQueue {
@@ -129,7 +157,28 @@ func (q *SnapshotQueue) Run(ctx context.Context) error {
 	}
 }
 
+// Flush writes every pending snapshot now, for shutdown (see SaveQueue.Flush).
+func (q *SnapshotQueue) Flush(ctx context.Context) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	for {
+		q.mu.Lock()
+		left := len(q.order)
+		q.mu.Unlock()
+		if left == 0 { return nil }
+		if ctx.Err() != nil { return fmt.Errorf("snapshot queue: %d snapshots not flushed: %w", left, ctx.Err()) }
+		q.flushLocked(ctx, 8)
+	}
+}
+
 func (q *SnapshotQueue) flushSome(ctx context.Context, n int) {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	q.flushLocked(ctx, n)
+}
+
+// flushLocked writes up to n pending snapshots; the caller holds flushMu.
+func (q *SnapshotQueue) flushLocked(ctx context.Context, n int) {
 	if n <= 0 { return }
 	var zones []uint32
 	q.mu.Lock()
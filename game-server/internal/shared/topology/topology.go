@@ -0,0 +1,236 @@
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+
+	"game-server/internal/shared"
+)
+
+// World map, shared by the gateway and the zones. Each zone owns an area
+// (rectangle or polygon) in the one world coordinate space. A player who
+// walks out of their zone's area into a listed neighbour's area is handed
+// over there at the same coordinates; one who steps on a portal region goes
+// to the portal's zone at its arrival point, wherever that is. Areas of
+// neighbours may overlap, which gives edge transfers some hysteresis.
+//
+// An "instanced" zone (a dungeon, an arena) is a template: nobody plays in
+// it directly, every group entering through a portal gets its own copy (see
+// zone.Host). Instanced zones are reached by portals only, never by edges.
+//
+// The file is JSON:
+//
+//	{"start": 1, "zones": [
+//	  {"id": 1, "area": {"rect": {"minX": -1000, "minY": -1000, "maxX": 100, "maxY": 1000}},
+//	   "neighbours": [2],
+//	   "portals": [{"to": 3, "region": {"poly": [{"x": 0, "y": 0}, ...]}, "arrive": {"x": 5, "y": 5}}]},
+//	  ...]}
+
+// MaxInstancedID is the highest id an instanced zone may have: its
+// instances carry it in 7 bits of their own id (see zone.Host).
+const MaxInstancedID = 0x7F
+
+type Point struct {
+	X int16 `json:"x"`
+	Y int16 `json:"y"`
+}
+
+// Rect is inclusive on all sides.
+type Rect struct {
+	MinX int16 `json:"minX"`
+	MinY int16 `json:"minY"`
+	MaxX int16 `json:"maxX"`
+	MaxY int16 `json:"maxY"`
+}
+
+// Shape is either a Rect or a simple polygon (at least 3 vertices, either
+// winding).
+type Shape struct {
+	Rect *Rect  `json:"rect,omitempty"`
+	Poly []Point `json:"poly,omitempty"`
+}
+
+type Portal struct {
+	To     shared.ZoneID `json:"to"`
+	Region Shape         `json:"region"`
+	Arrive Point         `json:"arrive"`
+}
+
+type Zone struct {
+	ID         shared.ZoneID   `json:"id"`
+	Instanced  bool            `json:"instanced"`
+	Area       Shape           `json:"area"`
+	Neighbours []shared.ZoneID `json:"neighbours"`
+	Portals    []Portal        `json:"portals"`
+}
+
+type Map struct {
+	Start shared.ZoneID `json:"start"` // where new characters go; 0 = lowest non-instanced id
+	Zones []Zone        `json:"zones"`
+
+	byID map[shared.ZoneID]*Zone
+}
+
+// Route is where a player at some position has to go.
+type Route struct {
+	To     shared.ZoneID
+	X, Y   int16 // position in the target zone
+	Portal bool
+}
+
+func Load(path string) (*Map, error) {
+	b, err := os.ReadFile(path)
+	if err != nil { return nil, err }
+	m, err := Parse(b)
+	if err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+	return m, nil
+}
+
+func Parse(b []byte) (*Map, error) {
+	var m Map
+	if err := json.Unmarshal(b, &m); err != nil { return nil, err }
+	if err := m.index(); err != nil { return nil, err }
+	return &m, nil
+}
+
+func (m *Map) index() error {
+	if len(m.Zones) == 0 { return fmt.Errorf("no zones") }
+	m.byID = make(map[shared.ZoneID]*Zone, len(m.Zones))
+	for i := range m.Zones {
+		z := &m.Zones[i]
+		if z.ID == 0 { return fmt.Errorf("zone with id 0") }
+		if z.ID >= 1<<31 { return fmt.Errorf("zone id %d: ids from 2^31 up are for instances", z.ID) }
+		if m.byID[z.ID] != nil { return fmt.Errorf("zone %d listed twice", z.ID) }
+		if z.Instanced && z.ID > MaxInstancedID { return fmt.Errorf("instanced zone %d: ids above %d cannot be told apart in instance ids", z.ID, MaxInstancedID) }
+		if err := z.Area.check(); err != nil { return fmt.Errorf("zone %d area: %w", z.ID, err) }
+		m.byID[z.ID] = z
+	}
+	for _, z := range m.Zones {
+		for _, n := range z.Neighbours {
+			if n == z.ID || m.byID[n] == nil { return fmt.Errorf("zone %d: bad neighbour %d", z.ID, n) }
+			if z.Instanced || m.byID[n].Instanced { return fmt.Errorf("zone %d: instanced zones have no neighbours", z.ID) }
+		}
+		for i, p := range z.Portals {
+			to := m.byID[p.To]
+			if to == nil { return fmt.Errorf("zone %d portal %d: unknown zone %d", z.ID, i, p.To) }
+			if err := p.Region.check(); err != nil { return fmt.Errorf("zone %d portal %d region: %w", z.ID, i, err) }
+			// arriving outside the target's area would hand the player straight on
+			if !to.Area.Contains(p.Arrive.X, p.Arrive.Y) {
+				return fmt.Errorf("zone %d portal %d: arrival %d,%d outside zone %d", z.ID, i, p.Arrive.X, p.Arrive.Y, p.To)
+			}
+			for _, back := range to.Portals {
+				if back.Region.Contains(p.Arrive.X, p.Arrive.Y) {
+					return fmt.Errorf("zone %d portal %d: arrival %d,%d is on a portal of zone %d", z.ID, i, p.Arrive.X, p.Arrive.Y, p.To)
+				}
+			}
+		}
+	}
+	if m.Start == 0 {
+		for id, z := range m.byID {
+			if !z.Instanced && (m.Start == 0 || id < m.Start) { m.Start = id }
+		}
+	}
+	if m.byID[m.Start] == nil { return fmt.Errorf("unknown start zone %d", m.Start) }
+	if m.byID[m.Start].Instanced { return fmt.Errorf("start zone %d is instanced", m.Start) }
+	return nil
+}
+
+func (m *Map) Zone(id shared.ZoneID) (*Zone, bool) {
+	z := m.byID[id]
+	return z, z != nil
+}
+
+// Route says whether a player of zone from standing at x,y belongs elsewhere.
+// Portals win over edges; of several neighbours the first listed whose area
+// holds the point is taken. Outside every area (the world's edge) the player
+// stays put.
+func (m *Map) Route(from shared.ZoneID, x, y int16) (Route, bool) {
+	z := m.byID[from]
+	if z == nil { return Route{}, false }
+	for _, p := range z.Portals {
+		if p.Region.Contains(x, y) { return Route{To: p.To, X: p.Arrive.X, Y: p.Arrive.Y, Portal: true}, true }
+	}
+	if z.Area.Contains(x, y) { return Route{}, false }
+	for _, n := range z.Neighbours {
+		if m.byID[n].Area.Contains(x, y) { return Route{To: n, X: x, Y: y}, true }
+	}
+	return Route{}, false
+}
+
+// Instanced reports whether id is an instanced zone (a template).
+func (m *Map) Instanced(id shared.ZoneID) bool {
+	z := m.byID[id]
+	return z != nil && z.Instanced
+}
+
+// Reachable reports whether zone from may hand players to zone to.
+func (m *Map) Reachable(from, to shared.ZoneID) bool {
+	z := m.byID[from]
+	if z == nil { return false }
+	for _, n := range z.Neighbours {
+		if n == to { return true }
+	}
+	for _, p := range z.Portals {
+		if p.To == to { return true }
+	}
+	return false
+}
+
+func (s Shape) check() error {
+	switch {
+	case s.Rect != nil && s.Poly != nil:
+		return fmt.Errorf("both rect and poly")
+	case s.Rect != nil:
+		if s.Rect.MinX > s.Rect.MaxX || s.Rect.MinY > s.Rect.MaxY { return fmt.Errorf("empty rect") }
+	case len(s.Poly) < 3:
+		return fmt.Errorf("need a rect or a poly of 3+ points")
+	}
+	return nil
+}
+
+func (s Shape) Contains(x, y int16) bool {
+	if r := s.Rect; r != nil {
+		return x >= r.MinX && x <= r.MaxX && y >= r.MinY && y <= r.MaxY
+	}
+	// even-odd ray cast towards +x; int64 so the products cannot overflow
+	in := false
+	px, py := int64(x), int64(y)
+	for i, j := 0, len(s.Poly)-1; i < len(s.Poly); j, i = i, i+1 {
+		ax, ay := int64(s.Poly[i].X), int64(s.Poly[i].Y)
+		bx, by := int64(s.Poly[j].X), int64(s.Poly[j].Y)
+		if (ay > py) == (by > py) { continue }
+		// crossing x of the edge at py, compared without dividing
+		lhs := (px - ax) * (by - ay)
+		rhs := (bx - ax) * (py - ay)
+		if (by - ay) < 0 { lhs, rhs = -lhs, -rhs }
+		if lhs < rhs { in = !in }
+	}
+	return in
+}
+
+// Near reports whether x,y is inside the shape or within r of its edge.
+func (s Shape) Near(x, y, r int16) bool {
+	if s.Contains(x, y) { return true }
+	px, py, rr := float64(x), float64(y), float64(r)*float64(r)
+	if rc := s.Rect; rc != nil {
+		dx := math.Max(0, math.Max(float64(rc.MinX)-px, px-float64(rc.MaxX)))
+		dy := math.Max(0, math.Max(float64(rc.MinY)-py, py-float64(rc.MaxY)))
+		return dx*dx+dy*dy <= rr
+	}
+	for i, j := 0, len(s.Poly)-1; i < len(s.Poly); j, i = i, i+1 {
+		if segDist2(px, py, s.Poly[j], s.Poly[i]) <= rr { return true }
+	}
+	return false
+}
+
+// segDist2 is the squared distance from p to the segment a-b.
+func segDist2(px, py float64, a, b Point) float64 {
+	ax, ay, bx, by := float64(a.X), float64(a.Y), float64(b.X), float64(b.Y)
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 { t = math.Max(0, math.Min(1, ((px-ax)*dx+(py-ay)*dy)/l)) }
+	cx, cy := ax+t*dx-px, ay+t*dy-py
+	return cx*cx + cy*cy
+}
@@ -0,0 +1,170 @@
+package topology
+
+import (
+	"strings"
+	"testing"
+
+	"game-server/internal/shared"
+)
+
+func rect(minX, minY, maxX, maxY int16) Shape {
+	return Shape{Rect: &Rect{MinX: minX, MinY: minY, MaxX: maxX, MaxY: maxY}}
+}
+
+func poly(xy ...int16) Shape {
+	var s Shape
+	for i := 0; i+1 < len(xy); i += 2 { s.Poly = append(s.Poly, Point{X: xy[i], Y: xy[i+1]}) }
+	return s
+}
+
+func TestShapeContains(t *testing.T) {
+	tri := poly(0, 0, 10, 0, 0, 10)
+	triCW := poly(0, 0, 0, 10, 10, 0)
+	// an L: the square 0..10 without its top-right quarter
+	ell := poly(0, 0, 10, 0, 10, 5, 5, 5, 5, 10, 0, 10)
+	big := poly(-32768, -32768, 32767, -32768, 32767, 32767, -32768, 32767)
+	tests := []struct {
+		name  string
+		shape Shape
+		x, y  int16
+		want  bool
+	}{
+		{name: "rect inside", shape: rect(-5, -5, 5, 5), x: 0, y: 0, want: true},
+		{name: "rect corner is inclusive", shape: rect(-5, -5, 5, 5), x: 5, y: -5, want: true},
+		{name: "rect just outside", shape: rect(-5, -5, 5, 5), x: 6, y: 0, want: false},
+		{name: "single point rect", shape: rect(3, 3, 3, 3), x: 3, y: 3, want: true},
+		{name: "triangle inside", shape: tri, x: 2, y: 2, want: true},
+		{name: "triangle beyond the hypotenuse", shape: tri, x: 6, y: 6, want: false},
+		{name: "triangle outside the box", shape: tri, x: -1, y: 2, want: false},
+		{name: "clockwise triangle inside", shape: triCW, x: 2, y: 2, want: true},
+		{name: "clockwise triangle outside", shape: triCW, x: 6, y: 6, want: false},
+		{name: "L arm", shape: ell, x: 2, y: 8, want: true},
+		{name: "L notch", shape: ell, x: 8, y: 8, want: false},
+		{name: "L foot", shape: ell, x: 8, y: 2, want: true},
+		{name: "whole int16 plane", shape: big, x: 32000, y: -32000, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.shape.Contains(tt.x, tt.y); got != tt.want { t.Errorf("Contains(%d, %d) = %v", tt.x, tt.y, got) }
+		})
+	}
+}
+
+func TestShapeNear(t *testing.T) {
+	tri := poly(0, 0, 10, 0, 0, 10)
+	tests := []struct {
+		name    string
+		shape   Shape
+		x, y, r int16
+		want    bool
+	}{
+		{name: "inside, no radius", shape: rect(0, 0, 10, 10), x: 5, y: 5, r: 0, want: true},
+		{name: "rect side within r", shape: rect(0, 0, 10, 10), x: 13, y: 5, r: 3, want: true},
+		{name: "rect side beyond r", shape: rect(0, 0, 10, 10), x: 14, y: 5, r: 3, want: false},
+		{name: "rect corner by euclid", shape: rect(0, 0, 10, 10), x: 13, y: 14, r: 5, want: true},
+		{name: "rect corner beyond euclid", shape: rect(0, 0, 10, 10), x: 14, y: 14, r: 5, want: false},
+		{name: "poly edge within r", shape: tri, x: 5, y: -2, r: 2, want: true},
+		{name: "poly edge beyond r", shape: tri, x: 5, y: -3, r: 2, want: false},
+		{name: "poly vertex", shape: tri, x: 13, y: -4, r: 5, want: true},
+		{name: "poly hypotenuse", shape: tri, x: 7, y: 7, r: 3, want: true},
+		{name: "poly hypotenuse beyond r", shape: tri, x: 7, y: 7, r: 2, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.shape.Near(tt.x, tt.y, tt.r); got != tt.want { t.Errorf("Near(%d, %d, %d) = %v", tt.x, tt.y, tt.r, got) }
+		})
+	}
+}
+
+// testWorld: zones 1 and 2 overlap on -100..100, zone 1 has a portal to 2
+// and one to the instanced zone 3, which leads back to 1.
+const testWorld = `{"zones": [
+  {"id": 1, "area": {"rect": {"minX": -1000, "minY": -1000, "maxX": 100, "maxY": 1000}},
+   "neighbours": [2],
+   "portals": [
+     {"to": 2, "region": {"poly": [{"x": -80, "y": -80}, {"x": -70, "y": -80}, {"x": -75, "y": -70}]}, "arrive": {"x": 200, "y": 0}},
+     {"to": 3, "region": {"rect": {"minX": -40, "minY": -40, "maxX": -30, "maxY": -30}}, "arrive": {"x": 0, "y": 0}}]},
+  {"id": 2, "area": {"rect": {"minX": -100, "minY": -1000, "maxX": 1000, "maxY": 1000}}, "neighbours": [1]},
+  {"id": 3, "instanced": true, "area": {"rect": {"minX": -50, "minY": -50, "maxX": 50, "maxY": 50}},
+   "portals": [{"to": 1, "region": {"rect": {"minX": 40, "minY": 40, "maxX": 50, "maxY": 50}}, "arrive": {"x": -20, "y": -20}}]}
+]}`
+
+func TestRoute(t *testing.T) {
+	m, err := Parse([]byte(testWorld))
+	if err != nil { t.Fatal(err) }
+	tests := []struct {
+		name  string
+		from  shared.ZoneID
+		x, y  int16
+		want  Route
+		moved bool
+	}{
+		{name: "inside own area", from: 1, x: 0, y: 0},
+		{name: "overlap keeps zone 1", from: 1, x: 50, y: 0},
+		{name: "overlap keeps zone 2", from: 2, x: 50, y: 0},
+		{name: "edge to the neighbour", from: 1, x: 101, y: 5, want: Route{To: 2, X: 101, Y: 5}, moved: true},
+		{name: "edge back", from: 2, x: -101, y: 5, want: Route{To: 1, X: -101, Y: 5}, moved: true},
+		{name: "world edge", from: 2, x: 1001, y: 0},
+		{name: "portal wins over own area", from: 1, x: -75, y: -77, want: Route{To: 2, X: 200, Y: 0, Portal: true}, moved: true},
+		{name: "portal into an instance", from: 1, x: -35, y: -35, want: Route{To: 3, X: 0, Y: 0, Portal: true}, moved: true},
+		{name: "instance has no edges", from: 3, x: 60, y: 0},
+		{name: "portal out of an instance", from: 3, x: 45, y: 45, want: Route{To: 1, X: -20, Y: -20, Portal: true}, moved: true},
+		{name: "unknown zone", from: 9, x: 0, y: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, moved := m.Route(tt.from, tt.x, tt.y)
+			if moved != tt.moved || got != tt.want { t.Errorf("Route = %+v, %v; want %+v, %v", got, moved, tt.want, tt.moved) }
+		})
+	}
+
+	if m.Start != 1 { t.Errorf("Start = %d, want the lowest non-instanced zone", m.Start) }
+	if !m.Instanced(3) || m.Instanced(1) || m.Instanced(9) { t.Error("Instanced is wrong") }
+	for _, c := range []struct {
+		from, to shared.ZoneID
+		want     bool
+	}{{1, 2, true}, {1, 3, true}, {3, 1, true}, {2, 1, true}, {2, 3, false}, {3, 2, false}, {9, 1, false}} {
+		if got := m.Reachable(c.from, c.to); got != c.want { t.Errorf("Reachable(%d, %d) = %v", c.from, c.to, got) }
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	area := `"area": {"rect": {"minX": 0, "minY": 0, "maxX": 10, "maxY": 10}}`
+	tests := []struct {
+		name string
+		json string
+		want string // in the error
+	}{
+		{name: "no zones", json: `{"zones": []}`, want: "no zones"},
+		{name: "zone 0", json: `{"zones": [{"id": 0, ` + area + `}]}`, want: "id 0"},
+		{name: "instance id range", json: `{"zones": [{"id": 2147483648, ` + area + `}]}`, want: "instances"},
+		{name: "instanced id too high", json: `{"zones": [{"id": 1, ` + area + `}, {"id": 129, "instanced": true, ` + area + `}]}`, want: "instanced zone 129"},
+		{name: "duplicate id", json: `{"zones": [{"id": 1, ` + area + `}, {"id": 1, ` + area + `}]}`, want: "twice"},
+		{name: "empty rect", json: `{"zones": [{"id": 1, "area": {"rect": {"minX": 5, "minY": 0, "maxX": 4, "maxY": 10}}}]}`, want: "empty rect"},
+		{name: "rect and poly", json: `{"zones": [{"id": 1, "area": {"rect": {"minX": 0, "minY": 0, "maxX": 1, "maxY": 1}, "poly": [{"x": 0, "y": 0}, {"x": 1, "y": 0}, {"x": 0, "y": 1}]}}]}`, want: "both"},
+		{name: "two-point poly", json: `{"zones": [{"id": 1, "area": {"poly": [{"x": 0, "y": 0}, {"x": 1, "y": 1}]}}]}`, want: "3+"},
+		{name: "no area", json: `{"zones": [{"id": 1}]}`, want: "area"},
+		{name: "unknown neighbour", json: `{"zones": [{"id": 1, ` + area + `, "neighbours": [2]}]}`, want: "bad neighbour"},
+		{name: "own neighbour", json: `{"zones": [{"id": 1, ` + area + `, "neighbours": [1]}]}`, want: "bad neighbour"},
+		{name: "instanced neighbour", json: `{"zones": [{"id": 1, ` + area + `, "neighbours": [2]}, {"id": 2, "instanced": true, ` + area + `}]}`, want: "instanced zones have no neighbours"},
+		{name: "portal to nowhere", json: `{"zones": [{"id": 1, ` + area + `, "portals": [{"to": 2, "region": {"rect": {"minX": 0, "minY": 0, "maxX": 1, "maxY": 1}}}]}]}`, want: "unknown zone 2"},
+		{name: "arrival outside target", json: `{"zones": [{"id": 1, ` + area + `, "portals": [{"to": 2, "region": {"rect": {"minX": 0, "minY": 0, "maxX": 1, "maxY": 1}}, "arrive": {"x": 50, "y": 50}}]}, {"id": 2, ` + area + `}]}`, want: "outside zone 2"},
+		{name: "arrival on a portal back", json: `{"zones": [{"id": 1, ` + area + `, "portals": [{"to": 2, "region": {"rect": {"minX": 0, "minY": 0, "maxX": 1, "maxY": 1}}, "arrive": {"x": 5, "y": 5}}]}, {"id": 2, ` + area + `, "portals": [{"to": 1, "region": {"rect": {"minX": 4, "minY": 4, "maxX": 6, "maxY": 6}}, "arrive": {"x": 9, "y": 9}}]}]}`, want: "is on a portal"},
+		{name: "unknown start", json: `{"start": 7, "zones": [{"id": 1, ` + area + `}]}`, want: "unknown start"},
+		{name: "instanced start", json: `{"start": 1, "zones": [{"id": 1, "instanced": true, ` + area + `}]}`, want: "start zone 1 is instanced"},
+		{name: "only instanced zones", json: `{"zones": [{"id": 1, "instanced": true, ` + area + `}]}`, want: "unknown start"},
+		{name: "not json", json: `{"zones": [`, want: "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.json))
+			if err == nil || !strings.Contains(err.Error(), tt.want) { t.Errorf("err = %v, want %q", err, tt.want) }
+		})
+	}
+}
+
+func TestLoadShippedWorld(t *testing.T) {
+	m, err := Load("../../../configs/world.json")
+	if err != nil { t.Fatal(err) }
+	if _, ok := m.Zone(m.Start); !ok { t.Errorf("start zone %d missing", m.Start) }
+}
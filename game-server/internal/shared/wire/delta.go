@@ -0,0 +1,190 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"game-server/internal/shared"
+)
+
+// Packed move encoding (delta mode).
+//
+// Only the move-channel ops are packable. Op codes are bit-packed two per
+// event, four events per byte, ahead of the event bodies:
+//
+//	[ops: ceil(n/4) bytes] bodies...
+//
+// bodies by op:
+// - RepMoveDelta: [eid:uvarint][dx:varint][dy:varint]   (zigzag)
+// - RepMove:      [eid:uvarint][x:i16][y:i16]
+// - RepSpawn:     [eid:uvarint][kind:u8][mask:uvarint][x:i16][y:i16]
+// - RepDespawn:   [eid:uvarint]
+//
+// Positions are whole world units, so deltas are already quantized; a
+// stationary-ish entity costs 3-4 bytes instead of 9.
+const (
+	packedMoveDelta = 0
+	packedMoveAbs   = 1
+	packedSpawn     = 2
+	packedDespawn   = 3
+)
+
+// Packable reports whether op has a packed encoding.
+func Packable(op RepOp) bool {
+	switch op {
+	case RepMoveDelta, RepMove, RepSpawn, RepDespawn:
+		return true
+	}
+	return false
+}
+
+func packedCode(op RepOp) byte {
+	switch op {
+	case RepMove:
+		return packedMoveAbs
+	case RepSpawn:
+		return packedSpawn
+	case RepDespawn:
+		return packedDespawn
+	}
+	return packedMoveDelta
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func varintLen(v int64) int {
+	ux := uint64(v) << 1
+	if v < 0 { ux = ^ux }
+	return uvarintLen(ux)
+}
+
+// PackedRepEventSize is the body size of e in the packed encoding, excluding
+// its share of the op code bytes.
+func PackedRepEventSize(e RepEvent) int {
+	n := uvarintLen(uint64(e.EID))
+	switch e.Op {
+	case RepMoveDelta:
+		n += varintLen(int64(e.X)) + varintLen(int64(e.Y))
+	case RepMove:
+		n += 4
+	case RepSpawn:
+		n += 1 + uvarintLen(uint64(e.Mask)) + 4
+	case RepDespawn:
+	default:
+		return 0
+	}
+	return n
+}
+
+// PackedRepEventsSize is the full packed size of events (op codes + bodies).
+func PackedRepEventsSize(events []RepEvent) int {
+	sz := (len(events) + 3) / 4
+	for _, e := range events { sz += PackedRepEventSize(e) }
+	return sz
+}
+
+// AppendPackedRepEvents appends the packed encoding of events to b. All
+// events must be Packable.
+func AppendPackedRepEvents(b []byte, events []RepEvent) []byte {
+	opOff := len(b)
+	for i := 0; i < (len(events)+3)/4; i++ { b = append(b, 0) }
+	var tmp [4]byte
+	for i, e := range events {
+		b[opOff+i/4] |= packedCode(e.Op) << (2 * uint(i%4))
+		b = binary.AppendUvarint(b, uint64(e.EID))
+		switch e.Op {
+		case RepMoveDelta:
+			b = binary.AppendVarint(b, int64(e.X))
+			b = binary.AppendVarint(b, int64(e.Y))
+		case RepMove:
+			binary.LittleEndian.PutUint16(tmp[0:2], uint16(e.X))
+			binary.LittleEndian.PutUint16(tmp[2:4], uint16(e.Y))
+			b = append(b, tmp[:4]...)
+		case RepSpawn:
+			b = append(b, byte(e.Kind))
+			b = binary.AppendUvarint(b, uint64(e.Mask))
+			binary.LittleEndian.PutUint16(tmp[0:2], uint16(e.X))
+			binary.LittleEndian.PutUint16(tmp[2:4], uint16(e.Y))
+			b = append(b, tmp[:4]...)
+		}
+	}
+	return b
+}
+
+// DecodePackedRepEvents decodes n packed events from the front of b and
+// returns how many bytes were consumed.
+func DecodePackedRepEvents(b []byte, n int) (events []RepEvent, off int, err error) {
+	errLen := errors.New("bad packed replicate payload length")
+	ops := (n + 3) / 4
+	if ops > len(b) { return nil, 0, errLen }
+	off = ops
+	events = make([]RepEvent, 0, n)
+	for i := 0; i < n; i++ {
+		code := (b[i/4] >> (2 * uint(i%4))) & 0x3
+		eidU, k := binary.Uvarint(b[off:])
+		if k <= 0 || eidU > 0xFFFFFFFF { return nil, 0, errLen }
+		off += k
+		e := RepEvent{EID: shared.EntityID(eidU)}
+		switch code {
+		case packedMoveDelta:
+			dx, k := binary.Varint(b[off:])
+			if k <= 0 { return nil, 0, errLen }
+			off += k
+			dy, k := binary.Varint(b[off:])
+			if k <= 0 { return nil, 0, errLen }
+			off += k
+			e.Op, e.X, e.Y = RepMoveDelta, int16(dx), int16(dy)
+		case packedMoveAbs:
+			if off+4 > len(b) { return nil, 0, errLen }
+			e.Op = RepMove
+			e.X = int16(binary.LittleEndian.Uint16(b[off:off+2]))
+			e.Y = int16(binary.LittleEndian.Uint16(b[off+2:off+4])); off += 4
+		case packedSpawn:
+			if off+1 > len(b) { return nil, 0, errLen }
+			e.Op = RepSpawn
+			e.Kind = EntityKind(b[off]); off++
+			mask, k := binary.Uvarint(b[off:])
+			if k <= 0 { return nil, 0, errLen }
+			off += k
+			e.Mask = InterestMask(mask)
+			if off+4 > len(b) { return nil, 0, errLen }
+			e.X = int16(binary.LittleEndian.Uint16(b[off:off+2]))
+			e.Y = int16(binary.LittleEndian.Uint16(b[off+2:off+4])); off += 4
+		case packedDespawn:
+			e.Op = RepDespawn
+		}
+		events = append(events, e)
+	}
+	return events, off, nil
+}
+
+// ReplicateDelta: [sid:16][serverTick:u32][baseTick:u32][chan:u8][n:u16] packed events...
+//
+// Same header as Replicate; RepMoveDelta events are relative to the
+// receiver's view at baseTick. Non-packable events are dropped.
+func EncodeReplicateDelta(sid shared.SessionID, serverTick, baseTick uint32, ch RepChannel, events []RepEvent) []byte {
+	packed := make([]RepEvent, 0, len(events))
+	for _, e := range events {
+		if Packable(e.Op) { packed = append(packed, e) }
+	}
+	if len(packed) > 65535 { packed = packed[:65535] }
+	b := make([]byte, ReplicateHeaderLen, ReplicateHeaderLen+PackedRepEventsSize(packed))
+	putReplicateHeader(b, sid, serverTick, baseTick, ch, len(packed))
+	return AppendPackedRepEvents(b, packed)
+}
+
+func DecodeReplicateDelta(b []byte) (sid shared.SessionID, serverTick, baseTick uint32, ch RepChannel, events []RepEvent, err error) {
+	if len(b) < ReplicateHeaderLen { return sid, 0, 0, 0, nil, errors.New("bad replicate-delta payload") }
+	sid, serverTick, baseTick, ch, n := replicateHeader(b)
+	events, off, err := DecodePackedRepEvents(b[ReplicateHeaderLen:], n)
+	if err != nil { return sid, 0, 0, 0, nil, err }
+	if ReplicateHeaderLen+off != len(b) { return sid, 0, 0, 0, nil, errors.New("extra bytes in replicate-delta payload") }
+	return
+}
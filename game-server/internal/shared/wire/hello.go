@@ -0,0 +1,57 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"game-server/internal/shared"
+)
+
+// Hello / HelloAck: [wireVersion:u16][zid:u32][tickHz:u16][caps:u32][serverTick:u32]
+//
+// The gateway sends MsgHello right after dialing (tickHz and serverTick 0);
+// the zone answers MsgHelloAck with its own values, or MsgError(ErrHandshake)
+// and closes. serverTick is the zone's tick as the ack is written, the first
+// point of the gateway's tick clock (see MsgTickSync).
+type Hello struct {
+	Version    uint16
+	ZoneID     shared.ZoneID
+	TickHz     uint16
+	Caps       Caps
+	ServerTick uint32
+}
+
+func EncodeHello(h Hello) []byte {
+	b := make([]byte, 2+4+2+4+4)
+	binary.LittleEndian.PutUint16(b[0:2], h.Version)
+	binary.LittleEndian.PutUint32(b[2:6], uint32(h.ZoneID))
+	binary.LittleEndian.PutUint16(b[6:8], h.TickHz)
+	binary.LittleEndian.PutUint32(b[8:12], uint32(h.Caps))
+	binary.LittleEndian.PutUint32(b[12:16], h.ServerTick)
+	return b
+}
+
+func DecodeHello(b []byte) (Hello, error) {
+	// accept a longer payload so a newer peer can still be told why it was rejected
+	if len(b) < 12 { return Hello{}, errors.New("bad hello payload") }
+	h := Hello{
+		Version: binary.LittleEndian.Uint16(b[0:2]),
+		ZoneID: shared.ZoneID(binary.LittleEndian.Uint32(b[2:6])),
+		TickHz: binary.LittleEndian.Uint16(b[6:8]),
+		Caps: Caps(binary.LittleEndian.Uint32(b[8:12])),
+	}
+	if len(b) >= 16 { h.ServerTick = binary.LittleEndian.Uint32(b[12:16]) }
+	return h, nil
+}
+
+// CheckHello validates the peer's hello against ours.
+func CheckHello(peer Hello, zid shared.ZoneID) error {
+	if peer.Version != WireVersion {
+		return fmt.Errorf("wire version mismatch: peer=%d local=%d", peer.Version, WireVersion)
+	}
+	if peer.ZoneID != zid {
+		return fmt.Errorf("zone id mismatch: peer=%d local=%d", peer.ZoneID, zid)
+	}
+	return nil
+}
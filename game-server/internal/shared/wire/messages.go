@@ -29,9 +29,10 @@ func DecodeAttachPlayer(b []byte) (sid shared.SessionID, cid shared.CharacterID,
 	return
 }
 
-// AttachWithState: [sid:16][cid:u64][zid:u32][interest:u32][x:i16][y:i16][hp:u16]
-func EncodeAttachWithState(sid shared.SessionID, cid shared.CharacterID, zid shared.ZoneID, interest InterestMask, x, y int16, hp uint16) []byte {
-	b := make([]byte, 32+2+2+2)
+// AttachWithState: [sid:16][cid:u64][zid:u32][interest:u32][x:i16][y:i16][hp:u16][xfer:u64]
+// xfer is the transfer it completes, echoed in the ack or nack.
+func EncodeAttachWithState(sid shared.SessionID, cid shared.CharacterID, zid shared.ZoneID, interest InterestMask, x, y int16, hp uint16, xfer uint64) []byte {
+	b := make([]byte, 32+2+2+2+8)
 	copy(b[0:16], sid[:])
 	binary.LittleEndian.PutUint64(b[16:24], uint64(cid))
 	binary.LittleEndian.PutUint32(b[24:28], uint32(zid))
@@ -39,12 +40,13 @@ func EncodeAttachWithState(sid shared.SessionID, cid shared.CharacterID, zid sha
 	binary.LittleEndian.PutUint16(b[32:34], uint16(x))
 	binary.LittleEndian.PutUint16(b[34:36], uint16(y))
 	binary.LittleEndian.PutUint16(b[36:38], hp)
+	binary.LittleEndian.PutUint64(b[38:46], xfer)
 	return b
 }
 
-func DecodeAttachWithState(b []byte) (sid shared.SessionID, cid shared.CharacterID, zid shared.ZoneID, interest InterestMask, x, y int16, hp uint16, err error) {
-	if len(b) != 38 {
-		return sid, 0, 0, 0, 0, 0, 0, errors.New("bad attach-with-state payload")
+func DecodeAttachWithState(b []byte) (sid shared.SessionID, cid shared.CharacterID, zid shared.ZoneID, interest InterestMask, x, y int16, hp uint16, xfer uint64, err error) {
+	if len(b) != 46 {
+		return sid, 0, 0, 0, 0, 0, 0, 0, errors.New("bad attach-with-state payload")
 	}
 	copy(sid[:], b[0:16])
 	cid = shared.CharacterID(binary.LittleEndian.Uint64(b[16:24]))
@@ -53,9 +55,42 @@ func DecodeAttachWithState(b []byte) (sid shared.SessionID, cid shared.Character
 	x = int16(binary.LittleEndian.Uint16(b[32:34]))
 	y = int16(binary.LittleEndian.Uint16(b[34:36]))
 	hp = binary.LittleEndian.Uint16(b[36:38])
+	xfer = binary.LittleEndian.Uint64(b[38:46])
 	return
 }
 
+// AttachAck: [sid:16][xfer:u64]
+// xfer is 0 for a plain attach.
+func EncodeAttachAck(sid shared.SessionID, xfer uint64) []byte {
+	b := make([]byte, 24)
+	copy(b[0:16], sid[:])
+	binary.LittleEndian.PutUint64(b[16:24], xfer)
+	return b
+}
+func DecodeAttachAck(b []byte) (sid shared.SessionID, xfer uint64, err error) {
+	if len(b) != 24 { return sid, 0, errors.New("bad attach-ack payload") }
+	copy(sid[:], b[0:16])
+	return sid, binary.LittleEndian.Uint64(b[16:24]), nil
+}
+
+// AttachNack: [sid:16][xfer:u64][code:u16][reason utf8]
+// The zone refused the attach; for a transfer the gateway aborts it at the
+// source.
+func EncodeAttachNack(sid shared.SessionID, xfer uint64, code ErrCode, reason string) []byte {
+	b := make([]byte, 26, 26+len(reason))
+	copy(b[0:16], sid[:])
+	binary.LittleEndian.PutUint64(b[16:24], xfer)
+	binary.LittleEndian.PutUint16(b[24:26], uint16(code))
+	return append(b, reason...)
+}
+func DecodeAttachNack(b []byte) (sid shared.SessionID, xfer uint64, code ErrCode, reason string, err error) {
+	if len(b) < 26 { return sid, 0, 0, "", errors.New("bad attach-nack payload") }
+	copy(sid[:], b[0:16])
+	xfer = binary.LittleEndian.Uint64(b[16:24])
+	code = ErrCode(binary.LittleEndian.Uint16(b[24:26]))
+	return sid, xfer, code, string(b[26:]), nil
+}
+
 // Detach: [sid:16]
 func EncodeDetachPlayer(sid shared.SessionID) []byte {
 	b := make([]byte, 16)
@@ -131,7 +166,10 @@ type RepEvent struct {
 	Mask InterestMask
 }
 
-// Replicate: [sid:16][serverTick:u32][chan:u8][n:u16] events...
+// Replicate: [sid:16][serverTick:u32][baseTick:u32][chan:u8][n:u16] events...
+//
+// baseTick is the acked tick the events were diffed against (0 = none, the
+// events describe the full view from scratch).
 //
 // event encodings by op:
 // - RepSpawn: [op:u8][eid:u32][kind:u8][mask:u32][x:i16][y:i16]
@@ -139,79 +177,110 @@ type RepEvent struct {
 // - RepDespawn: [op:u8][eid:u32]
 // - RepStateHP: [op:u8][eid:u32][hp:u16]
 // - RepEventText: [op:u8][len:u16][bytes...]
-func EncodeReplicate(sid shared.SessionID, serverTick uint32, ch RepChannel, events []RepEvent) []byte {
+const ReplicateHeaderLen = 16 + 4 + 4 + 1 + 2
+
+func EncodeReplicate(sid shared.SessionID, serverTick, baseTick uint32, ch RepChannel, events []RepEvent) []byte {
 	if len(events) > 65535 { events = events[:65535] }
-	sz := 16 + 4 + 1 + 2
-	for _, e := range events {
-		switch e.Op {
-		case RepSpawn:
-			sz += 1 + 4 + 1 + 4 + 4
-		case RepMove:
-			sz += 1 + 4 + 4
-		case RepDespawn:
-			sz += 1 + 4
-		case RepStateHP:
-			sz += 1 + 4 + 2
-		case RepEventText:
-			txt := e.Text
-			if len(txt) > 65535 { txt = txt[:65535] }
-			sz += 1 + 2 + len(txt)
-		}
-	}
-	b := make([]byte, sz)
+	sz := ReplicateHeaderLen
+	for _, e := range events { sz += RepEventSize(e) }
+	b := make([]byte, ReplicateHeaderLen, sz)
+	putReplicateHeader(b, sid, serverTick, baseTick, ch, len(events))
+	for _, e := range events { b = AppendRepEvent(b, e) }
+	return b
+}
+
+func DecodeReplicate(b []byte) (sid shared.SessionID, serverTick, baseTick uint32, ch RepChannel, events []RepEvent, err error) {
+	if len(b) < ReplicateHeaderLen { return sid, 0, 0, 0, nil, errors.New("bad replicate payload") }
+	sid, serverTick, baseTick, ch, n := replicateHeader(b)
+	events, off, err := DecodeRepEvents(b[ReplicateHeaderLen:], n)
+	if err != nil { return sid, 0, 0, 0, nil, err }
+	if ReplicateHeaderLen+off != len(b) { return sid, 0, 0, 0, nil, errors.New("extra bytes in replicate payload") }
+	return
+}
+
+func putReplicateHeader(b []byte, sid shared.SessionID, serverTick, baseTick uint32, ch RepChannel, n int) {
 	copy(b[0:16], sid[:])
 	binary.LittleEndian.PutUint32(b[16:20], serverTick)
-	b[20] = byte(ch)
-	binary.LittleEndian.PutUint16(b[21:23], uint16(len(events)))
-	off := 23
-	for _, e := range events {
-		switch e.Op {
-		case RepSpawn:
-			b[off] = byte(e.Op); off++
-			binary.LittleEndian.PutUint32(b[off:off+4], uint32(e.EID)); off += 4
-			b[off] = byte(e.Kind); off++
-			binary.LittleEndian.PutUint32(b[off:off+4], uint32(e.Mask)); off += 4
-			binary.LittleEndian.PutUint16(b[off:off+2], uint16(e.X))
-			binary.LittleEndian.PutUint16(b[off+2:off+4], uint16(e.Y))
-			off += 4
-		case RepMove:
-			b[off] = byte(e.Op); off++
-			binary.LittleEndian.PutUint32(b[off:off+4], uint32(e.EID)); off += 4
-			binary.LittleEndian.PutUint16(b[off:off+2], uint16(e.X))
-			binary.LittleEndian.PutUint16(b[off+2:off+4], uint16(e.Y))
-			off += 4
-		case RepDespawn:
-			b[off] = byte(e.Op); off++
-			binary.LittleEndian.PutUint32(b[off:off+4], uint32(e.EID)); off += 4
-		case RepStateHP:
-			b[off] = byte(e.Op); off++
-			binary.LittleEndian.PutUint32(b[off:off+4], uint32(e.EID)); off += 4
-			binary.LittleEndian.PutUint16(b[off:off+2], e.Val); off += 2
-		case RepEventText:
-			txt := e.Text
-			if len(txt) > 65535 { txt = txt[:65535] }
-			b[off] = byte(e.Op); off++
-			binary.LittleEndian.PutUint16(b[off:off+2], uint16(len(txt))); off += 2
-			copy(b[off:], []byte(txt)); off += len(txt)
-		}
-	}
-	return b
+	binary.LittleEndian.PutUint32(b[20:24], baseTick)
+	b[24] = byte(ch)
+	binary.LittleEndian.PutUint16(b[25:27], uint16(n))
 }
 
-func DecodeReplicate(b []byte) (sid shared.SessionID, serverTick uint32, ch RepChannel, events []RepEvent, err error) {
-	if len(b) < 23 { return sid, 0, 0, nil, errors.New("bad replicate payload") }
+func replicateHeader(b []byte) (sid shared.SessionID, serverTick, baseTick uint32, ch RepChannel, n int) {
 	copy(sid[:], b[0:16])
 	serverTick = binary.LittleEndian.Uint32(b[16:20])
-	ch = RepChannel(b[20])
-	n := int(binary.LittleEndian.Uint16(b[21:23]))
-	off := 23
+	baseTick = binary.LittleEndian.Uint32(b[20:24])
+	ch = RepChannel(b[24])
+	n = int(binary.LittleEndian.Uint16(b[25:27]))
+	return
+}
+
+// RepEventSize is the encoded size of a single event (see EncodeReplicate).
+// Unknown ops encode to nothing.
+func RepEventSize(e RepEvent) int {
+	switch e.Op {
+	case RepSpawn:
+		return 1 + 4 + 1 + 4 + 4
+	case RepMove:
+		return 1 + 4 + 4
+	case RepDespawn:
+		return 1 + 4
+	case RepStateHP:
+		return 1 + 4 + 2
+	case RepEventText:
+		l := len(e.Text)
+		if l > 65535 { l = 65535 }
+		return 1 + 2 + l
+	}
+	return 0
+}
+
+// AppendRepEvent appends the encoding of e to b. Shared by the gateway<->zone
+// frame and the client-facing replication datagrams.
+func AppendRepEvent(b []byte, e RepEvent) []byte {
+	var tmp [4]byte
+	switch e.Op {
+	case RepSpawn:
+		b = append(b, byte(e.Op))
+		binary.LittleEndian.PutUint32(tmp[:], uint32(e.EID)); b = append(b, tmp[:4]...)
+		b = append(b, byte(e.Kind))
+		binary.LittleEndian.PutUint32(tmp[:], uint32(e.Mask)); b = append(b, tmp[:4]...)
+		binary.LittleEndian.PutUint16(tmp[0:2], uint16(e.X))
+		binary.LittleEndian.PutUint16(tmp[2:4], uint16(e.Y))
+		b = append(b, tmp[:4]...)
+	case RepMove:
+		b = append(b, byte(e.Op))
+		binary.LittleEndian.PutUint32(tmp[:], uint32(e.EID)); b = append(b, tmp[:4]...)
+		binary.LittleEndian.PutUint16(tmp[0:2], uint16(e.X))
+		binary.LittleEndian.PutUint16(tmp[2:4], uint16(e.Y))
+		b = append(b, tmp[:4]...)
+	case RepDespawn:
+		b = append(b, byte(e.Op))
+		binary.LittleEndian.PutUint32(tmp[:], uint32(e.EID)); b = append(b, tmp[:4]...)
+	case RepStateHP:
+		b = append(b, byte(e.Op))
+		binary.LittleEndian.PutUint32(tmp[:], uint32(e.EID)); b = append(b, tmp[:4]...)
+		binary.LittleEndian.PutUint16(tmp[0:2], e.Val); b = append(b, tmp[:2]...)
+	case RepEventText:
+		txt := e.Text
+		if len(txt) > 65535 { txt = txt[:65535] }
+		b = append(b, byte(e.Op))
+		binary.LittleEndian.PutUint16(tmp[0:2], uint16(len(txt))); b = append(b, tmp[:2]...)
+		b = append(b, txt...)
+	}
+	return b
+}
+
+// DecodeRepEvents decodes n events from the front of b and returns how many
+// bytes were consumed. Trailing bytes are left to the caller.
+func DecodeRepEvents(b []byte, n int) (events []RepEvent, off int, err error) {
 	events = make([]RepEvent, 0, n)
 	for i := 0; i < n; i++ {
-		if off+1 > len(b) { return sid, 0, 0, nil, errors.New("bad replicate payload length") }
+		if off+1 > len(b) { return nil, 0, errors.New("bad replicate payload length") }
 		op := RepOp(b[off]); off++
 		switch op {
 		case RepSpawn:
-			if off+4+1+4+4 > len(b) { return sid, 0, 0, nil, errors.New("bad replicate payload length") }
+			if off+4+1+4+4 > len(b) { return nil, 0, errors.New("bad replicate payload length") }
 			eid := shared.EntityID(binary.LittleEndian.Uint32(b[off:off+4])); off += 4
 			kind := EntityKind(b[off]); off++
 			mask := InterestMask(binary.LittleEndian.Uint32(b[off:off+4])); off += 4
@@ -219,37 +288,148 @@ func DecodeReplicate(b []byte) (sid shared.SessionID, serverTick uint32, ch RepC
 			y := int16(binary.LittleEndian.Uint16(b[off+2:off+4])); off += 4
 			events = append(events, RepEvent{Op: op, EID: eid, Kind: kind, Mask: mask, X: x, Y: y})
 		case RepMove:
-			if off+8 > len(b) { return sid, 0, 0, nil, errors.New("bad replicate payload length") }
+			if off+8 > len(b) { return nil, 0, errors.New("bad replicate payload length") }
 			eid := shared.EntityID(binary.LittleEndian.Uint32(b[off:off+4])); off += 4
 			x := int16(binary.LittleEndian.Uint16(b[off:off+2]))
 			y := int16(binary.LittleEndian.Uint16(b[off+2:off+4])); off += 4
 			events = append(events, RepEvent{Op: op, EID: eid, X: x, Y: y})
 		case RepDespawn:
-			if off+4 > len(b) { return sid, 0, 0, nil, errors.New("bad replicate payload length") }
+			if off+4 > len(b) { return nil, 0, errors.New("bad replicate payload length") }
 			eid := shared.EntityID(binary.LittleEndian.Uint32(b[off:off+4])); off += 4
 			events = append(events, RepEvent{Op: op, EID: eid})
 		case RepStateHP:
-			if off+6 > len(b) { return sid, 0, 0, nil, errors.New("bad replicate payload length") }
+			if off+6 > len(b) { return nil, 0, errors.New("bad replicate payload length") }
 			eid := shared.EntityID(binary.LittleEndian.Uint32(b[off:off+4])); off += 4
 			hp := binary.LittleEndian.Uint16(b[off:off+2]); off += 2
 			events = append(events, RepEvent{Op: op, EID: eid, Val: hp})
 		case RepEventText:
-			if off+2 > len(b) { return sid, 0, 0, nil, errors.New("bad replicate payload length") }
+			if off+2 > len(b) { return nil, 0, errors.New("bad replicate payload length") }
 			l := int(binary.LittleEndian.Uint16(b[off:off+2])); off += 2
-			if off+l > len(b) { return sid, 0, 0, nil, errors.New("bad replicate payload length") }
+			if off+l > len(b) { return nil, 0, errors.New("bad replicate payload length") }
 			txt := string(b[off:off+l]); off += l
 			events = append(events, RepEvent{Op: op, Text: txt})
 		default:
-			return sid, 0, 0, nil, errors.New("unknown replicate op")
+			return nil, 0, errors.New("unknown replicate op")
 		}
 	}
-	if off != len(b) { return sid, 0, 0, nil, errors.New("extra bytes in replicate payload") }
+	return events, off, nil
+}
+
+// RepAck: [sid:16][tick:u32][chan:u8]
+// The client has the complete replicate message for (tick, chan).
+func EncodeRepAck(sid shared.SessionID, tick uint32, ch RepChannel) []byte {
+	b := make([]byte, 16+4+1)
+	copy(b[0:16], sid[:])
+	binary.LittleEndian.PutUint32(b[16:20], tick)
+	b[20] = byte(ch)
+	return b
+}
+func DecodeRepAck(b []byte) (sid shared.SessionID, tick uint32, ch RepChannel, err error) {
+	if len(b) != 21 { return sid, 0, 0, errors.New("bad rep-ack payload") }
+	copy(sid[:], b[0:16])
+	tick = binary.LittleEndian.Uint32(b[16:20])
+	ch = RepChannel(b[20])
+	return
+}
+
+// PlayerBudget: [sid:16][bytesPerTick:u32]
+// The gateway's estimate of what the client link can carry; replaces the
+// zone's default BudgetBytes for that player.
+func EncodePlayerBudget(sid shared.SessionID, bytesPerTick uint32) []byte {
+	b := make([]byte, 16+4)
+	copy(b[0:16], sid[:])
+	binary.LittleEndian.PutUint32(b[16:20], bytesPerTick)
+	return b
+}
+func DecodePlayerBudget(b []byte) (sid shared.SessionID, bytesPerTick uint32, err error) {
+	if len(b) != 20 { return sid, 0, errors.New("bad player-budget payload") }
+	copy(sid[:], b[0:16])
+	bytesPerTick = binary.LittleEndian.Uint32(b[16:20])
 	return
 }
 
-// TransferPrepare: [sid:16][cid:u64][targetZone:u32][interest:u32][x:i16][y:i16][hp:u16]
-func EncodeTransferPrepare(sid shared.SessionID, cid shared.CharacterID, target shared.ZoneID, interest InterestMask, st persist.CharacterState) []byte {
-	b := make([]byte, 16+8+4+4+2+2+2)
+// PlayerLink: [sid:16][rttMs:u16][jitterMs:u16][lossPermille:u16]
+// The gateway's ping measurements of the client link, for lag compensation.
+type LinkStats struct {
+	RTTMs        uint16
+	JitterMs     uint16
+	LossPermille uint16
+}
+
+func EncodePlayerLink(sid shared.SessionID, ls LinkStats) []byte {
+	b := make([]byte, 16+2+2+2)
+	copy(b[0:16], sid[:])
+	binary.LittleEndian.PutUint16(b[16:18], ls.RTTMs)
+	binary.LittleEndian.PutUint16(b[18:20], ls.JitterMs)
+	binary.LittleEndian.PutUint16(b[20:22], ls.LossPermille)
+	return b
+}
+func DecodePlayerLink(b []byte) (sid shared.SessionID, ls LinkStats, err error) {
+	if len(b) != 22 { return sid, ls, errors.New("bad player-link payload") }
+	copy(sid[:], b[0:16])
+	ls.RTTMs = binary.LittleEndian.Uint16(b[16:18])
+	ls.JitterMs = binary.LittleEndian.Uint16(b[18:20])
+	ls.LossPermille = binary.LittleEndian.Uint16(b[20:22])
+	return
+}
+
+// PlayerParty: [sid:16][n:u16] n*[cid:u64]
+// The characters in the player's party, not counting itself; the zone
+// replicates their players to it whatever the distance. n=0: no party.
+func EncodePlayerParty(sid shared.SessionID, members []shared.CharacterID) []byte {
+	b := make([]byte, 16+2+8*len(members))
+	copy(b[0:16], sid[:])
+	binary.LittleEndian.PutUint16(b[16:18], uint16(len(members)))
+	for i, cid := range members {
+		binary.LittleEndian.PutUint64(b[18+8*i:], uint64(cid))
+	}
+	return b
+}
+func DecodePlayerParty(b []byte) (sid shared.SessionID, members []shared.CharacterID, err error) {
+	if len(b) < 18 { return sid, nil, errors.New("bad player-party payload") }
+	copy(sid[:], b[0:16])
+	n := int(binary.LittleEndian.Uint16(b[16:18]))
+	if len(b) != 18+8*n { return sid, nil, errors.New("bad player-party payload") }
+	members = make([]shared.CharacterID, n)
+	for i := range members {
+		members[i] = shared.CharacterID(binary.LittleEndian.Uint64(b[18+8*i:]))
+	}
+	return sid, members, nil
+}
+
+// TickSync: [serverTick:u32]
+// Sent by the zone at the start of a tick, once a second, to every gateway
+// that negotiated CapTickSync; the gateway runs its tick clock off these.
+func EncodeTickSync(tick uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, tick)
+	return b
+}
+func DecodeTickSync(b []byte) (uint32, error) {
+	if len(b) != 4 { return 0, errors.New("bad tick-sync payload") }
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// Kick: [sid:16][reason utf8]
+// The zone has already detached the player; the gateway ends the session
+// and tells the client why.
+func EncodeKick(sid shared.SessionID, reason string) []byte {
+	b := make([]byte, 16, 16+len(reason))
+	copy(b[0:16], sid[:])
+	return append(b, reason...)
+}
+func DecodeKick(b []byte) (sid shared.SessionID, reason string, err error) {
+	if len(b) < 16 { return sid, "", errors.New("bad kick payload") }
+	copy(sid[:], b[0:16])
+	return sid, string(b[16:]), nil
+}
+
+// TransferPrepare: [sid:16][cid:u64][targetZone:u32][interest:u32][x:i16][y:i16][hp:u16][xfer:u64]
+// xfer is minted by the source zone and names this transfer in every later
+// message (attach, ack/nack, commit/abort), so stale or repeated ones can be
+// told apart from the current one.
+func EncodeTransferPrepare(sid shared.SessionID, cid shared.CharacterID, target shared.ZoneID, interest InterestMask, st persist.CharacterState, xfer uint64) []byte {
+	b := make([]byte, 16+8+4+4+2+2+2+8)
 	copy(b[0:16], sid[:])
 	binary.LittleEndian.PutUint64(b[16:24], uint64(cid))
 	binary.LittleEndian.PutUint32(b[24:28], uint32(target))
@@ -257,12 +437,13 @@ func EncodeTransferPrepare(sid shared.SessionID, cid shared.CharacterID, target
 	binary.LittleEndian.PutUint16(b[32:34], uint16(st.X))
 	binary.LittleEndian.PutUint16(b[34:36], uint16(st.Y))
 	binary.LittleEndian.PutUint16(b[36:38], st.HP)
+	binary.LittleEndian.PutUint64(b[38:46], xfer)
 	return b
 }
 
-func DecodeTransferPrepare(b []byte) (sid shared.SessionID, cid shared.CharacterID, target shared.ZoneID, interest InterestMask, x, y int16, hp uint16, err error) {
-	if len(b) != 38 {
-		return sid, 0, 0, 0, 0, 0, 0, errors.New("bad transfer-prepare payload")
+func DecodeTransferPrepare(b []byte) (sid shared.SessionID, cid shared.CharacterID, target shared.ZoneID, interest InterestMask, x, y int16, hp uint16, xfer uint64, err error) {
+	if len(b) != 46 {
+		return sid, 0, 0, 0, 0, 0, 0, 0, errors.New("bad transfer-prepare payload")
 	}
 	copy(sid[:], b[0:16])
 	cid = shared.CharacterID(binary.LittleEndian.Uint64(b[16:24]))
@@ -271,11 +452,134 @@ func DecodeTransferPrepare(b []byte) (sid shared.SessionID, cid shared.Character
 	x = int16(binary.LittleEndian.Uint16(b[32:34]))
 	y = int16(binary.LittleEndian.Uint16(b[34:36]))
 	hp = binary.LittleEndian.Uint16(b[36:38])
+	xfer = binary.LittleEndian.Uint64(b[38:46])
+	return
+}
+
+// TransferCommit/Abort: [sid:16][xfer:u64]
+// Idempotent: the source acts only while that very transfer is pending.
+func EncodeTransferCommit(sid shared.SessionID, xfer uint64) []byte { return EncodeAttachAck(sid, xfer) }
+func DecodeTransferCommit(b []byte) (shared.SessionID, uint64, error) { return DecodeAttachAck(b) }
+func EncodeTransferAbort(sid shared.SessionID, xfer uint64) []byte { return EncodeAttachAck(sid, xfer) }
+func DecodeTransferAbort(b []byte) (shared.SessionID, uint64, error) { return DecodeAttachAck(b) }
+
+// TransferQuery: [sid:16][xfer:u64]
+// The source of a transfer still pending after its timeout asks the gateway
+// for the outcome, which answers with a commit or an abort (or a detach, for
+// a session it no longer has).
+func EncodeTransferQuery(sid shared.SessionID, xfer uint64) []byte { return EncodeAttachAck(sid, xfer) }
+func DecodeTransferQuery(b []byte) (shared.SessionID, uint64, error) { return DecodeAttachAck(b) }
+
+// PeerHello: [wireVersion:u16][from:u32][to:u32]
+// Opens a ghost link: zone from streams MsgGhosts to zone to, which answers
+// MsgHelloAck (or MsgError(ErrHandshake)) and never sends anything else.
+func EncodePeerHello(from, to shared.ZoneID) []byte {
+	b := make([]byte, 2+4+4)
+	binary.LittleEndian.PutUint16(b[0:2], WireVersion)
+	binary.LittleEndian.PutUint32(b[2:6], uint32(from))
+	binary.LittleEndian.PutUint32(b[6:10], uint32(to))
+	return b
+}
+func DecodePeerHello(b []byte) (version uint16, from, to shared.ZoneID, err error) {
+	if len(b) != 10 { return 0, 0, 0, errors.New("bad peer-hello payload") }
+	version = binary.LittleEndian.Uint16(b[0:2])
+	from = shared.ZoneID(binary.LittleEndian.Uint32(b[2:6]))
+	to = shared.ZoneID(binary.LittleEndian.Uint32(b[6:10]))
 	return
 }
 
-// TransferCommit/Abort: [sid:16]
-func EncodeTransferCommit(sid shared.SessionID) []byte { return EncodeDetachPlayer(sid) }
-func DecodeTransferCommit(b []byte) (shared.SessionID, error) { return DecodeDetachPlayer(b) }
-func EncodeTransferAbort(sid shared.SessionID) []byte { return EncodeDetachPlayer(sid) }
-func DecodeTransferAbort(b []byte) (shared.SessionID, error) { return DecodeDetachPlayer(b) }
+// GhostEntity is a read-only copy of another zone's entity; EID is the
+// owning zone's.
+type GhostEntity struct {
+	EID   shared.EntityID
+	Kind  EntityKind
+	Owner shared.CharacterID // players only
+	X, Y  int16
+	HP    uint16
+}
+
+const ghostEntitySize = 4 + 1 + 8 + 2 + 2 + 2
+
+// Ghosts: [serverTick:u32][n:u16] n*[eid:u32][kind:u8][owner:u64][x:i16][y:i16][hp:u16]
+// The full set of the sender's entities in the band; anything the receiver
+// holds from that sender and not listed is gone.
+func EncodeGhosts(tick uint32, ents []GhostEntity) []byte {
+	if len(ents) > 0xFFFF { ents = ents[:0xFFFF] }
+	b := make([]byte, 6+len(ents)*ghostEntitySize)
+	binary.LittleEndian.PutUint32(b[0:4], tick)
+	binary.LittleEndian.PutUint16(b[4:6], uint16(len(ents)))
+	o := 6
+	for _, e := range ents {
+		binary.LittleEndian.PutUint32(b[o:o+4], uint32(e.EID))
+		b[o+4] = byte(e.Kind)
+		binary.LittleEndian.PutUint64(b[o+5:o+13], uint64(e.Owner))
+		binary.LittleEndian.PutUint16(b[o+13:o+15], uint16(e.X))
+		binary.LittleEndian.PutUint16(b[o+15:o+17], uint16(e.Y))
+		binary.LittleEndian.PutUint16(b[o+17:o+19], e.HP)
+		o += ghostEntitySize
+	}
+	return b
+}
+
+func DecodeGhosts(b []byte) (tick uint32, ents []GhostEntity, err error) {
+	if len(b) < 6 { return 0, nil, errors.New("bad ghosts payload") }
+	tick = binary.LittleEndian.Uint32(b[0:4])
+	n := int(binary.LittleEndian.Uint16(b[4:6]))
+	if len(b) != 6+n*ghostEntitySize { return 0, nil, errors.New("bad ghosts payload") }
+	ents = make([]GhostEntity, n)
+	o := 6
+	for i := range ents {
+		ents[i] = GhostEntity{
+			EID: shared.EntityID(binary.LittleEndian.Uint32(b[o:o+4])),
+			Kind: EntityKind(b[o+4]),
+			Owner: shared.CharacterID(binary.LittleEndian.Uint64(b[o+5:o+13])),
+			X: int16(binary.LittleEndian.Uint16(b[o+13:o+15])),
+			Y: int16(binary.LittleEndian.Uint16(b[o+15:o+17])),
+			HP: binary.LittleEndian.Uint16(b[o+17:o+19]),
+		}
+		o += ghostEntitySize
+	}
+	return tick, ents, nil
+}
+
+// InstanceCreate: [req:u32]
+// Sent on the link to an instance host (the template's zone id); req is the
+// gateway's, echoed in the answer.
+func EncodeInstanceCreate(req uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, req)
+	return b
+}
+func DecodeInstanceCreate(b []byte) (uint32, error) {
+	if len(b) != 4 { return 0, errors.New("bad instance-create payload") }
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// InstanceCreated: [req:u32][instance:u32][code:u16][reason utf8]
+// instance is the new instance's zone id, reachable on the host's address;
+// 0 means it was not created and code/reason say why.
+func EncodeInstanceCreated(req uint32, instance shared.ZoneID, code ErrCode, reason string) []byte {
+	b := make([]byte, 10, 10+len(reason))
+	binary.LittleEndian.PutUint32(b[0:4], req)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(instance))
+	binary.LittleEndian.PutUint16(b[8:10], uint16(code))
+	return append(b, reason...)
+}
+func DecodeInstanceCreated(b []byte) (req uint32, instance shared.ZoneID, code ErrCode, reason string, err error) {
+	if len(b) < 10 { return 0, 0, 0, "", errors.New("bad instance-created payload") }
+	req = binary.LittleEndian.Uint32(b[0:4])
+	instance = shared.ZoneID(binary.LittleEndian.Uint32(b[4:8]))
+	code = ErrCode(binary.LittleEndian.Uint16(b[8:10]))
+	return req, instance, code, string(b[10:]), nil
+}
+
+// InstanceClosed: [instance:u32]
+func EncodeInstanceClosed(instance shared.ZoneID) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(instance))
+	return b
+}
+func DecodeInstanceClosed(b []byte) (shared.ZoneID, error) {
+	if len(b) != 4 { return 0, errors.New("bad instance-closed payload") }
+	return shared.ZoneID(binary.LittleEndian.Uint32(b)), nil
+}
@@ -2,29 +2,49 @@ package wire
 
 // WireVersion is the contract for Gateway <-> Zone.
 // Bump only with coordinated rollout.
-const WireVersion uint16 = 1
+const WireVersion uint16 = 3
 
 type MsgType uint8
 
 const (
+	// Handshake: first frame on every link, both directions (see EncodeHello)
+	MsgHello               MsgType = 9
+	MsgHelloAck            MsgType = 106
+
 	// Gateway -> Zone
 	MsgAttachPlayer        MsgType = 1
 	MsgAttachWithState     MsgType = 4
 	MsgDetachPlayer        MsgType = 2
 	MsgPlayerInput         MsgType = 3
 	MsgPlayerAction        MsgType = 5
+	MsgRepAck              MsgType = 8
+	MsgPlayerBudget        MsgType = 10 // per-player replication budget, see EncodePlayerBudget
+	MsgPlayerLink          MsgType = 11 // client link RTT/jitter/loss, see EncodePlayerLink
+	MsgInstanceCreate      MsgType = 12 // to an instance host, see EncodeInstanceCreate
+	MsgPlayerParty         MsgType = 13 // who a player always sees, see EncodePlayerParty
 
 	// Transfer 2PC (Gateway -> Zone)
 	MsgTransferCommit      MsgType = 6
 	MsgTransferAbort       MsgType = 7
 
 	// Zone -> Gateway
-	MsgAttachAck           MsgType = 101
+	MsgAttachAck           MsgType = 101 // see EncodeAttachAck
+	MsgAttachNack          MsgType = 109 // attach refused, see EncodeAttachNack
 	MsgError               MsgType = 102
 	MsgReplicate           MsgType = 103
+	MsgReplicateDelta      MsgType = 105 // packed move channel, see EncodeReplicateDelta
+	MsgTickSync            MsgType = 107 // zone tick at a tick boundary, see EncodeTickSync
+	MsgKick                MsgType = 108 // evict a player through its gateway, see EncodeKick
+	MsgInstanceCreated     MsgType = 110 // answer to MsgInstanceCreate, see EncodeInstanceCreated
+	MsgInstanceClosed      MsgType = 111 // an idle instance was torn down, see EncodeInstanceClosed
 
 	// Transfer 2PC (Zone -> Gateway)
 	MsgTransferPrepare     MsgType = 104
+	MsgTransferQuery       MsgType = 112 // a prepare went unanswered, see EncodeTransferQuery
+
+	// Zone -> Zone ghost links (neighbours along a shared border)
+	MsgPeerHello           MsgType = 20 // first frame from the dialing zone, see EncodePeerHello
+	MsgGhosts              MsgType = 21 // entities in the border band, see EncodeGhosts
 )
 
 type ErrCode uint16
@@ -37,6 +57,8 @@ const (
 	ErrCooldown    ErrCode = 4
 	ErrOutOfRange  ErrCode = 5
 	ErrTransfer    ErrCode = 6
+	ErrHandshake   ErrCode = 7
+	ErrFull        ErrCode = 8 // e.g. an instance host at its limit
 )
 
 type RepChannel uint8
@@ -53,11 +75,29 @@ const (
 	RepSpawn      RepOp = 1
 	RepDespawn    RepOp = 2
 	RepMove       RepOp = 3
+	RepMoveDelta  RepOp = 4 // X/Y carry the delta against the observer's baseline
 
 	RepStateHP    RepOp = 10
 	RepEventText  RepOp = 20
 )
 
+// Capability flags exchanged in the handshake; a link uses the intersection.
+type Caps uint32
+
+const (
+	CapDeltaMove Caps = 1 << 0 // MsgReplicateDelta
+	CapRepAck    Caps = 1 << 1 // MsgRepAck relayed from clients
+	CapBudget    Caps = 1 << 2 // MsgPlayerBudget from gateway congestion control
+	CapLinkStats Caps = 1 << 3 // MsgPlayerLink from gateway pings
+	CapTickSync  Caps = 1 << 4 // MsgTickSync from the zone
+	CapKick      Caps = 1 << 5 // MsgKick from the zone
+	CapInstances Caps = 1 << 6 // the zone is an instance host (MsgInstanceCreate)
+	CapParty     Caps = 1 << 7 // MsgPlayerParty from the gateway
+	CapXferQuery Caps = 1 << 8 // MsgTransferQuery from the zone; the gateway alone settles transfers
+)
+
+func (c Caps) Has(f Caps) bool { return c&f == f }
+
 // Interest layers (Step14)
 type InterestMask uint32
 
@@ -1,4 +1,4 @@
-package gateway
+package shared
 
 import (
 	"fmt"
@@ -6,9 +6,11 @@ import (
 	"strings"
 )
 
-type ZoneFlags map[uint32]string
+// ZoneAddrs maps zone ids to addresses. As a flag.Value it takes
+// <zoneID>=<host:port> and may be repeated (cmd/gateway -zone, cmd/zone -peer).
+type ZoneAddrs map[uint32]string
 
-func (z ZoneFlags) String() string {
+func (z ZoneAddrs) String() string {
 	var s []string
 	for id, addr := range z {
 		s = append(s, fmt.Sprintf("%d=%s", id, addr))
@@ -16,10 +18,10 @@ func (z ZoneFlags) String() string {
 	return strings.Join(s, ",")
 }
 
-func (z ZoneFlags) Set(v string) error {
+func (z ZoneAddrs) Set(v string) error {
 	parts := strings.Split(v, "=")
 	if len(parts) != 2 {
-		return fmt.Errorf("zone flag must be <id>=<addr>")
+		return fmt.Errorf("want <id>=<addr>")
 	}
 	idU, err := strconv.ParseUint(parts[0], 10, 32)
 	if err != nil || idU == 0 {
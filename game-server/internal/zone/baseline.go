@@ -0,0 +1,64 @@
+package zone
+
+import "game-server/internal/shared"
+
+// Step25: acked-baseline replication (Quake-style snapshots).
+//
+// For every replicated channel we remember the view each outgoing message
+// leaves the client with, keyed by server tick. The client acks (tick, chan)
+// through the gateway; the newest acked view becomes the baseline the next
+// message is diffed against. A lost datagram is simply never acked, so the
+// following diff still covers it.
+
+// maxUnackedViews bounds how many sent views we keep past the baseline. When
+// that many go unacked the client is assumed to have lost the baseline too
+// (it keeps a larger frame history) and we diff against an empty view.
+const maxUnackedViews = 32
+
+// repView is what the client holds for one channel as of tick.
+type repView[T comparable] struct {
+	tick uint32
+	ents map[shared.EntityID]T
+}
+
+func (v repView[T]) clone(tick uint32) repView[T] {
+	out := repView[T]{tick: tick, ents: make(map[shared.EntityID]T, len(v.ents))}
+	for eid, x := range v.ents { out.ents[eid] = x }
+	return out
+}
+
+type repBaseline[T comparable] struct {
+	acked repView[T]
+	sent  []repView[T] // views sent after acked, oldest first
+}
+
+func newRepBaseline[T comparable]() repBaseline[T] {
+	return repBaseline[T]{acked: repView[T]{ents: make(map[shared.EntityID]T)}}
+}
+
+// base returns the view to diff against: the acked one, or an empty view
+// (tick 0) if the baseline is lost.
+func (b *repBaseline[T]) base() repView[T] {
+	if len(b.sent) >= maxUnackedViews {
+		return repView[T]{ents: make(map[shared.EntityID]T)}
+	}
+	return b.acked
+}
+
+func (b *repBaseline[T]) record(v repView[T]) {
+	b.sent = append(b.sent, v)
+	if len(b.sent) > maxUnackedViews {
+		b.sent = b.sent[len(b.sent)-maxUnackedViews:]
+	}
+}
+
+// ack promotes the view sent at tick to baseline. Stale or unknown ticks are ignored.
+func (b *repBaseline[T]) ack(tick uint32) {
+	for i, v := range b.sent {
+		if v.tick == tick {
+			b.acked = v
+			b.sent = b.sent[i+1:]
+			return
+		}
+	}
+}
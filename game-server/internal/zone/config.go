@@ -1,6 +1,11 @@
 package zone
 
-import "game-server/internal/persist"
+import (
+	"time"
+
+	"game-server/internal/persist"
+	"game-server/internal/shared/topology"
+)
 
 type Config struct {
 	ListenAddr string
@@ -15,6 +20,10 @@ type Config struct {
 	BudgetBytes int
 	StateEveryTicks int
 
+	// delta movement replication: moves are sent as varint deltas against the
+	// observer's last acked baseline
+	DeltaMove bool
+
 	// persistence
 	SaveEveryTicks int
 	Store persist.Store
@@ -25,13 +34,29 @@ type Config struct {
 	SnapshotStore persist.SnapshotStore
 	SnapshotQ *persist.SnapshotQueue
 
+	// on shutdown, how long to wait for SaveQ and SnapshotQ to flush
+	DrainTimeout time.Duration
+
 	// AI budget
 	AIBudgetPerTick int
 
-	// transfer (boundary-based toy policy)
-	TransferTargetZone uint32
-	TransferBoundaryX int16
+	// transfer: the world map says where a player at a given position
+	// belongs (edges and portals, see topology.Map.Route)
+	World *topology.Map
 	TransferTimeoutTicks uint32
+	TransferRetryTicks uint32 // after an abort, before a player still on the portal is offered again
+
+	// ghost links: neighbour zone id -> address. Entities within GhostBand
+	// of a neighbour's area are mirrored there (see ghost.go).
+	Peers map[uint32]string
+	GhostBand int16
+
+	// instancing (see host.go). Template is set on an instance: the
+	// world-map zone it is a copy of; ZoneID is then the instance's own id.
+	// The rest configures a host.
+	Template uint32
+	MaxInstances int
+	InstanceIdle time.Duration // an instance empty this long is torn down
 
 	// Step24 lag compensation
 	HistoryTicks int
@@ -0,0 +1,187 @@
+package zone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"game-server/internal/shared"
+	"game-server/internal/shared/wire"
+)
+
+// Ghost entities: continuous visibility across zone borders.
+//
+// Every zone dials each world-map neighbour it has an address for (Peers)
+// and, once a tick, sends it every local entity within GhostBand of that
+// neighbour's area (MsgGhosts, the full set each time). The receiver keeps
+// them as ghosts: ordinary World entities flagged in World.Ghost, so they sit
+// in the spatial grid and replicate to nearby players like anything else,
+// but they never think, move on their own, take hits, get saved or get
+// passed on to a third zone. Each direction has its own link; the accepting
+// side only listens.
+
+const (
+	ghostRedialMin = 200 * time.Millisecond
+	ghostRedialMax = 5 * time.Second
+)
+
+// ghostLinkLoop keeps our link to neighbour zid up until ctx is done.
+func (s *Server) ghostLinkLoop(ctx context.Context, zid uint32, addr string) {
+	backoff := ghostRedialMin
+	for {
+		l, err := s.dialPeer(zid, addr)
+		if err == nil {
+			backoff = ghostRedialMin
+			s.mu.Lock()
+			s.peersOut[zid] = l
+			s.mu.Unlock()
+			log.Printf("zone %d: ghost link to zone %d up", s.cfg.ZoneID, zid)
+			// the peer sends nothing after its ack; reading just waits for the end
+			for err == nil { _, err = wire.ReadFrame(l.r) }
+			s.mu.Lock()
+			if s.peersOut[zid] == l { delete(s.peersOut, zid) }
+			s.mu.Unlock()
+			_ = l.conn.Close()
+		}
+		if ctx.Err() != nil { return }
+		log.Printf("zone %d: ghost link to zone %d: %v", s.cfg.ZoneID, zid, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > ghostRedialMax { backoff = ghostRedialMax }
+	}
+}
+
+func (s *Server) dialPeer(zid uint32, addr string) (*gwLink, error) {
+	c, err := net.DialTimeout("tcp", addr, 3*time.Second)
+	if err != nil { return nil, err }
+	l := newGWLink(0, c)
+	l.peer = zid
+	fail := func(err error) (*gwLink, error) {
+		_ = c.Close()
+		return nil, err
+	}
+	if err := l.send(wire.MsgPeerHello, wire.EncodePeerHello(shared.ZoneID(s.cfg.ZoneID), shared.ZoneID(zid))); err != nil { return fail(err) }
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fr, err := wire.ReadFrame(l.r)
+	_ = c.SetReadDeadline(time.Time{})
+	if err != nil { return fail(err) }
+	switch fr.Type {
+	case wire.MsgHelloAck:
+		h, err := wire.DecodeHello(fr.Payload)
+		if err != nil { return fail(err) }
+		if uint32(h.ZoneID) != zid { return fail(fmt.Errorf("%s is zone %d", addr, h.ZoneID)) }
+		return l, nil
+	case wire.MsgError:
+		_, msg, _ := wire.DecodeError(fr.Payload)
+		return fail(errors.New("rejected: " + msg))
+	default:
+		return fail(errors.New("expected hello ack"))
+	}
+}
+
+// peerHandshake admits a neighbour's ghost link (the first frame was
+// MsgPeerHello). Only zones the world map lists as our neighbours get in.
+func (s *Server) peerHandshake(l *gwLink, payload []byte) error {
+	reject := func(err error) error {
+		l.sendError(wire.ErrHandshake, err.Error())
+		return err
+	}
+	version, from, to, err := wire.DecodePeerHello(payload)
+	if err != nil { return reject(err) }
+	if version != wire.WireVersion { return reject(fmt.Errorf("wire version mismatch: peer=%d local=%d", version, wire.WireVersion)) }
+	if uint32(to) != s.cfg.ZoneID { return reject(fmt.Errorf("zone id mismatch: peer=%d local=%d", to, s.cfg.ZoneID)) }
+	if !s.isNeighbour(from) { return reject(fmt.Errorf("zone %d is not a neighbour", from)) }
+	l.peer = uint32(from)
+	s.mu.Lock()
+	tick := s.serverTick
+	s.mu.Unlock()
+	ack := wire.Hello{Version: wire.WireVersion, ZoneID: shared.ZoneID(s.cfg.ZoneID), TickHz: uint16(s.cfg.TickHz), ServerTick: tick}
+	return l.send(wire.MsgHelloAck, wire.EncodeHello(ack))
+}
+
+func (s *Server) isNeighbour(zid shared.ZoneID) bool {
+	wz, _ := s.cfg.World.Zone(mapZoneID(s.cfg))
+	for _, n := range wz.Neighbours {
+		if n == zid { return true }
+	}
+	return false
+}
+
+// applyGhostsLocked makes what we hold from zone peer match ents. A
+// character that is (still, or already) ours is skipped: mid-transfer both
+// zones have it for a moment and its player must not see itself twice.
+func (s *Server) applyGhostsLocked(peer uint32, ents []wire.GhostEntity) {
+	held := s.ghosts[peer]
+	if held == nil {
+		held = make(map[shared.EntityID]shared.EntityID)
+		s.ghosts[peer] = held
+	}
+	local := make(map[shared.CharacterID]struct{}, len(s.players))
+	for _, p := range s.players { local[p.CID] = struct{}{} }
+	seen := make(map[shared.EntityID]struct{}, len(ents))
+	for _, e := range ents {
+		if _, ok := local[e.Owner]; ok && e.Owner != 0 { continue }
+		seen[e.EID] = struct{}{}
+		eid, ok := held[e.EID]
+		if !ok {
+			eid = s.world.Spawn(e.Kind, e.Owner, e.X, e.Y)
+			s.world.Ghost[eid] = true
+			held[e.EID] = eid
+		}
+		s.world.PosX[eid], s.world.PosY[eid] = e.X, e.Y
+		s.world.HP[eid] = e.HP
+	}
+	for reid, eid := range held {
+		if _, ok := seen[reid]; ok { continue }
+		s.world.Despawn(eid)
+		delete(s.posHist, eid)
+		delete(held, reid)
+	}
+}
+
+// dropGhostOfLocked removes the ghost of character cid, which just became
+// ours, rather than leaving it next to the real one until the neighbour's
+// next update.
+func (s *Server) dropGhostOfLocked(cid shared.CharacterID) {
+	for _, held := range s.ghosts {
+		for reid, eid := range held {
+			if s.world.Owner[eid] != cid { continue }
+			s.world.Despawn(eid)
+			delete(s.posHist, eid)
+			delete(held, reid)
+		}
+	}
+}
+
+// ghostSend is one MsgGhosts for one neighbour, built under s.mu and sent
+// after it.
+type ghostSend struct {
+	l       *gwLink
+	payload []byte
+}
+
+// collectGhostsLocked builds this tick's MsgGhosts for every neighbour we
+// have a link to. Ghosts are never forwarded: they belong to another zone.
+func (s *Server) collectGhostsLocked() []ghostSend {
+	out := make([]ghostSend, 0, len(s.peersOut))
+	for zid, l := range s.peersOut {
+		nz, ok := s.cfg.World.Zone(shared.ZoneID(zid))
+		if !ok { continue }
+		ents := make([]wire.GhostEntity, 0, 32)
+		for eid, kind := range s.world.Kind {
+			if s.world.Ghost[eid] { continue }
+			x, y := s.world.PosX[eid], s.world.PosY[eid]
+			if !nz.Area.Near(x, y, s.cfg.GhostBand) { continue }
+			ents = append(ents, wire.GhostEntity{EID: eid, Kind: kind, Owner: s.world.Owner[eid], X: x, Y: y, HP: s.world.HP[eid]})
+		}
+		out = append(out, ghostSend{l: l, payload: wire.EncodeGhosts(s.serverTick, ents)})
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package zone
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"game-server/internal/shared/wire"
+)
+
+// gwLink is one attached gateway. Players remember the link they were
+// attached through; replication and errors for them go back the same way.
+type gwLink struct {
+	id   uint32
+	conn net.Conn
+	r    *bufio.Reader
+	caps wire.Caps // negotiated in the handshake
+	peer uint32    // neighbour zone on a ghost link (see ghost.go), 0 for a gateway
+
+	mu sync.Mutex // guards w
+	w  *bufio.Writer
+}
+
+func newGWLink(id uint32, c net.Conn) *gwLink {
+	return &gwLink{
+		id: id,
+		conn: c,
+		r: bufio.NewReaderSize(c, 64*1024),
+		w: bufio.NewWriterSize(c, 64*1024),
+	}
+}
+
+func (l *gwLink) send(typ wire.MsgType, payload []byte) error {
+	if l == nil { return nil }
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return wire.WriteFrame(l.w, typ, payload)
+}
+
+func (l *gwLink) sendError(code wire.ErrCode, msg string) {
+	_ = l.send(wire.MsgError, wire.EncodeError(code, msg))
+}
+
+// linkFrame is what link readers feed the main loop; closed marks the last
+// message from a link.
+type linkFrame struct {
+	l      *gwLink
+	fr     wire.Frame
+	closed bool
+}
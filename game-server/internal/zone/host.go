@@ -0,0 +1,230 @@
+package zone
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"game-server/internal/shared"
+	"game-server/internal/shared/wire"
+)
+
+// Instance hosting (dungeons, arenas).
+//
+// The process for an instanced zone of the world map runs no world of its
+// own: it is a Host, and each instance it creates is a complete Server (its
+// own World, grid and tick loop) under a zone id minted here. All of them
+// share the host's listener; a gateway dials an instance by saying hello
+// with its id. A hello for the template's id opens a control link instead,
+// on which the gateway asks for new instances (MsgInstanceCreate) and hears
+// about torn-down ones (MsgInstanceClosed). An instance without players for
+// InstanceIdle is torn down: its characters are saved, the rest is dropped.
+
+type Host struct {
+	cfg Config
+
+	mu sync.Mutex
+	instances map[uint32]*instance
+	ctrl map[*gwLink]struct{}
+	// last instance sequence number; seeded from the clock so ids from
+	// before a restart are not handed out again
+	seq uint32
+}
+
+type instance struct {
+	s *Server
+	ctx context.Context
+	stop context.CancelFunc
+	done chan struct{} // closed once its run has returned
+	emptySince time.Time // zero while it has players
+}
+
+func NewHost(cfg Config) *Host {
+	if cfg.TickHz <= 0 { cfg.TickHz = 20 }
+	if cfg.MaxInstances <= 0 { cfg.MaxInstances = 64 }
+	if cfg.InstanceIdle <= 0 { cfg.InstanceIdle = 30*time.Second }
+	if cfg.DrainTimeout <= 0 { cfg.DrainTimeout = 5*time.Second }
+	if cfg.World == nil || !cfg.World.Instanced(shared.ZoneID(cfg.ZoneID)) {
+		panic(fmt.Sprintf("zone: zone %d is not an instanced zone of the world map", cfg.ZoneID))
+	}
+	return &Host{
+		cfg: cfg,
+		instances: make(map[uint32]*instance),
+		ctrl: make(map[*gwLink]struct{}),
+		seq: uint32(time.Now().UnixNano()),
+	}
+}
+
+// instanceID mints ids from 2^31 up, which the world map keeps free, with
+// the template id in bits 24-30 so hosts of different templates do not
+// collide (the map keeps instanced ids within topology.MaxInstancedID).
+func instanceID(template, seq uint32) uint32 {
+	return 1<<31 | template<<24 | seq&0xFFFFFF
+}
+
+func (h *Host) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", h.cfg.ListenAddr)
+	if err != nil { return err }
+	defer ln.Close()
+	log.Printf("instance host up: template=%d listen=%s max=%d idle=%v",
+		h.cfg.ZoneID, h.cfg.ListenAddr, h.cfg.MaxInstances, h.cfg.InstanceIdle)
+
+	go h.acceptLoop(ctx, ln)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.mu.Lock()
+			insts := make([]*instance, 0, len(h.instances))
+			for _, inst := range h.instances {
+				inst.stop()
+				insts = append(insts, inst)
+			}
+			for l := range h.ctrl { _ = l.conn.Close() }
+			h.mu.Unlock()
+			// each instance queues its characters' saves on the way out
+			for _, inst := range insts { <-inst.done }
+			return drainQueues(h.cfg)
+		case now := <-t.C:
+			h.reap(now)
+		}
+	}
+}
+
+// acceptLoop routes each new link by its hello: to an instance, or to the
+// control loop for the template's own id.
+func (h *Host) acceptLoop(ctx context.Context, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil { log.Printf("instance host %d accept: %v", h.cfg.ZoneID, err) }
+			return
+		}
+		go func() {
+			l := newGWLink(0, c)
+			fr, err := readFirstFrame(l)
+			if err != nil {
+				_ = c.Close()
+				return
+			}
+			var zid uint32
+			if fr.Type == wire.MsgHello {
+				if hello, err := wire.DecodeHello(fr.Payload); err == nil { zid = uint32(hello.ZoneID) }
+			}
+			if zid == h.cfg.ZoneID {
+				h.serveControl(ctx, l, fr)
+				return
+			}
+			h.mu.Lock()
+			inst := h.instances[zid]
+			h.mu.Unlock()
+			if inst == nil {
+				log.Printf("instance host %d: rejected link from %s: no instance %d", h.cfg.ZoneID, c.RemoteAddr(), zid)
+				l.sendError(wire.ErrHandshake, fmt.Sprintf("no such instance %d", zid))
+				_ = c.Close()
+				return
+			}
+			inst.s.serveLink(inst.ctx, l, fr)
+		}()
+	}
+}
+
+// serveControl handshakes a gateway's control link and answers its
+// MsgInstanceCreate until the link closes.
+func (h *Host) serveControl(ctx context.Context, l *gwLink, fr wire.Frame) {
+	hello, _ := wire.DecodeHello(fr.Payload)
+	if err := wire.CheckHello(hello, shared.ZoneID(h.cfg.ZoneID)); err != nil {
+		l.sendError(wire.ErrHandshake, err.Error())
+		_ = l.conn.Close()
+		return
+	}
+	ack := wire.Hello{Version: wire.WireVersion, ZoneID: shared.ZoneID(h.cfg.ZoneID), TickHz: uint16(h.cfg.TickHz), Caps: wire.CapInstances}
+	if err := l.send(wire.MsgHelloAck, wire.EncodeHello(ack)); err != nil {
+		_ = l.conn.Close()
+		return
+	}
+	h.mu.Lock()
+	h.ctrl[l] = struct{}{}
+	h.mu.Unlock()
+	log.Printf("instance host %d: gateway %s attached", h.cfg.ZoneID, l.conn.RemoteAddr())
+	defer func() {
+		h.mu.Lock()
+		delete(h.ctrl, l)
+		h.mu.Unlock()
+		_ = l.conn.Close()
+	}()
+
+	for {
+		fr, err := wire.ReadFrame(l.r)
+		if err != nil { return }
+		if fr.Type != wire.MsgInstanceCreate { continue } // e.g. a detach meant for an instance that never was
+		req, err := wire.DecodeInstanceCreate(fr.Payload)
+		if err != nil {
+			l.sendError(wire.ErrBadMsg, err.Error())
+			continue
+		}
+		id, err := h.create(ctx)
+		if err != nil {
+			_ = l.send(wire.MsgInstanceCreated, wire.EncodeInstanceCreated(req, 0, wire.ErrFull, err.Error()))
+			continue
+		}
+		_ = l.send(wire.MsgInstanceCreated, wire.EncodeInstanceCreated(req, shared.ZoneID(id), 0, ""))
+	}
+}
+
+func (h *Host) create(ctx context.Context) (uint32, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.instances) >= h.cfg.MaxInstances { return 0, fmt.Errorf("instance limit %d reached", h.cfg.MaxInstances) }
+	var id uint32
+	for {
+		h.seq++
+		id = instanceID(h.cfg.ZoneID, h.seq)
+		if h.instances[id] == nil { break }
+	}
+	cfg := h.cfg
+	cfg.ZoneID, cfg.Template = id, h.cfg.ZoneID
+	cfg.HTTPAddr, cfg.Peers = "", nil
+	ictx, stop := context.WithCancel(ctx)
+	inst := &instance{s: New(cfg), ctx: ictx, stop: stop, done: make(chan struct{}), emptySince: time.Now()}
+	h.instances[id] = inst
+	go func() {
+		defer close(inst.done)
+		_ = inst.s.run(ictx)
+	}()
+	log.Printf("instance host %d: created instance %d (%d running)", h.cfg.ZoneID, id, len(h.instances))
+	return id, nil
+}
+
+// reap tears down instances that have been empty for InstanceIdle and tells
+// the gateways.
+func (h *Host) reap(now time.Time) {
+	h.mu.Lock()
+	var dead []uint32
+	var insts []*instance
+	for id, inst := range h.instances {
+		if inst.s.playerCount() > 0 {
+			inst.emptySince = time.Time{}
+			continue
+		}
+		if inst.emptySince.IsZero() { inst.emptySince = now }
+		if now.Sub(inst.emptySince) < h.cfg.InstanceIdle { continue }
+		delete(h.instances, id)
+		inst.stop()
+		dead = append(dead, id)
+		insts = append(insts, inst)
+	}
+	ctrl := make([]*gwLink, 0, len(h.ctrl))
+	for l := range h.ctrl { ctrl = append(ctrl, l) }
+	h.mu.Unlock()
+
+	for i, id := range dead {
+		<-insts[i].done
+		log.Printf("instance host %d: instance %d idle, torn down", h.cfg.ZoneID, id)
+		for _, l := range ctrl { _ = l.send(wire.MsgInstanceClosed, wire.EncodeInstanceClosed(shared.ZoneID(id))) }
+	}
+}
@@ -1,9 +1,9 @@
 package zone
 
 import (
-	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"sort"
@@ -22,7 +22,16 @@ type Server struct {
 
 	mu sync.Mutex
 
-	w *bufio.Writer // gateway link
+	// attached gateways (see gwlink.go)
+	links map[uint32]*gwLink
+	nextLinkID uint32
+	inbound chan linkFrame // link readers -> run
+
+	// ghost links by neighbour zone (see ghost.go): we send on peersOut and
+	// receive on peersIn; ghosts maps their entity ids to our ghost entities
+	peersOut map[uint32]*gwLink
+	peersIn map[uint32]*gwLink
+	ghosts map[uint32]map[shared.EntityID]shared.EntityID
 
 	world *World
 	grid *spatial.Grid
@@ -32,6 +41,9 @@ type Server struct {
 
 	// pending transfer prepare waiting for commit/abort (Step13)
 	transferPending map[shared.SessionID]*pendingTransfer
+	// last transfer ID handed out; seeded from the clock so IDs from before a
+	// restart are not reused
+	xferSeq uint64
 
 	met *metrics.Counters
 }
@@ -41,13 +53,27 @@ type player struct {
 	CID shared.CharacterID
 	EID shared.EntityID
 
+	gw *gwLink // gateway that owns the session
+
 	Interest wire.InterestMask
 
 	nextClientTick uint32
 
-	known map[shared.EntityID]struct{}
-	lastSentPos map[shared.EntityID][2]int16
-	lastSentHP map[shared.EntityID]uint16
+	// Step25: per-channel acked baselines (see baseline.go)
+	move repBaseline[[2]int16]
+	state repBaseline[uint16]
+
+	// replication bytes per tick from gateway congestion control; 0 = cfg.BudgetBytes
+	budget int
+
+	// client link as measured by the gateway's pings; zero until reported
+	link wire.LinkStats
+	// characters in the player's party (MsgPlayerParty): always replicated
+	party map[shared.CharacterID]struct{}
+	// actions in a row whose tick failed validation (see maxBadActionTicks)
+	badTicks int
+	// no transfer prepare before this tick: the last one was aborted
+	xferRetryAt uint32
 
 	pendingEvents []string
 }
@@ -112,6 +138,7 @@ func (h *posHistory) sampleAt(tick uint32) (x, y int16, ok bool) {
 }
 
 type pendingTransfer struct {
+	ID uint64 // names this transfer in commit/abort, never 0
 	TargetZone shared.ZoneID
 	StartedTick uint32
 
@@ -129,14 +156,17 @@ func New(cfg Config) *Server {
 	if cfg.TickHz <= 0 { cfg.TickHz = 20 }
 	if cfg.AOIRadius <= 0 { cfg.AOIRadius = 25 }
 	if cfg.CellSize <= 0 { cfg.CellSize = 8 }
+	if cfg.GhostBand <= 0 { cfg.GhostBand = cfg.AOIRadius } // what a player at the border can see
 	if cfg.BudgetBytes <= 0 { cfg.BudgetBytes = 900 }
 	if cfg.StateEveryTicks <= 0 { cfg.StateEveryTicks = 5 }
 	if cfg.SaveEveryTicks <= 0 { cfg.SaveEveryTicks = 20 }
 	if cfg.SnapshotEveryTicks <= 0 { cfg.SnapshotEveryTicks = 200 } // 10s at 20Hz
 	if cfg.AIBudgetPerTick <= 0 { cfg.AIBudgetPerTick = 200 }
 	if cfg.TransferTimeoutTicks == 0 { cfg.TransferTimeoutTicks = 60 } // 3s at 20Hz
+	if cfg.TransferRetryTicks == 0 { cfg.TransferRetryTicks = 40 }
 	if cfg.HistoryTicks <= 0 { cfg.HistoryTicks = 40 }
 	if cfg.RewindMaxTicks == 0 { cfg.RewindMaxTicks = 5 }
+	if cfg.DrainTimeout <= 0 { cfg.DrainTimeout = 5*time.Second }
 
 	if cfg.Store == nil || cfg.SaveQ == nil {
 		panic("zone: Store and SaveQ required")
@@ -144,8 +174,14 @@ func New(cfg Config) *Server {
 	if cfg.SnapshotStore == nil || cfg.SnapshotQ == nil {
 		panic("zone: SnapshotStore and SnapshotQ required")
 	}
-	if cfg.TransferTargetZone == 0 {
-		panic("zone: TransferTargetZone required")
+	if cfg.World == nil {
+		panic("zone: World required")
+	}
+	if _, ok := cfg.World.Zone(mapZoneID(cfg)); !ok {
+		panic(fmt.Sprintf("zone: zone %d is not on the world map", mapZoneID(cfg)))
+	}
+	if cfg.Template == 0 && cfg.World.Instanced(shared.ZoneID(cfg.ZoneID)) {
+		panic(fmt.Sprintf("zone: zone %d is instanced, run it as a Host", cfg.ZoneID))
 	}
 
 	s := &Server{
@@ -153,13 +189,32 @@ func New(cfg Config) *Server {
 		world: NewWorld(),
 		grid: spatial.New(cfg.CellSize),
 		players: make(map[shared.SessionID]*player),
+		links: make(map[uint32]*gwLink),
+		peersOut: make(map[uint32]*gwLink),
+		peersIn: make(map[uint32]*gwLink),
+		ghosts: make(map[uint32]map[shared.EntityID]shared.EntityID),
 		transferPending: make(map[shared.SessionID]*pendingTransfer),
+		inbound: make(chan linkFrame, 512),
+		xferSeq: uint64(time.Now().UnixNano()),
 		posHist: make(map[shared.EntityID]*posHistory),
 		met: &metrics.Counters{},
 	}
 	return s
 }
 
+// playerCount is how many players are attached right now.
+func (s *Server) playerCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.players)
+}
+
+// mapZoneID is the world-map zone cfg runs: the template for an instance.
+func mapZoneID(cfg Config) shared.ZoneID {
+	if cfg.Template != 0 { return shared.ZoneID(cfg.Template) }
+	return shared.ZoneID(cfg.ZoneID)
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	// Step18: attempt snapshot load before serving
 	if snap, ok, err := s.cfg.SnapshotStore.LoadSnapshot(ctx, s.cfg.ZoneID); err == nil && ok {
@@ -176,26 +231,21 @@ func (s *Server) Start(ctx context.Context) error {
 	if err != nil { return err }
 	defer ln.Close()
 
-	log.Printf("zone up: zone=%d listen=%s xferTarget=%d boundaryX=%d",
-		s.cfg.ZoneID, s.cfg.ListenAddr, s.cfg.TransferTargetZone, s.cfg.TransferBoundaryX)
-
-	c, err := ln.Accept()
-	if err != nil { return err }
-	defer c.Close()
+	wz, _ := s.cfg.World.Zone(mapZoneID(s.cfg))
+	log.Printf("zone up: zone=%d listen=%s neighbours=%v portals=%d",
+		s.cfg.ZoneID, s.cfg.ListenAddr, wz.Neighbours, len(wz.Portals))
 
-	r := bufio.NewReaderSize(c, 64*1024)
-	s.w = bufio.NewWriterSize(c, 64*1024)
-
-	inbound := make(chan wire.Frame, 512)
-	go func() {
-		defer close(inbound)
-		for {
-			fr, err := wire.ReadFrame(r)
-			if err != nil { return }
-			inbound <- fr
-		}
-	}()
+	go s.acceptLoop(ctx, ln)
+	for _, n := range wz.Neighbours {
+		if addr, ok := s.cfg.Peers[uint32(n)]; ok { go s.ghostLinkLoop(ctx, uint32(n), addr) }
+	}
+	return s.run(ctx)
+}
 
+// run is the zone's main loop: frames from the links and the tick, until ctx
+// is done. An instance (see host.go) leaves draining the queues to its host.
+func (s *Server) run(ctx context.Context) error {
+	defer s.closeLinks()
 	ticker := time.NewTicker(time.Second / time.Duration(s.cfg.TickHz))
 	defer ticker.Stop()
 
@@ -204,13 +254,17 @@ func (s *Server) Start(ctx context.Context) error {
 		case <-ctx.Done():
 			s.mu.Lock()
 			s.enqueueDirtyLocked()
-			s.enqueueSnapshotLocked()
+			if s.cfg.Template == 0 { s.enqueueSnapshotLocked() }
 			s.mu.Unlock()
-			return nil
+			if s.cfg.Template != 0 { return nil }
+			return drainQueues(s.cfg)
 
-		case fr, ok := <-inbound:
-			if !ok { return errors.New("gateway link closed") }
-			s.handleFrame(ctx, fr)
+		case lf := <-s.inbound:
+			if lf.closed {
+				s.dropLink(lf.l)
+				continue
+			}
+			s.handleFrame(ctx, lf.l, lf.fr)
 
 		case <-ticker.C:
 			start := time.Now()
@@ -220,54 +274,249 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 }
 
-func (s *Server) handleFrame(ctx context.Context, fr wire.Frame) {
+// drainQueues writes out every queued save and snapshot before Start
+// returns, so the process can exit right after. The queues' own Run loops may
+// be flushing at the same time; the queues serialize that.
+func drainQueues(cfg Config) error {
+	start := time.Now()
+	dctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	err := errors.Join(cfg.SaveQ.Flush(dctx), cfg.SnapshotQ.Flush(dctx))
+	if err != nil {
+		log.Printf("zone %d drain: %v", cfg.ZoneID, err)
+		return err
+	}
+	log.Printf("zone %d drained in %v", cfg.ZoneID, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// acceptLoop admits any number of gateways. Each one must complete the
+// handshake first; mismatched builds are rejected with ErrHandshake and
+// logged, not served.
+func (s *Server) acceptLoop(ctx context.Context, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil { log.Printf("zone %d accept: %v", s.cfg.ZoneID, err) }
+			return
+		}
+		go func() {
+			l := newGWLink(0, c)
+			fr, err := readFirstFrame(l)
+			if err != nil {
+				_ = c.Close()
+				return
+			}
+			s.serveLink(ctx, l, fr)
+		}()
+	}
+}
+
+// serveLink handshakes a new link whose first frame was first, then feeds
+// its frames to the main loop until it closes.
+func (s *Server) serveLink(ctx context.Context, l *gwLink, first wire.Frame) {
+	c := l.conn
+	s.mu.Lock()
+	s.nextLinkID++
+	l.id = s.nextLinkID
+	s.mu.Unlock()
+
+	caps, err := s.handshake(l, first)
+	if err != nil {
+		log.Printf("zone %d: rejected link from %s: %v", s.cfg.ZoneID, c.RemoteAddr(), err)
+		_ = c.Close()
+		return
+	}
+	l.caps = caps
+	s.mu.Lock()
+	if ctx.Err() != nil {
+		// shutting down (an instance being torn down): closeLinks may be past
+		s.mu.Unlock()
+		_ = c.Close()
+		return
+	}
+	if l.peer != 0 {
+		if old := s.peersIn[l.peer]; old != nil { _ = old.conn.Close() }
+		s.peersIn[l.peer] = l
+	} else {
+		s.links[l.id] = l
+	}
+	s.mu.Unlock()
+	if l.peer != 0 {
+		log.Printf("zone %d: ghost link from zone %d attached", s.cfg.ZoneID, l.peer)
+	} else {
+		log.Printf("zone %d: gateway %s attached link=%d caps=%#x", s.cfg.ZoneID, c.RemoteAddr(), l.id, uint32(caps))
+	}
+
+	for {
+		fr, err := wire.ReadFrame(l.r)
+		if err != nil {
+			if ctx.Err() == nil && l.peer == 0 { log.Printf("zone %d: gateway link=%d closed: %v", s.cfg.ZoneID, l.id, err) }
+			select {
+			case s.inbound <- linkFrame{l: l, closed: true}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		select {
+		case s.inbound <- linkFrame{l: l, fr: fr}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dropLink forgets a gateway and detaches only the players it owned; other
+// gateways keep playing.
+func (s *Server) dropLink(l *gwLink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.peer != 0 {
+		// a newer link from the same zone may already have replaced this one
+		if s.peersIn[l.peer] != l { return }
+		delete(s.peersIn, l.peer)
+		_ = l.conn.Close()
+		s.applyGhostsLocked(l.peer, nil)
+		log.Printf("zone %d: ghost link from zone %d dropped", s.cfg.ZoneID, l.peer)
+		return
+	}
+	if s.links[l.id] != l { return }
+	delete(s.links, l.id)
+	_ = l.conn.Close()
+	n := 0
+	for sid, p := range s.players {
+		if p.gw == l {
+			s.detachLocked(sid, "gateway lost")
+			n++
+		}
+	}
+	log.Printf("zone %d: gateway link=%d dropped, detached %d players", s.cfg.ZoneID, l.id, n)
+}
+
+func (s *Server) closeLinks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, l := range s.links {
+		_ = l.conn.Close()
+		delete(s.links, id)
+	}
+	for _, peers := range []map[uint32]*gwLink{s.peersOut, s.peersIn} {
+		for zid, l := range peers {
+			_ = l.conn.Close()
+			delete(peers, zid)
+		}
+	}
+}
+
+// readFirstFrame reads the frame a new link opens with; a peer gets a few
+// seconds for it.
+func readFirstFrame(l *gwLink) (wire.Frame, error) {
+	_ = l.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer func() { _ = l.conn.SetReadDeadline(time.Time{}) }()
+	return wire.ReadFrame(l.r)
+}
+
+// handshake expects MsgHello as the first frame and answers with our own
+// hello. It returns the capabilities both sides support. A neighbour zone
+// opens with MsgPeerHello instead (see peerHandshake); its link gets no caps.
+func (s *Server) handshake(l *gwLink, fr wire.Frame) (wire.Caps, error) {
+	reject := func(err error) (wire.Caps, error) {
+		l.sendError(wire.ErrHandshake, err.Error())
+		return 0, err
+	}
+	if fr.Type == wire.MsgPeerHello {
+		return 0, s.peerHandshake(l, fr.Payload)
+	}
+	if fr.Type != wire.MsgHello {
+		return reject(errors.New("expected hello"))
+	}
+	h, err := wire.DecodeHello(fr.Payload)
+	if err != nil { return reject(err) }
+	if err := wire.CheckHello(h, shared.ZoneID(s.cfg.ZoneID)); err != nil {
+		return reject(err)
+	}
+	local := wire.CapRepAck | wire.CapBudget | wire.CapLinkStats | wire.CapTickSync | wire.CapKick | wire.CapParty | wire.CapXferQuery
+	if s.cfg.DeltaMove { local |= wire.CapDeltaMove }
+	s.mu.Lock()
+	tick := s.serverTick
+	s.mu.Unlock()
+	ack := wire.Hello{Version: wire.WireVersion, ZoneID: shared.ZoneID(s.cfg.ZoneID), TickHz: uint16(s.cfg.TickHz), Caps: local, ServerTick: tick}
+	if err := l.send(wire.MsgHelloAck, wire.EncodeHello(ack)); err != nil {
+		return 0, err
+	}
+	return local & h.Caps, nil
+}
+
+func (s *Server) handleFrame(ctx context.Context, l *gwLink, fr wire.Frame) {
+	if l.peer != 0 {
+		// a ghost link carries nothing else
+		if fr.Type != wire.MsgGhosts { return }
+		_, ents, err := wire.DecodeGhosts(fr.Payload)
+		if err != nil { return }
+		s.mu.Lock()
+		if s.peersIn[l.peer] == l { s.applyGhostsLocked(l.peer, ents) }
+		s.mu.Unlock()
+		return
+	}
 	switch fr.Type {
 	case wire.MsgAttachPlayer:
 		sid, cid, zid, interest, err := wire.DecodeAttachPlayer(fr.Payload)
-		if err != nil || uint32(zid) != s.cfg.ZoneID {
-			_ = wire.WriteFrame(s.w, wire.MsgError, wire.EncodeError(wire.ErrBadMsg, "bad attach"))
+		if err != nil {
+			l.sendError(wire.ErrBadMsg, "bad attach")
 			return
 		}
-		s.attachFromStore(ctx, sid, cid, interest)
-		_ = wire.WriteFrame(s.w, wire.MsgAttachAck, nil)
+		if uint32(zid) != s.cfg.ZoneID {
+			_ = l.send(wire.MsgAttachNack, wire.EncodeAttachNack(sid, 0, wire.ErrBadMsg, "wrong zone"))
+			return
+		}
+		s.attachFromStore(ctx, l, sid, cid, interest)
+		_ = l.send(wire.MsgAttachAck, wire.EncodeAttachAck(sid, 0))
 
 	case wire.MsgAttachWithState:
-		sid, cid, zid, interest, x, y, hp, err := wire.DecodeAttachWithState(fr.Payload)
-		if err != nil || uint32(zid) != s.cfg.ZoneID {
-			_ = wire.WriteFrame(s.w, wire.MsgError, wire.EncodeError(wire.ErrBadMsg, "bad attach-with-state"))
+		sid, cid, zid, interest, x, y, hp, xfer, err := wire.DecodeAttachWithState(fr.Payload)
+		if err != nil {
+			l.sendError(wire.ErrBadMsg, "bad attach-with-state")
+			return
+		}
+		if why := s.refuseAttachWithState(sid, zid, x, y); why != "" {
+			_ = l.send(wire.MsgAttachNack, wire.EncodeAttachNack(sid, xfer, wire.ErrTransfer, why))
 			return
 		}
 		s.mu.Lock()
-		if _, ok := s.players[sid]; !ok {
+		if p, ok := s.players[sid]; ok {
+			// a repeated attach (or a re-attach after a link drop)
+			s.rebindLocked(p, l)
+		} else {
+			s.dropGhostOfLocked(cid)
 			eid := s.world.Spawn(wire.KindPlayer, cid, x, y)
 			s.posHist[eid] = newPosHistory(s.cfg.HistoryTicks)
 			s.world.HP[eid] = hp
 			s.players[sid] = &player{
 				SID: sid, CID: cid, EID: eid,
+				gw: l,
 				Interest: interest,
-				known: make(map[shared.EntityID]struct{}),
-				lastSentPos: make(map[shared.EntityID][2]int16),
-				lastSentHP: make(map[shared.EntityID]uint16),
+				move: newRepBaseline[[2]int16](),
+				state: newRepBaseline[uint16](),
 				pendingEvents: []string{"entered zone"},
 			}
 			// spawn some NPCs around on first attach to show AI/combat
 			for _, ne := range s.world.RandomNearbyNPCSpawn(x, y, 3) { s.posHist[ne] = newPosHistory(s.cfg.HistoryTicks) }
 		}
 		s.mu.Unlock()
-		_ = wire.WriteFrame(s.w, wire.MsgAttachAck, nil)
+		_ = l.send(wire.MsgAttachAck, wire.EncodeAttachAck(sid, xfer))
 
 	case wire.MsgDetachPlayer:
 		sid, err := wire.DecodeDetachPlayer(fr.Payload)
 		if err != nil { return }
 		s.mu.Lock()
-		s.detachLocked(sid, "detach")
+		if s.ownedLocked(l, sid) != nil { s.detachLocked(sid, "detach") }
 		s.mu.Unlock()
 
 	case wire.MsgPlayerInput:
 		sid, tick, mx, my, err := wire.DecodePlayerInput(fr.Payload)
 		if err != nil { return }
 		s.mu.Lock()
-		p := s.players[sid]
+		p := s.ownedLocked(l, sid)
 		if p == nil { s.mu.Unlock(); return }
 		// freeze if transfer pending
 		if _, pending := s.transferPending[sid]; pending {
@@ -284,68 +533,139 @@ func (s *Server) handleFrame(ctx context.Context, fr wire.Frame) {
 		s.world.VelY[eid] = my
 		s.mu.Unlock()
 
+	case wire.MsgRepAck:
+		sid, tick, ch, err := wire.DecodeRepAck(fr.Payload)
+		if err != nil { return }
+		s.mu.Lock()
+		if p := s.ownedLocked(l, sid); p != nil {
+			switch ch {
+			case wire.ChanMove:
+				p.move.ack(tick)
+			case wire.ChanState:
+				p.state.ack(tick)
+			}
+		}
+		s.mu.Unlock()
+
+	case wire.MsgPlayerBudget:
+		sid, bpt, err := wire.DecodePlayerBudget(fr.Payload)
+		if err != nil { return }
+		// never below what a spawn or two needs, never far past the configured default
+		b := int(bpt)
+		if b < minPlayerBudget { b = minPlayerBudget }
+		if b > 4*s.cfg.BudgetBytes { b = 4*s.cfg.BudgetBytes }
+		s.mu.Lock()
+		if p := s.ownedLocked(l, sid); p != nil { p.budget = b }
+		s.mu.Unlock()
+
+	case wire.MsgPlayerLink:
+		sid, ls, err := wire.DecodePlayerLink(fr.Payload)
+		if err != nil { return }
+		s.mu.Lock()
+		if p := s.ownedLocked(l, sid); p != nil { p.link = ls }
+		s.mu.Unlock()
+
+	case wire.MsgPlayerParty:
+		sid, members, err := wire.DecodePlayerParty(fr.Payload)
+		if err != nil { return }
+		s.mu.Lock()
+		if p := s.ownedLocked(l, sid); p != nil {
+			p.party = make(map[shared.CharacterID]struct{}, len(members))
+			for _, cid := range members { p.party[cid] = struct{}{} }
+		}
+		s.mu.Unlock()
+
 	case wire.MsgPlayerAction:
 		sid, tick, skill, target, err := wire.DecodePlayerAction(fr.Payload)
 		if err != nil { return }
 		s.mu.Lock()
-		p := s.players[sid]
+		p := s.ownedLocked(l, sid)
 		if p == nil { s.mu.Unlock(); return }
 		// strict anti-cheat: use serverTick for cooldown, ignore client tick besides anti-spam window
 		_ = tick
 		if skill != 1 {
 			s.mu.Unlock()
-			_ = wire.WriteFrame(s.w, wire.MsgError, wire.EncodeError(wire.ErrBadAction, "unknown skill"))
+			l.sendError(wire.ErrBadAction, "unknown skill")
 			return
 		}
 		// Step24: lag compensation - use client-provided action tick as claimed server tick
 actionTick := tick
-if actionTick == 0 || actionTick > s.serverTick || (s.serverTick-actionTick) > s.cfg.RewindMaxTicks {
+if actionTick == 0 || actionTick > s.serverTick || (s.serverTick-actionTick) > s.rewindLimitLocked(p) {
+	p.badTicks++
+	if p.badTicks >= maxBadActionTicks && l.caps.Has(wire.CapKick) {
+		s.detachLocked(sid, "kick")
+		s.mu.Unlock()
+		s.kick(l, sid, "action ticks out of sync")
+		return
+	}
 	s.mu.Unlock()
-	_ = wire.WriteFrame(s.w, wire.MsgError, wire.EncodeError(wire.ErrBadAction, "bad action tick"))
+	l.sendError(wire.ErrBadAction, "bad action tick")
 	return
 }
+p.badTicks = 0
 ax, ay, okA := s.posAtLocked(p.EID, actionTick)
 tx, ty, okT := s.posAtLocked(target, actionTick)
 if !okA || !okT {
 	s.mu.Unlock()
-	_ = wire.WriteFrame(s.w, wire.MsgError, wire.EncodeError(wire.ErrBadAction, "no history"))
+	l.sendError(wire.ErrBadAction, "no history")
 	return
 }
 ok, reason := s.world.ResolveSkill1At(p.EID, target, s.serverTick, ax, ay, tx, ty)
 if ok {
 			p.pendingEvents = append(p.pendingEvents, "hit")
 		} else {
-			_ = wire.WriteFrame(s.w, wire.MsgError, wire.EncodeError(reason, "action rejected"))
+			l.sendError(reason, "action rejected")
 		}
 		s.mu.Unlock()
 
 	case wire.MsgTransferCommit:
-		sid, err := wire.DecodeTransferCommit(fr.Payload)
+		sid, xfer, err := wire.DecodeTransferCommit(fr.Payload)
 		if err != nil { return }
 		s.mu.Lock()
-		// finalize: remove player/entity
-		if pt := s.transferPending[sid]; pt != nil {
+		// finalize: remove player/entity. A repeated or stale commit finds no
+		// matching pending transfer and does nothing.
+		if pt := s.transferPending[sid]; pt != nil && pt.ID == xfer && s.ownedLocked(l, sid) != nil {
 			s.detachLocked(sid, "transfer commit")
 			delete(s.transferPending, sid)
 		}
 		s.mu.Unlock()
 
 	case wire.MsgTransferAbort:
-		sid, err := wire.DecodeTransferAbort(fr.Payload)
+		sid, xfer, err := wire.DecodeTransferAbort(fr.Payload)
 		if err != nil { return }
 		s.mu.Lock()
-		// unfreeze by clearing pending; keep player alive
-		delete(s.transferPending, sid)
+		// unfreeze by clearing pending; keep player alive. Same matching as commit.
+		if pt := s.transferPending[sid]; pt != nil && pt.ID == xfer {
+			if p := s.ownedLocked(l, sid); p != nil {
+				delete(s.transferPending, sid)
+				p.xferRetryAt = s.serverTick + s.cfg.TransferRetryTicks
+			}
+		}
 		s.mu.Unlock()
 
 	default:
 	}
 }
 
-func (s *Server) attachFromStore(ctx context.Context, sid shared.SessionID, cid shared.CharacterID, interest wire.InterestMask) {
+// refuseAttachWithState says why a transfer into this zone cannot be taken,
+// or "" if it can.
+func (s *Server) refuseAttachWithState(sid shared.SessionID, zid shared.ZoneID, x, y int16) string {
+	if uint32(zid) != s.cfg.ZoneID { return "wrong zone" }
+	if wz, _ := s.cfg.World.Zone(mapZoneID(s.cfg)); !wz.Area.Contains(x, y) { return "arrival outside zone" }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// still leaving here: taking it back now would race the other transfer
+	if _, pending := s.transferPending[sid]; pending { return "transfer out in progress" }
+	return ""
+}
+
+func (s *Server) attachFromStore(ctx context.Context, l *gwLink, sid shared.SessionID, cid shared.CharacterID, interest wire.InterestMask) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.players[sid]; ok { return }
+	if p, ok := s.players[sid]; ok {
+		s.rebindLocked(p, l)
+		return
+	}
 
 	base, found, _ := s.cfg.Store.LoadCharacter(ctx, cid)
 	if !found {
@@ -357,6 +677,7 @@ func (s *Server) attachFromStore(ctx context.Context, sid shared.SessionID, cid
 		base.ZoneID = shared.ZoneID(s.cfg.ZoneID)
 	}
 
+	s.dropGhostOfLocked(cid)
 	eid := s.world.Spawn(wire.KindPlayer, cid, base.X, base.Y)
 	s.posHist[eid] = newPosHistory(s.cfg.HistoryTicks)
 	s.world.HP[eid] = base.HP
@@ -366,15 +687,34 @@ func (s *Server) attachFromStore(ctx context.Context, sid shared.SessionID, cid
 	}
 	s.players[sid] = &player{
 		SID: sid, CID: cid, EID: eid,
+		gw: l,
 		Interest: interest,
-		known: make(map[shared.EntityID]struct{}),
-		lastSentPos: make(map[shared.EntityID][2]int16),
-		lastSentHP: make(map[shared.EntityID]uint16),
+		move: newRepBaseline[[2]int16](),
+		state: newRepBaseline[uint16](),
 		pendingEvents: []string{"welcome"},
 	}
 	for _, ne := range s.world.RandomNearbyNPCSpawn(base.X, base.Y, 3) { s.posHist[ne] = newPosHistory(s.cfg.HistoryTicks) }
 }
 
+// rebindLocked moves an attached session to the gateway that re-attached it.
+// The client behind the new link holds none of our frames, so baselines restart.
+func (s *Server) rebindLocked(p *player, l *gwLink) {
+	if p.gw == l { return }
+	p.gw = l
+	p.move = newRepBaseline[[2]int16]()
+	p.state = newRepBaseline[uint16]()
+	p.budget = 0 // the new gateway reports its own
+	p.link = wire.LinkStats{}
+}
+
+// ownedLocked returns the player only if l is the gateway that owns it, so a
+// stale gateway cannot drive or detach a session another gateway took over.
+func (s *Server) ownedLocked(l *gwLink, sid shared.SessionID) *player {
+	p := s.players[sid]
+	if p == nil || p.gw != l { return nil }
+	return p
+}
+
 func (s *Server) detachLocked(sid shared.SessionID, why string) {
 	p := s.players[sid]
 	if p == nil { return }
@@ -417,6 +757,7 @@ func (s *Server) enqueueSnapshotLocked() {
 		Entities: make([]persist.SnapshotEntity, 0, len(s.world.Kind)),
 	}
 	for eid := range s.world.Kind {
+		if s.world.Ghost[eid] { continue } // the neighbour saves its own
 		snap.Entities = append(snap.Entities, persist.SnapshotEntity{
 			EID: uint32(eid),
 			Kind: uint8(s.world.Kind[eid]),
@@ -468,6 +809,12 @@ type eidDist struct { eid shared.EntityID; d2 int32 }
 func (s *Server) step(ctx context.Context) {
 	s.mu.Lock()
 	s.serverTick++
+	var syncTo []*gwLink
+	if s.serverTick%uint32(s.cfg.TickHz) == 0 {
+		for _, l := range s.links {
+			if l.caps.Has(wire.CapTickSync) { syncTo = append(syncTo, l) }
+		}
+	}
 
 	// Step17: AI budget + LOD (only NPCs near any player)
 	aiBudget := s.cfg.AIBudgetPerTick
@@ -479,7 +826,7 @@ func (s *Server) step(ctx context.Context) {
 		}
 		for eid, kind := range s.world.Kind {
 			if aiBudget <= 0 { break }
-			if kind != wire.KindNPC { continue }
+			if kind != wire.KindNPC || s.world.Ghost[eid] { continue }
 			// LOD: only update NPCs within 35 units of any player
 			nx, ny := s.world.PosX[eid], s.world.PosY[eid]
 			near := false
@@ -506,31 +853,51 @@ for eid := range s.world.Kind {
 	h.add(s.serverTick, s.world.PosX[eid], s.world.PosY[eid])
 }
 
-	// Step13: handle transfer timeouts (abort)
+	// Step13: transfers the gateway has not settled in time. The gateway
+	// owns the outcome (its commit may be on the way, the target may already
+	// hold the player), so we ask it again rather than unfreeze on our own;
+	// only a gateway that cannot answer gets the local abort.
 	for sid, pt := range s.transferPending {
-		if s.serverTick - pt.StartedTick > s.cfg.TransferTimeoutTicks {
+		if s.serverTick - pt.StartedTick <= s.cfg.TransferTimeoutTicks { continue }
+		p := s.players[sid]
+		if p == nil {
 			delete(s.transferPending, sid)
-			_ = wire.WriteFrame(s.w, wire.MsgError, wire.EncodeError(wire.ErrTransfer, "transfer timeout"))
+			continue
+		}
+		if p.gw.caps.Has(wire.CapXferQuery) {
+			pt.StartedTick = s.serverTick // ask again after another timeout
+			_ = p.gw.send(wire.MsgTransferQuery, wire.EncodeTransferQuery(sid, pt.ID))
+			continue
 		}
+		delete(s.transferPending, sid)
+		p.xferRetryAt = s.serverTick + s.cfg.TransferRetryTicks
+		p.gw.sendError(wire.ErrTransfer, "transfer timeout")
 	}
 
 	sendState := (s.serverTick % uint32(s.cfg.StateEveryTicks)) == 0
 	doSave := (s.serverTick % uint32(s.cfg.SaveEveryTicks)) == 0
-	doSnap := (s.serverTick % uint32(s.cfg.SnapshotEveryTicks)) == 0
+	// an instance is thrown away when done; only its characters are saved
+	doSnap := s.cfg.Template == 0 && (s.serverTick % uint32(s.cfg.SnapshotEveryTicks)) == 0
 
-	// detect boundary transfer and emit prepare (Step13)
+	// detect edge/portal transfer and emit prepare (Step13)
 	for sid, p := range s.players {
 		if _, pending := s.transferPending[sid]; pending { continue }
-		x := s.world.PosX[p.EID]
-		if s.shouldTransfer(x) {
+		// an aborted target (full, down, no instance) would abort again at
+		// once; a player left standing on the portal waits a little
+		if p.xferRetryAt != 0 && int32(s.serverTick - p.xferRetryAt) < 0 { continue }
+		r, ok := s.cfg.World.Route(mapZoneID(s.cfg), s.world.PosX[p.EID], s.world.PosY[p.EID])
+		if ok {
 			// freeze movement
 			s.world.VelX[p.EID] = 0
 			s.world.VelY[p.EID] = 0
+			// X/Y are where the player lands in the target zone
+			s.xferSeq++
 			pt := &pendingTransfer{
-				TargetZone: shared.ZoneID(s.cfg.TransferTargetZone),
+				ID: s.xferSeq,
+				TargetZone: r.To,
 				StartedTick: s.serverTick,
-				X: s.world.PosX[p.EID],
-				Y: s.world.PosY[p.EID],
+				X: r.X,
+				Y: r.Y,
 				HP: s.world.HP[p.EID],
 				Interest: p.Interest,
 				CID: p.CID,
@@ -541,8 +908,8 @@ for eid := range s.world.Kind {
 			s.enqueueCharacterLocked(p.CID, p.EID)
 
 			st := persist.CharacterState{CharacterID: p.CID, ZoneID: shared.ZoneID(s.cfg.ZoneID), X: pt.X, Y: pt.Y, HP: pt.HP, ServerTick: s.serverTick}
-			payload := wire.EncodeTransferPrepare(p.SID, p.CID, pt.TargetZone, pt.Interest, st)
-			_ = wire.WriteFrame(s.w, wire.MsgTransferPrepare, payload)
+			payload := wire.EncodeTransferPrepare(p.SID, p.CID, pt.TargetZone, pt.Interest, st, pt.ID)
+			_ = p.gw.send(wire.MsgTransferPrepare, payload)
 			p.pendingEvents = append(p.pendingEvents, "transfer_prepare")
 		}
 	}
@@ -550,12 +917,18 @@ for eid := range s.world.Kind {
 	// replication per player (AOI + interest filters)
 	type perOut struct {
 		sid shared.SessionID
+		gw *gwLink
+		moveBase, stateBase uint32
 		ev []wire.RepEvent
 		move []wire.RepEvent
 		state []wire.RepEvent
 	}
 	out := make([]perOut, 0, len(s.players))
 
+	// party members are looked up by character
+	byCID := make(map[shared.CharacterID]shared.EntityID, len(s.players))
+	for _, p := range s.players { byCID[p.CID] = p.EID }
+
 	tmp := make([]uint32, 0, 256)
 	for sid, p := range s.players {
 		// if transfer pending, still allow event channel to show "loading" but stop movement/state
@@ -567,10 +940,18 @@ for eid := range s.world.Kind {
 		tmp = tmp[:0]
 		cands := s.grid.QueryCircle(px, py, s.cfg.AOIRadius, tmp)
 
-		newSet := make(map[shared.EntityID]struct{}, len(cands))
-		dists := make([]eidDist, 0, len(cands))
+		newSet := make(map[shared.EntityID]struct{}, len(cands)+len(p.party))
+		dists := make([]eidDist, 0, len(cands)+len(p.party))
+		// party members are in view wherever they are, and go first
+		for cid := range p.party {
+			if eid, ok := byCID[cid]; ok {
+				newSet[eid] = struct{}{}
+				dists = append(dists, eidDist{eid: eid, d2: -1})
+			}
+		}
 		for _, eidU := range cands {
 			eid := shared.EntityID(eidU)
+			if _, ok := newSet[eid]; ok { continue }
 			newSet[eid] = struct{}{}
 			ex, ey, ok := s.grid.GetPos(eidU)
 			if !ok { continue }
@@ -593,131 +974,201 @@ for eid := range s.world.Kind {
 		move := make([]wire.RepEvent, 0, 64)
 		state := make([]wire.RepEvent, 0, 16)
 
+		var moveBase, stateBase uint32
 		if !pending && (p.Interest & wire.InterestMove != 0) {
+			base := p.move.base()
+			moveBase = base.tick
 			// despawn
-			for eid := range p.known {
+			for eid := range base.ents {
 				if _, ok := newSet[eid]; !ok {
 					move = append(move, wire.RepEvent{Op: wire.RepDespawn, EID: eid})
-					delete(p.known, eid)
-					delete(p.lastSentPos, eid)
-					delete(p.lastSentHP, eid)
 				}
 			}
 
-			// spawn/move with interest filtering
+			// spawn/move with interest filtering, diffed against the acked view
 			for _, ed := range dists {
 				eid := ed.eid
 				mask := s.world.Mask[eid]
 				if (mask & p.Interest) == 0 {
 					continue
 				}
-				if _, ok := p.known[eid]; !ok {
+				x, y := s.world.PosX[eid], s.world.PosY[eid]
+				if prev, ok := base.ents[eid]; !ok {
 					move = append(move, wire.RepEvent{
-						Op: wire.RepSpawn, EID: eid, X: s.world.PosX[eid], Y: s.world.PosY[eid],
+						Op: wire.RepSpawn, EID: eid, X: x, Y: y,
 						Kind: s.world.Kind[eid], Mask: mask,
 					})
-					p.known[eid] = struct{}{}
-					p.lastSentPos[eid] = [2]int16{s.world.PosX[eid], s.world.PosY[eid]}
-					p.lastSentHP[eid] = s.world.HP[eid]
-				} else {
-					prev := p.lastSentPos[eid]
-					if prev[0] != s.world.PosX[eid] || prev[1] != s.world.PosY[eid] {
-						move = append(move, wire.RepEvent{Op: wire.RepMove, EID: eid, X: s.world.PosX[eid], Y: s.world.PosY[eid]})
-						p.lastSentPos[eid] = [2]int16{s.world.PosX[eid], s.world.PosY[eid]}
-					}
+				} else if prev != [2]int16{x, y} {
+					move = append(move, moveEvent(p.gw.caps, eid, prev, x, y))
 				}
 				if len(move) >= 256 { break }
 			}
 		}
 
+		// budget greedy: ev -> move -> state
+		b := s.cfg.BudgetBytes
+		if p.budget > 0 { b = p.budget }
+		ev = trimBudget(ev, b, estSize); b -= estSize(ev)
+		moveSize := estSize
+		if p.gw.caps.Has(wire.CapDeltaMove) { moveSize = estSizePacked }
+		move = trimBudget(move, b, moveSize); b -= moveSize(move)
+
+		// what the client will hold once this tick's move message lands
+		view := p.move.base().clone(s.serverTick)
+		applyMoveEvents(view.ents, move)
+		if len(move) > 0 {
+			p.move.record(view)
+			// a gateway that cannot relay acks gets the old assume-delivered behaviour
+			if !p.gw.caps.Has(wire.CapRepAck) { p.move.ack(view.tick) }
+		}
+
 		if !pending && sendState && (p.Interest & wire.InterestState != 0) {
+			base := p.state.base()
+			stateBase = base.tick
 			for _, ed := range dists {
 				eid := ed.eid
-				mask := s.world.Mask[eid]
-				if (mask & p.Interest) == 0 { continue }
-				if _, ok := p.known[eid]; !ok { continue }
-				if p.lastSentHP[eid] != s.world.HP[eid] {
+				if _, ok := view.ents[eid]; !ok { continue }
+				if hp, ok := base.ents[eid]; !ok || hp != s.world.HP[eid] {
 					state = append(state, wire.RepEvent{Op: wire.RepStateHP, EID: eid, Val: s.world.HP[eid]})
-					p.lastSentHP[eid] = s.world.HP[eid]
 				}
 				if len(state) >= 64 { break }
 			}
+			state = trimBudget(state, b, estSize)
+			if len(state) > 0 {
+				sv := repView[uint16]{tick: s.serverTick, ents: make(map[shared.EntityID]uint16, len(view.ents))}
+				for eid := range view.ents {
+					if hp, ok := base.ents[eid]; ok { sv.ents[eid] = hp }
+				}
+				for _, e := range state { sv.ents[e.EID] = e.Val }
+				p.state.record(sv)
+				if !p.gw.caps.Has(wire.CapRepAck) { p.state.ack(sv.tick) }
+			}
 		}
 
-		// budget greedy: ev -> move -> state
-		b := s.cfg.BudgetBytes
-		ev = trimBudget(ev, b); b -= estSize(ev)
-		move = trimBudget(move, b); b -= estSize(move)
-		state = trimBudget(state, b)
-
 		if len(ev)+len(move)+len(state) > 0 {
-			out = append(out, perOut{sid: p.SID, ev: ev, move: move, state: state})
+			out = append(out, perOut{sid: p.SID, gw: p.gw, moveBase: moveBase, stateBase: stateBase, ev: ev, move: move, state: state})
 		}
 	}
 
 	if doSave { s.enqueueDirtyLocked() }
 	if doSnap { s.enqueueSnapshotLocked() }
+	ghostOut := s.collectGhostsLocked()
 
 	// update metrics
-	s.met.Entities.Store(int64(len(s.world.Kind)))
+	s.met.Entities.Store(int64(len(s.world.Kind) - len(s.world.Ghost)))
 	s.met.Players.Store(int64(len(s.players)))
 
 	s.mu.Unlock()
 
+	// tick start is when the step began; the step's own time is well under a tick
+	for _, l := range syncTo { _ = l.send(wire.MsgTickSync, wire.EncodeTickSync(s.serverTick)) }
+	for _, g := range ghostOut { _ = g.l.send(wire.MsgGhosts, g.payload) }
+
 	for _, m := range out {
 		if len(m.ev) > 0 {
-			p := wire.EncodeReplicate(m.sid, s.serverTick, wire.ChanEvent, m.ev)
+			p := wire.EncodeReplicate(m.sid, s.serverTick, 0, wire.ChanEvent, m.ev)
 			s.met.AddRepBytes(len(p))
-			_ = wire.WriteFrame(s.w, wire.MsgReplicate, p)
+			_ = m.gw.send(wire.MsgReplicate, p)
 		}
 		if len(m.move) > 0 {
-			p := wire.EncodeReplicate(m.sid, s.serverTick, wire.ChanMove, m.move)
+			typ, p := wire.MsgReplicate, []byte(nil)
+			if m.gw.caps.Has(wire.CapDeltaMove) {
+				typ, p = wire.MsgReplicateDelta, wire.EncodeReplicateDelta(m.sid, s.serverTick, m.moveBase, wire.ChanMove, m.move)
+			} else {
+				p = wire.EncodeReplicate(m.sid, s.serverTick, m.moveBase, wire.ChanMove, m.move)
+			}
 			s.met.AddRepBytes(len(p))
-			_ = wire.WriteFrame(s.w, wire.MsgReplicate, p)
+			_ = m.gw.send(typ, p)
 		}
 		if len(m.state) > 0 {
-			p := wire.EncodeReplicate(m.sid, s.serverTick, wire.ChanState, m.state)
+			p := wire.EncodeReplicate(m.sid, s.serverTick, m.stateBase, wire.ChanState, m.state)
 			s.met.AddRepBytes(len(p))
-			_ = wire.WriteFrame(s.w, wire.MsgReplicate, p)
+			_ = m.gw.send(wire.MsgReplicate, p)
 		}
 	}
 
 	_ = ctx
 }
 
-func (s *Server) shouldTransfer(x int16) bool {
-	b := s.cfg.TransferBoundaryX
-	if b > 0 { return x > b }
-	if b < 0 { return x < b }
-	return false
+// moveEvent encodes a move against the baseline position prev: the cheaper
+// of delta and absolute in delta mode, absolute otherwise.
+func moveEvent(caps wire.Caps, eid shared.EntityID, prev [2]int16, x, y int16) wire.RepEvent {
+	abs := wire.RepEvent{Op: wire.RepMove, EID: eid, X: x, Y: y}
+	if !caps.Has(wire.CapDeltaMove) {
+		return abs
+	}
+	d := wire.RepEvent{Op: wire.RepMoveDelta, EID: eid, X: x - prev[0], Y: y - prev[1]}
+	if wire.PackedRepEventSize(d) >= wire.PackedRepEventSize(abs) {
+		return abs
+	}
+	return d
 }
 
-// budget estimation for wire.RepEvent list (coarse upper bound)
-func estSize(evs []wire.RepEvent) int {
-	sz := 23
+// applyMoveEvents applies move-channel events to a view, the same way the
+// client rebuilds its frame from the baseline.
+func applyMoveEvents(ents map[shared.EntityID][2]int16, evs []wire.RepEvent) {
 	for _, e := range evs {
 		switch e.Op {
-		case wire.RepSpawn:
-			sz += 1+4+1+4+4
-		case wire.RepMove:
-			sz += 1+4+4
+		case wire.RepSpawn, wire.RepMove:
+			ents[e.EID] = [2]int16{e.X, e.Y}
+		case wire.RepMoveDelta:
+			prev := ents[e.EID]
+			ents[e.EID] = [2]int16{prev[0] + e.X, prev[1] + e.Y}
 		case wire.RepDespawn:
-			sz += 1+4
-		case wire.RepStateHP:
-			sz += 1+4+2
-		case wire.RepEventText:
-			l := len(e.Text); if l > 65535 { l = 65535 }
-			sz += 1+2+l
+			delete(ents, e.EID)
 		}
 	}
+}
+
+// maxBadActionTicks in a row gets a player kicked: a client that keeps
+// claiming ticks its link cannot explain is broken or rewinding on purpose.
+const maxBadActionTicks = 10
+
+// kick asks gateway l to end session sid, showing reason to the player. The
+// caller has already detached the player here.
+func (s *Server) kick(l *gwLink, sid shared.SessionID, reason string) {
+	log.Printf("zone %d: kick sid=%s: %s", s.cfg.ZoneID, sid.String(), reason)
+	_ = l.send(wire.MsgKick, wire.EncodeKick(sid, reason))
+}
+
+// rewindSlack covers the client's tick estimate error and tick rounding on
+// top of the measured one-way delay.
+const rewindSlack = 100 * time.Millisecond
+
+// rewindLimitLocked is how many ticks back p may claim to have acted: half
+// the RTT plus twice the jitter the gateway measured (MsgPlayerLink) and
+// rewindSlack, never more than RewindMaxTicks. Before any measurement only
+// the cap applies.
+func (s *Server) rewindLimitLocked(p *player) uint32 {
+	max := s.cfg.RewindMaxTicks
+	if p.link.RTTMs == 0 { return max }
+	d := time.Duration(p.link.RTTMs)*time.Millisecond/2 + 2*time.Duration(p.link.JitterMs)*time.Millisecond + rewindSlack
+	n := uint32(d*time.Duration(s.cfg.TickHz)/time.Second) + 1
+	if n < max { return n }
+	return max
+}
+
+// minPlayerBudget is the floor for a gateway-supplied budget.
+const minPlayerBudget = 128
+
+// budget estimation for wire.RepEvent list (coarse upper bound)
+func estSize(evs []wire.RepEvent) int {
+	sz := wire.ReplicateHeaderLen
+	for _, e := range evs { sz += wire.RepEventSize(e) }
 	return sz
 }
-func trimBudget(evs []wire.RepEvent, budget int) []wire.RepEvent {
-	if budget <= 23 { return evs[:0] }
+
+// estSizePacked is estSize for the delta (packed) move encoding.
+func estSizePacked(evs []wire.RepEvent) int {
+	return wire.ReplicateHeaderLen + wire.PackedRepEventsSize(evs)
+}
+
+func trimBudget(evs []wire.RepEvent, budget int, size func([]wire.RepEvent) int) []wire.RepEvent {
+	if budget <= wire.ReplicateHeaderLen { return evs[:0] }
 	out := evs[:0]
 	for _, e := range evs {
 		out = append(out, e)
-		if estSize(out) > budget {
+		if size(out) > budget {
 			out = out[:len(out)-1]
 			break
 		}
@@ -24,6 +24,9 @@ type World struct {
 
 	Dirty  map[shared.EntityID]bool
 
+	// read-only copies of a neighbour zone's entities (see ghost.go)
+	Ghost  map[shared.EntityID]bool
+
 	// Cooldowns: eid -> next serverTick allowed for skill1
 	Skill1CD map[shared.EntityID]uint32
 }
@@ -41,6 +44,7 @@ func NewWorld() *World {
 		HP: make(map[shared.EntityID]uint16),
 		Mask: make(map[shared.EntityID]wire.InterestMask),
 		Dirty: make(map[shared.EntityID]bool),
+		Ghost: make(map[shared.EntityID]bool),
 		Skill1CD: make(map[shared.EntityID]uint32),
 	}
 }
@@ -74,6 +78,7 @@ func (w *World) Despawn(eid shared.EntityID) {
 	delete(w.HP, eid)
 	delete(w.Mask, eid)
 	delete(w.Dirty, eid)
+	delete(w.Ghost, eid)
 	delete(w.Skill1CD, eid)
 }
 
@@ -117,7 +122,7 @@ func (w *World) ResolveSkill1At(attacker, target shared.EntityID, serverTick uin
 	if w.Kind[attacker] != wire.KindPlayer {
 		return false, wire.ErrBadAction
 	}
-	if _, exists := w.Kind[target]; !exists {
+	if _, exists := w.Kind[target]; !exists || w.Ghost[target] {
 		return false, wire.ErrBadAction
 	}
 	if serverTick < w.Skill1CD[attacker] {